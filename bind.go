@@ -0,0 +1,188 @@
+package nu
+
+import (
+	"fmt"
+	"reflect"
+)
+
+/*
+BindPositional assigns values of the positional arguments to the fields of
+the struct dst points to. Exported fields of the struct are bound in the
+order of declaration, ie first field gets the value of the first positional
+argument (see [ExecCommand.PositionalOrDefault], so default value is used
+for omitted optional argument). Fields tagged with `nu:"-"` are skipped.
+
+When argument (and it's default) is Nothing the field is left unchanged.
+
+The Value is converted to the type of the field:
+
+  - field of type Value gets the Value as is;
+  - Int value can be assigned to any numeric field as long as the value
+    fits into the field's type, Float value only to float field;
+  - String and Glob can be assigned to string field;
+  - List can be assigned to slice when items are assignable to the
+    slice's element type;
+  - Record can be assigned to map with string key when fields are
+    assignable to the map's element type;
+  - pointer fields are allocated and value is assigned to the pointee;
+  - otherwise Value must be assignable to the field.
+*/
+func (ec *ExecCommand) BindPositional(dst any) error {
+	rv, err := structPtr(dst)
+	if err != nil {
+		return err
+	}
+
+	idx := 0
+	for i := range rv.NumField() {
+		f := rv.Type().Field(i)
+		if !f.IsExported() || f.Tag.Get("nu") == "-" {
+			continue
+		}
+		if v := ec.PositionalOrDefault(idx); v.Value != nil {
+			if err := assignValue(rv.Field(i), v); err != nil {
+				return fmt.Errorf("binding positional argument [%d] to field %s: %w", idx, f.Name, err)
+			}
+		}
+		idx++
+	}
+	return nil
+}
+
+/*
+BindFlags assigns values of the named arguments (flags) to the fields of the
+struct dst points to. Field is bound to the flag named by the field's "nu"
+tag, ie
+
+	var flags struct {
+		Major bool   `nu:"major"`
+		Out   string `nu:"output"`
+	}
+	err := exec.BindFlags(&flags)
+
+Fields without the tag are skipped. The value is obtained using
+[ExecCommand.FlagValue] so toggle flags are always bound (false when not
+set) and default values from the signature are used for flags which were not
+set by user. When flag value is Nothing the field is left unchanged.
+
+See [ExecCommand.BindPositional] for the Value conversion rules.
+*/
+func (ec *ExecCommand) BindFlags(dst any) error {
+	rv, err := structPtr(dst)
+	if err != nil {
+		return err
+	}
+
+	for i := range rv.NumField() {
+		f := rv.Type().Field(i)
+		name := f.Tag.Get("nu")
+		if !f.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		if v, _ := ec.FlagValue(name); v.Value != nil {
+			if err := assignValue(rv.Field(i), v); err != nil {
+				return fmt.Errorf("binding flag %q to field %s: %w", name, f.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func structPtr(dst any) (reflect.Value, error) {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("destination must be non-nil pointer to struct, got %T", dst)
+	}
+	return rv.Elem(), nil
+}
+
+var valueType = reflect.TypeFor[Value]()
+
+/*
+assignValue converts v to the type of dst and assigns it.
+*/
+func assignValue(dst reflect.Value, v Value) error {
+	if dst.Type() == valueType {
+		dst.Set(reflect.ValueOf(v))
+		return nil
+	}
+	if v.Value == nil {
+		dst.SetZero()
+		return nil
+	}
+
+	src := reflect.ValueOf(v.Value)
+	switch dst.Kind() {
+	case reflect.Pointer:
+		p := reflect.New(dst.Type().Elem())
+		if err := assignValue(p.Elem(), v); err != nil {
+			return err
+		}
+		dst.Set(p)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if src.CanInt() && !src.Type().AssignableTo(dst.Type()) {
+			if n := src.Int(); !dst.OverflowInt(n) {
+				dst.SetInt(n)
+				return nil
+			}
+			return fmt.Errorf("value %d overflows %s", src.Int(), dst.Type())
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if src.CanInt() {
+			if n := src.Int(); n >= 0 && !dst.OverflowUint(uint64(n)) {
+				dst.SetUint(uint64(n))
+				return nil
+			}
+			return fmt.Errorf("value %d overflows %s", src.Int(), dst.Type())
+		}
+	case reflect.Float32, reflect.Float64:
+		switch {
+		case src.CanFloat():
+			dst.SetFloat(src.Float())
+			return nil
+		case src.CanInt():
+			dst.SetFloat(float64(src.Int()))
+			return nil
+		}
+	case reflect.String:
+		switch data := v.Value.(type) {
+		case string:
+			dst.SetString(data)
+			return nil
+		case Glob:
+			dst.SetString(data.Value)
+			return nil
+		}
+	case reflect.Slice:
+		if items, ok := v.Value.([]Value); ok && dst.Type().Elem() != valueType {
+			s := reflect.MakeSlice(dst.Type(), len(items), len(items))
+			for i, item := range items {
+				if err := assignValue(s.Index(i), item); err != nil {
+					return fmt.Errorf("list item [%d]: %w", i, err)
+				}
+			}
+			dst.Set(s)
+			return nil
+		}
+	case reflect.Map:
+		if rec, ok := v.Value.(Record); ok && dst.Type().Key().Kind() == reflect.String && dst.Type() != reflect.TypeFor[Record]() {
+			m := reflect.MakeMapWithSize(dst.Type(), len(rec))
+			for k, fv := range rec {
+				item := reflect.New(dst.Type().Elem()).Elem()
+				if err := assignValue(item, fv); err != nil {
+					return fmt.Errorf("record field %q: %w", k, err)
+				}
+				m.SetMapIndex(reflect.ValueOf(k).Convert(dst.Type().Key()), item)
+			}
+			dst.Set(m)
+			return nil
+		}
+	}
+
+	if !src.Type().AssignableTo(dst.Type()) {
+		return fmt.Errorf("can't assign %T value to %s", v.Value, dst.Type())
+	}
+	dst.Set(src)
+	return nil
+}
@@ -0,0 +1,179 @@
+package nu
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ainvaltin/nu-plugin/syntaxshape"
+)
+
+func Test_ExecCommand_BindPositional(t *testing.T) {
+	p := &Plugin{cmds: map[string]*Command{
+		"cmd": {
+			Signature: PluginSignature{
+				Name: "cmd",
+				RequiredPositional: PositionalArgs{
+					{Name: "file"},
+					{Name: "count"},
+				},
+				OptionalPositional: PositionalArgs{
+					{Name: "mode", Default: &Value{Value: "fast"}},
+					{Name: "limit"},
+				},
+			},
+		},
+	}}
+
+	type args struct {
+		File    string
+		Count   int
+		skipped string
+		Ignored bool `nu:"-"`
+		Mode    string
+		Limit   *uint8
+	}
+
+	t.Run("all arguments supplied", func(t *testing.T) {
+		ec := &ExecCommand{p: p, Name: "cmd", Positional: []Value{{Value: "a.txt"}, {Value: int64(3)}, {Value: "slow"}, {Value: int64(200)}}}
+		var dst args
+		if err := ec.BindPositional(&dst); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		limit := uint8(200)
+		if diff := cmp.Diff(args{File: "a.txt", Count: 3, Mode: "slow", Limit: &limit}, dst, cmp.AllowUnexported(args{})); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("optional arguments omitted", func(t *testing.T) {
+		ec := &ExecCommand{p: p, Name: "cmd", Positional: []Value{{Value: Glob{Value: "*.txt"}}, {Value: int64(1)}}}
+		var dst args
+		if err := ec.BindPositional(&dst); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if diff := cmp.Diff(args{File: "*.txt", Count: 1, Mode: "fast"}, dst, cmp.AllowUnexported(args{})); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("conversions", func(t *testing.T) {
+		ec := &ExecCommand{p: p, Name: "cmd", Positional: []Value{
+			{Value: []Value{{Value: int64(1)}, {Value: int64(2)}}},
+			{Value: Record{"a": Value{Value: 1.5}}},
+			{Value: int64(4)},
+			{Value: 5 * time.Second},
+			{Value: "raw", Span: Span{Start: 1, End: 4}},
+		}}
+		var dst struct {
+			List     []int
+			Rec      map[string]float64
+			Float    float32
+			Duration time.Duration
+			Raw      Value
+		}
+		if err := ec.BindPositional(&dst); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if diff := cmp.Diff([]int{1, 2}, dst.List); diff != "" {
+			t.Errorf("List mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(map[string]float64{"a": 1.5}, dst.Rec); diff != "" {
+			t.Errorf("Rec mismatch (-want +got):\n%s", diff)
+		}
+		if dst.Float != 4 {
+			t.Errorf("expected Float to be 4, got %v", dst.Float)
+		}
+		if dst.Duration != 5*time.Second {
+			t.Errorf("expected Duration to be 5s, got %v", dst.Duration)
+		}
+		if diff := cmp.Diff(Value{Value: "raw", Span: Span{Start: 1, End: 4}}, dst.Raw); diff != "" {
+			t.Errorf("Raw mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		ec := &ExecCommand{p: p, Name: "cmd", Positional: []Value{{Value: "a.txt"}, {Value: int64(300)}}}
+		expectErrorMsg(t, ec.BindPositional(nil), `destination must be non-nil pointer to struct, got <nil>`)
+		expectErrorMsg(t, ec.BindPositional(args{}), `destination must be non-nil pointer to struct, got nu.args`)
+
+		var dst struct {
+			File  string
+			Count int8
+		}
+		expectErrorMsg(t, ec.BindPositional(&dst), `binding positional argument [1] to field Count: value 300 overflows int8`)
+
+		var dst2 struct {
+			File int
+		}
+		expectErrorMsg(t, ec.BindPositional(&dst2), `binding positional argument [0] to field File: can't assign string value to int`)
+
+		// Float is not converted to integer, even when it is a whole number
+		ec.Positional = []Value{{Value: 3.0}}
+		expectErrorMsg(t, ec.BindPositional(&dst2), `binding positional argument [0] to field File: can't assign float64 value to int`)
+	})
+}
+
+func Test_ExecCommand_BindFlags(t *testing.T) {
+	p := &Plugin{cmds: map[string]*Command{
+		"cmd": {
+			Signature: PluginSignature{
+				Name: "cmd",
+				Named: Flags{
+					{Long: "major"},
+					{Long: "minor"},
+					{Long: "output", Shape: syntaxshape.String(), Default: &Value{Value: "out.txt"}},
+					{Long: "count", Shape: syntaxshape.Int()},
+					{Long: "level", Shape: syntaxshape.Int()},
+				},
+			},
+		},
+	}}
+
+	type flags struct {
+		Major    bool   `nu:"major"`
+		Minor    bool   `nu:"minor"`
+		Out      string `nu:"output"`
+		Count    *int   `nu:"count"`
+		Level    int    `nu:"level"`
+		Untagged string
+		Ignored  string `nu:"-"`
+	}
+
+	t.Run("flags set", func(t *testing.T) {
+		ec := &ExecCommand{p: p, Name: "cmd", Named: NamedParams{
+			"major":  Value{},
+			"minor":  Value{Value: false},
+			"output": Value{Value: "foo.txt"},
+			"count":  Value{Value: int64(5)},
+		}}
+		dst := flags{Minor: true, Level: 7, Untagged: "u", Ignored: "i"}
+		if err := ec.BindFlags(&dst); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		count := 5
+		expect := flags{Major: true, Minor: false, Out: "foo.txt", Count: &count, Level: 7, Untagged: "u", Ignored: "i"}
+		if diff := cmp.Diff(expect, dst); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("flags not set", func(t *testing.T) {
+		ec := &ExecCommand{p: p, Name: "cmd", Named: NamedParams{}}
+		dst := flags{Major: true, Level: 7}
+		if err := ec.BindFlags(&dst); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// toggles are reset to false, default is used for output, count and level are unchanged
+		if diff := cmp.Diff(flags{Out: "out.txt", Level: 7}, dst); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		ec := &ExecCommand{p: p, Name: "cmd", Named: NamedParams{"count": Value{Value: "five"}}}
+		expectErrorMsg(t, ec.BindFlags(&flags{}), `binding flag "count" to field Count: can't assign string value to int`)
+		expectErrorMsg(t, ec.BindFlags(flags{}), `destination must be non-nil pointer to struct, got nu.flags`)
+	})
+}
@@ -25,6 +25,8 @@ type (
 		Name  string        `msgpack:"name"`
 		Call  evaluatedCall `msgpack:"call"`
 		Input any           `msgpack:"input,omitempty"`
+		// raw msgpack of the input Value, see [Config.RetainRawValues]
+		RawInput msgpack.RawMessage `msgpack:"-"`
 	}
 
 	evaluatedCall struct {
@@ -52,8 +54,9 @@ type (
 
 	// Value tuple variant as used by PipelineDataHeader
 	pipelineValue struct {
-		V Value
-		M pipelineMetadata
+		V   Value
+		M   pipelineMetadata
+		Raw msgpack.RawMessage // raw msgpack of V, assigned only when retaining raw Values
 	}
 
 	listStream struct {
@@ -146,7 +149,7 @@ func (r *run) DecodeMsgpack(dec *msgpack.Decoder) error {
 		case "call":
 			err = dec.DecodeValue(reflect.ValueOf(&r.Call))
 		case "input":
-			r.Input, err = decodePipelineDataHeader(dec)
+			r.Input, r.RawInput, err = decodePipelineData(dec)
 		default:
 			return fmt.Errorf("unknown key %q under Run", key)
 		}
@@ -158,49 +161,59 @@ func (r *run) DecodeMsgpack(dec *msgpack.Decoder) error {
 }
 
 func decodePipelineDataHeader(dec *msgpack.Decoder) (any, error) {
+	data, _, err := decodePipelineData(dec)
+	return data, err
+}
+
+/*
+decodePipelineData decodes PipelineDataHeader, when the header is Value and
+the decoder is configured to retain raw Values the raw msgpack of the Value
+is returned too.
+*/
+func decodePipelineData(dec *msgpack.Decoder) (any, msgpack.RawMessage, error) {
 	c, err := dec.PeekCode()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	switch {
 	case msgpcode.IsFixedString(c), msgpcode.IsString(c):
 		name, err := dec.DecodeString()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if name == "Empty" {
-			return empty{}, nil
+			return empty{}, nil, nil
 		}
-		return nil, fmt.Errorf("expected PipelineHeader Empty, got %q", name)
+		return nil, nil, fmt.Errorf("expected PipelineHeader Empty, got %q", name)
 	case msgpcode.IsFixedMap(c):
 		name, err := decodeWrapperMap(dec)
 		if err != nil {
-			return nil, fmt.Errorf("decoding PipelineHeader map: %w", err)
+			return nil, nil, fmt.Errorf("decoding PipelineHeader map: %w", err)
 		}
 		switch name {
 		case "Value":
 			v := pipelineValue{}
 			if err := v.DecodeMsgpack(dec); err != nil {
-				return nil, fmt.Errorf("decoding pipelineValue: %w", err)
+				return nil, nil, fmt.Errorf("decoding pipelineValue: %w", err)
 			}
-			return v.V, nil
+			return v.V, v.Raw, nil
 		case "ListStream":
 			v := listStream{}
 			if err := dec.DecodeValue(reflect.ValueOf(&v)); err != nil {
-				return nil, fmt.Errorf("decoding ListStream: %w", err)
+				return nil, nil, fmt.Errorf("decoding ListStream: %w", err)
 			}
-			return v, nil
+			return v, nil, nil
 		case "ByteStream":
 			v := byteStream{}
 			if err := dec.DecodeValue(reflect.ValueOf(&v)); err != nil {
-				return nil, fmt.Errorf("decoding ByteStream: %w", err)
+				return nil, nil, fmt.Errorf("decoding ByteStream: %w", err)
 			}
-			return v, nil
+			return v, nil, nil
 		default:
-			return nil, fmt.Errorf("unknown PipelineDataHeader value %q", name)
+			return nil, nil, fmt.Errorf("unknown PipelineDataHeader value %q", name)
 		}
 	default:
-		return nil, fmt.Errorf("unexpected type %x in PipelineDataHeader", c)
+		return nil, nil, fmt.Errorf("unexpected type %x in PipelineDataHeader", c)
 	}
 }
 
@@ -208,6 +221,8 @@ func encodePipelineDataHeader(enc *msgpack.Encoder, data any) error {
 	switch dt := data.(type) {
 	case Value:
 		return (&pipelineValue{V: dt}).EncodeMsgpack(enc)
+	case *pipelineValue:
+		return dt.EncodeMsgpack(enc)
 	case *listStream:
 		if err := encodeMapStart(enc, "ListStream"); err != nil {
 			return err
@@ -255,7 +270,8 @@ func (np *NamedParams) EncodeMsgpack(enc *msgpack.Encoder) error {
 		return err
 	}
 	var parName npName
-	for name, v := range *np {
+	for name := range mapKeys(enc, *np) {
+		v := (*np)[name]
 		if err := enc.EncodeArrayLen(2); err != nil {
 			return err
 		}
@@ -407,7 +423,12 @@ func (pv *pipelineValue) DecodeMsgpack(dec *msgpack.Decoder) error {
 	if dLen != 2 {
 		return fmt.Errorf("expected two item tuple, got %d items", dLen)
 	}
-	if err = pv.V.DecodeMsgpack(dec); err != nil {
+	if retainRawValues(dec) {
+		pv.Raw, err = decodeRetainRaw(dec, &pv.V)
+	} else {
+		err = pv.V.DecodeMsgpack(dec)
+	}
+	if err != nil {
 		return fmt.Errorf("decoding Value: %w", err)
 	}
 	if err = pv.M.DecodeMsgpack(dec); err != nil {
@@ -0,0 +1,240 @@
+package nu
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/*
+CellPath is Nushell [CellPath Value] type - a path to a cell in a Value,
+ie "foo.0.bar" selects field "bar" of the first item in the list which is
+the value of the field "foo". Use [ExecCommand.ReturnCellPath] to return
+CellPath as the result of the command.
+
+[CellPath Value]: https://www.nushell.sh/contributor-book/plugin_protocol_reference.html#cellpath
+*/
+type CellPath struct {
+	Members []PathMember
+}
+
+type PathMemberType uint8
+
+const (
+	PathMemberString PathMemberType = 0 // member selects field of the Record
+	PathMemberInt    PathMemberType = 1 // member selects item of the List
+)
+
+/*
+PathMember is a single member of the [CellPath].
+*/
+type PathMember struct {
+	Type     PathMemberType
+	Name     string // name of the field, used when Type == PathMemberString
+	Index    uint   // index of the item, used when Type == PathMemberInt
+	Optional bool   // when true missing cell is not an error
+	Span     Span
+}
+
+/*
+NewCellPath creates CellPath from segments, segment must be one of:
+
+  - string: selects Record field with given name;
+  - int, uint: selects List item with given index (must not be negative);
+  - PathMember: added as is, use it to create optional members.
+
+Plugin protocol doesn't support case-insensitive path members.
+*/
+func NewCellPath(segments ...any) (CellPath, error) {
+	cp := CellPath{Members: make([]PathMember, 0, len(segments))}
+	for i, seg := range segments {
+		switch v := seg.(type) {
+		case string:
+			cp.AddString(v)
+		case int:
+			if v < 0 {
+				return CellPath{}, fmt.Errorf("segment [%d]: index must not be negative, got %d", i, v)
+			}
+			cp.AddInteger(uint(v))
+		case uint:
+			cp.AddInteger(v)
+		case PathMember:
+			cp.Members = append(cp.Members, v)
+		default:
+			return CellPath{}, fmt.Errorf("segment [%d]: unsupported type %T", i, seg)
+		}
+	}
+	return cp, nil
+}
+
+// AddString adds member which selects Record field with given name.
+func (cp *CellPath) AddString(name string) *CellPath {
+	cp.Members = append(cp.Members, PathMember{Type: PathMemberString, Name: name})
+	return cp
+}
+
+// AddInteger adds member which selects List item with given index.
+func (cp *CellPath) AddInteger(index uint) *CellPath {
+	cp.Members = append(cp.Members, PathMember{Type: PathMemberInt, Index: index})
+	return cp
+}
+
+/*
+String returns the path in the Nushell syntax, ie "foo.0.bar?".
+*/
+func (cp CellPath) String() string {
+	s := make([]string, len(cp.Members))
+	for i, m := range cp.Members {
+		s[i] = m.String()
+	}
+	return strings.Join(s, ".")
+}
+
+func (pm PathMember) String() string {
+	s := pm.Name
+	if pm.Type == PathMemberInt {
+		s = strconv.FormatUint(uint64(pm.Index), 10)
+	}
+	if pm.Optional {
+		s += "?"
+	}
+	return s
+}
+
+var _ msgpack.CustomEncoder = (*CellPath)(nil)
+
+func (cp *CellPath) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if err := encodeMapStart(enc, "members"); err != nil {
+		return err
+	}
+	if err := enc.EncodeArrayLen(len(cp.Members)); err != nil {
+		return err
+	}
+	for x, m := range cp.Members {
+		if err := m.encodeMsgpack(enc); err != nil {
+			return fmt.Errorf("encoding member [%d]: %w", x, err)
+		}
+	}
+	return nil
+}
+
+func (pm *PathMember) encodeMsgpack(enc *msgpack.Encoder) error {
+	var err error
+	switch pm.Type {
+	case PathMemberString:
+		if err := pm.startMember(enc, "String"); err != nil {
+			return err
+		}
+		err = enc.EncodeString(pm.Name)
+	case PathMemberInt:
+		if err := pm.startMember(enc, "Int"); err != nil {
+			return err
+		}
+		err = enc.EncodeUint(uint64(pm.Index))
+	default:
+		return fmt.Errorf("unsupported path member type %d", pm.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := enc.EncodeString("span"); err != nil {
+		return err
+	}
+	if err := enc.EncodeValue(reflect.ValueOf(&pm.Span)); err != nil {
+		return err
+	}
+	if err := enc.EncodeString("optional"); err != nil {
+		return err
+	}
+	return enc.EncodeBool(pm.Optional)
+}
+
+/*
+startMember outputs
+
+	{ typeName: { "val": | }
+
+caller must output value of the "val" and two more key-value pairs.
+*/
+func (pm *PathMember) startMember(enc *msgpack.Encoder, typeName string) error {
+	if err := encodeMapStart(enc, typeName); err != nil {
+		return err
+	}
+	if err := enc.EncodeMapLen(3); err != nil {
+		return err
+	}
+	return enc.EncodeString("val")
+}
+
+var _ msgpack.CustomDecoder = (*CellPath)(nil)
+
+func (cp *CellPath) DecodeMsgpack(dec *msgpack.Decoder) error {
+	key, err := decodeWrapperMap(dec)
+	if err != nil {
+		return fmt.Errorf("decoding CellPath: %w", err)
+	}
+	if key != "members" {
+		return fmt.Errorf("unexpected key %q in CellPath", key)
+	}
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return fmt.Errorf("decoding CellPath members count: %w", err)
+	}
+	cp.Members = make([]PathMember, max(n, 0))
+	for x := range cp.Members {
+		if err := cp.Members[x].decodeMsgpack(dec); err != nil {
+			return fmt.Errorf("decoding member [%d/%d]: %w", x+1, n, err)
+		}
+	}
+	return nil
+}
+
+func (pm *PathMember) decodeMsgpack(dec *msgpack.Decoder) error {
+	typeName, err := decodeWrapperMap(dec)
+	if err != nil {
+		return err
+	}
+	switch typeName {
+	case "String":
+		pm.Type = PathMemberString
+	case "Int":
+		pm.Type = PathMemberInt
+	default:
+		return fmt.Errorf("unsupported path member type %q", typeName)
+	}
+
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		return err
+	}
+	for idx := 0; idx < n; idx++ {
+		fieldName, err := dec.DecodeString()
+		if err != nil {
+			return fmt.Errorf("decoding field name [%d/%d] of %s: %w", idx+1, n, typeName, err)
+		}
+		switch fieldName {
+		case "val":
+			if pm.Type == PathMemberString {
+				pm.Name, err = dec.DecodeString()
+			} else {
+				var idx uint64
+				idx, err = dec.DecodeUint64()
+				pm.Index = uint(idx)
+			}
+		case "span":
+			err = dec.DecodeValue(reflect.ValueOf(&pm.Span))
+		case "optional":
+			pm.Optional, err = dec.DecodeBool()
+		default:
+			return fmt.Errorf("unsupported field %q of %s path member", fieldName, typeName)
+		}
+		if err != nil {
+			return fmt.Errorf("decoding field %s of %s: %w", fieldName, typeName, err)
+		}
+	}
+	return nil
+}
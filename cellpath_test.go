@@ -0,0 +1,52 @@
+package nu
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_CellPath_String(t *testing.T) {
+	cp := CellPath{}
+	if s := cp.String(); s != "" {
+		t.Errorf("expected empty string, got %q", s)
+	}
+	cp.AddString("foo").AddInteger(0).AddString("bar")
+	cp.Members[2].Optional = true
+	if s := cp.String(); s != "foo.0.bar?" {
+		t.Errorf("expected %q, got %q", "foo.0.bar?", s)
+	}
+}
+
+func Test_NewCellPath(t *testing.T) {
+	cp, err := NewCellPath("foo", 0, uint(2), PathMember{Type: PathMemberString, Name: "bar", Optional: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expect := CellPath{Members: []PathMember{
+		{Type: PathMemberString, Name: "foo"},
+		{Type: PathMemberInt, Index: 0},
+		{Type: PathMemberInt, Index: 2},
+		{Type: PathMemberString, Name: "bar", Optional: true},
+	}}
+	if diff := cmp.Diff(expect, cp); diff != "" {
+		t.Errorf("cell path mismatch (-want +got):\n%s", diff)
+	}
+	if s := cp.String(); s != "foo.0.2.bar?" {
+		t.Errorf("expected %q, got %q", "foo.0.2.bar?", s)
+	}
+
+	cp, err = NewCellPath()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cp.Members) != 0 {
+		t.Errorf("expected empty path, got %v", cp)
+	}
+
+	_, err = NewCellPath("foo", -1)
+	expectErrorMsg(t, err, `segment [1]: index must not be negative, got -1`)
+
+	_, err = NewCellPath("foo", 1.5)
+	expectErrorMsg(t, err, `segment [1]: unsupported type float64`)
+}
@@ -3,9 +3,14 @@ package nu
 import (
 	"context"
 	"fmt"
+	"io"
+	"log/slog"
 	"reflect"
+	"strings"
+	"time"
 
 	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
 
 	"github.com/ainvaltin/nu-plugin/syntaxshape"
 	"github.com/ainvaltin/nu-plugin/types"
@@ -20,6 +25,13 @@ type Command struct {
 
 	// callback executed on command invocation
 	OnRun func(context.Context, *ExecCommand) error `msgpack:"-"`
+
+	// When greater than zero the context passed to the OnRun handler is
+	// cancelled with [ErrCommandTimeout] as the cause after Timeout. When
+	// the handler then returns error the command responds with LabeledError
+	// saying that the command timed out. The handler must observe the ctx,
+	// runaway handler ignoring it can't be stopped.
+	Timeout time.Duration `msgpack:"-"`
 }
 
 func (c Command) Validate() error {
@@ -32,6 +44,43 @@ func (c Command) Validate() error {
 	return nil
 }
 
+/*
+Known categories of the command (value of the [PluginSignature.Category]),
+see [Nushell Category] for the list. Use the constants to avoid typos.
+
+[Nushell Category]: https://docs.rs/nu-protocol/latest/nu_protocol/enum.Category.html
+*/
+const (
+	CategoryBits         = "Bits"
+	CategoryBytes        = "Bytes"
+	CategoryChart        = "Chart"
+	CategoryConversions  = "Conversions"
+	CategoryCore         = "Core"
+	CategoryDatabase     = "Database"
+	CategoryDate         = "Date"
+	CategoryDebug        = "Debug"
+	CategoryDefault      = "Default"
+	CategoryEnv          = "Env"
+	CategoryExperimental = "Experimental"
+	CategoryFileSystem   = "FileSystem"
+	CategoryFilters      = "Filters"
+	CategoryFormats      = "Formats"
+	CategoryGenerators   = "Generators"
+	CategoryHash         = "Hash"
+	CategoryHistory      = "History"
+	CategoryMath         = "Math"
+	CategoryMisc         = "Misc"
+	CategoryNetwork      = "Network"
+	CategoryPath         = "Path"
+	CategoryPlatform     = "Platform"
+	CategoryPlugin       = "Plugin"
+	CategoryRandom       = "Random"
+	CategoryShells       = "Shells"
+	CategoryStrings      = "Strings"
+	CategorySystem       = "System"
+	CategoryViewers      = "Viewers"
+)
+
 type PluginSignature struct {
 	Name string `msgpack:"name"`
 	// This should be a single sentence as it is the part shown for example in the completion menu.
@@ -52,6 +101,23 @@ type PluginSignature struct {
 	CreatesScope         bool         `msgpack:"creates_scope"`
 	AllowsUnknownArgs    bool         `msgpack:"allows_unknown_args"`
 	AllowMissingExamples bool         `msgpack:"allow_variants_without_examples"`
+
+	// Additional names of the command. Plugin protocol doesn't support aliases
+	// so the command is registered under each name as a separate command (with
+	// the same signature and OnRun handler). ExecCommand.Name is the name used
+	// to invoke the command.
+	Aliases []string `msgpack:"-"`
+
+	// When not empty the command is deprecated and the value should explain
+	// what to use instead. Plugin protocol doesn't support deprecation marker
+	// so warning is logged when deprecated command is invoked.
+	Deprecated string `msgpack:"-"`
+
+	// By default, when command is invoked with the "help" flag, the help
+	// text (obtained with GetHelp engine call) is returned without calling
+	// the OnRun handler. Set to true to let the OnRun handler deal with
+	// the "help" flag.
+	HandleHelpManually bool `msgpack:"-"`
 }
 
 type InOutTypes struct {
@@ -73,6 +139,11 @@ type (
 type (
 	/*
 		Flag is a definition of a flag (Shape is unassigned) or named argument (Shape assigned).
+
+		The protocol has no way to declare the set of allowed values of the
+		named argument (so that the shell would offer completions and validate
+		it), use String shape and [ExecCommand.FlagEnum] to validate the value
+		in the OnRun handler.
 	*/
 	Flag struct {
 		Long     string                  `msgpack:"long"`
@@ -82,6 +153,9 @@ type (
 		Desc     string                  `msgpack:"desc"`
 		VarId    uint                    `msgpack:"var_id,omitempty"`
 		Default  *Value                  `msgpack:"default_value,omitempty"`
+
+		// When not empty the flag is deprecated, see [PluginSignature.Deprecated].
+		Deprecated string `msgpack:"-"`
 	}
 	Flags []Flag
 )
@@ -91,10 +165,84 @@ type (
 		Example     string `msgpack:"example"`
 		Description string `msgpack:"description"`
 		Result      *Value `msgpack:"result,omitempty"`
+		// When assigned it is called when the signature is encoded and
+		// it's result is used instead of Result. Useful when the result
+		// of the example depends on the environment.
+		ResultFunc func() (*Value, error) `msgpack:"-"`
 	}
 	Examples []Example
 )
 
+/*
+deprecationWarnings logs warning when deprecated command or flag is used.
+*/
+func (sig *PluginSignature) deprecationWarnings(ctx context.Context, log *slog.Logger, exec *ExecCommand) {
+	if sig.Deprecated != "" {
+		log.WarnContext(ctx, "deprecated command used", "command", exec.Name, "deprecation", sig.Deprecated)
+	}
+	for _, f := range sig.Named {
+		if f.Deprecated == "" {
+			continue
+		}
+		if _, ok := exec.Named[f.Long]; ok {
+			log.WarnContext(ctx, "deprecated flag used", "command", exec.Name, "flag", f.Long, "deprecation", f.Deprecated)
+		}
+	}
+}
+
+/*
+checkInputType returns error when the type of the input doesn't match any
+of the input types declared by the command.
+
+Items of the list stream are not inspected (that would require consuming
+the stream) so list stream matches any List or Table type.
+*/
+func (sig *PluginSignature) checkInputType(exec *ExecCommand) error {
+	var typ types.Type
+	span := exec.Head
+	switch in := exec.Input.(type) {
+	case Value:
+		typ, span = typeOf(in.Value), in.Span
+	case <-chan Value:
+		typ = types.ListStream()
+	case io.Reader:
+		// byte stream of "Unknown" type might be either String or Binary
+		typ = types.Binary()
+	default:
+		typ = typeOf(in)
+	}
+
+	expected := make([]string, 0, len(sig.InputOutputTypes))
+	for _, iot := range sig.InputOutputTypes {
+		if types.IsSubtype(typ, iot.In) || acceptsStream(exec.Input, iot.In) {
+			return nil
+		}
+		expected = append(expected, iot.In.String())
+	}
+	return &LabeledError{
+		Msg: fmt.Sprintf("input type not supported by the command %s", sig.Name),
+		Labels: []ErrorLabel{{
+			Text: fmt.Sprintf("got %s input, expected one of: %s", typ, strings.Join(expected, ", ")),
+			Span: span,
+		}},
+	}
+}
+
+/*
+acceptsStream reports whether stream input is accepted by the (declared)
+type t, ie list stream is accepted by any List type.
+*/
+func acceptsStream(input any, t types.Type) bool {
+	switch input.(type) {
+	case <-chan Value:
+		// every List and Table type is subtype of list<any>
+		return types.IsSubtype(t, types.List(types.Any()))
+	case io.Reader:
+		return types.IsSubtype(types.String(), t)
+	}
+	return false
+}
+
 func (sig PluginSignature) Validate() error {
 	if sig.Name == "" {
 		return fmt.Errorf("command must have name")
@@ -112,9 +260,29 @@ func (sig PluginSignature) Validate() error {
 		return fmt.Errorf("command Input-Output types must be specified")
 	}
 
+	if err := sig.RequiredPositional.Validate(); err != nil {
+		return err
+	}
+	if err := sig.OptionalPositional.Validate(); err != nil {
+		return err
+	}
 	return sig.Named.Validate()
 }
 
+/*
+checkDefault returns error when the type of the default value v is not
+compatible with the shape, Nothing is accepted as default of any shape.
+*/
+func checkDefault(shape syntaxshape.SyntaxShape, v *Value) error {
+	if v == nil || v.Value == nil || shape == nil {
+		return nil
+	}
+	if vt, st := typeOf(v.Value), shape.Type(); !types.IsSubtype(vt, st) {
+		return fmt.Errorf("default value of type %s is not compatible with the shape of type %s", vt, st)
+	}
+	return nil
+}
+
 /*
 Decode top-level "plugin input" message, the message must be "map".
 */
@@ -211,6 +379,18 @@ func (flags *Flags) Validate() error {
 		if len(v.Short) > 1 {
 			return fmt.Errorf("flag's short name must be single character, got %q", v.Short)
 		}
+		if err := checkDefault(v.Shape, v.Default); err != nil {
+			return fmt.Errorf("flag --%s: %w", v.Long, err)
+		}
+	}
+	return nil
+}
+
+func (pa *PositionalArgs) Validate() error {
+	for _, v := range *pa {
+		if err := checkDefault(v.Shape, v.Default); err != nil {
+			return fmt.Errorf("positional argument %q: %w", v.Name, err)
+		}
 	}
 	return nil
 }
@@ -225,6 +405,13 @@ func (ex *Examples) EncodeMsgpack(enc *msgpack.Encoder) error {
 		return err
 	}
 	for _, v := range *ex {
+		if v.ResultFunc != nil {
+			r, err := v.ResultFunc()
+			if err != nil {
+				return fmt.Errorf("evaluating result of the example %q: %w", v.Example, err)
+			}
+			v.Result = r
+		}
 		if err := enc.EncodeValue(reflect.ValueOf(&v)); err != nil {
 			return err
 		}
@@ -241,3 +428,134 @@ func (iot *InOutTypes) EncodeMsgpack(enc *msgpack.Encoder) error {
 	}
 	return iot.Out.EncodeMsgpack(enc)
 }
+
+/*
+DecodeSignature decodes plugin command's signature (the "sig" field of the
+command in the "Signature" call response), it is the inverse of encoding
+[PluginSignature] as done by the plugin when responding to the Signature call.
+
+Fields not known to the PluginSignature are skipped.
+*/
+func DecodeSignature(dec *msgpack.Decoder) (PluginSignature, error) {
+	var sig PluginSignature
+	if err := dec.Decode(&sig); err != nil {
+		return sig, fmt.Errorf("decoding signature: %w", err)
+	}
+	return sig, nil
+}
+
+var _ msgpack.CustomDecoder = (*InOutTypes)(nil)
+
+func (iot *InOutTypes) DecodeMsgpack(dec *msgpack.Decoder) error {
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+	if n != 2 {
+		return fmt.Errorf("expected input-output types to be tuple of two, got %d items", n)
+	}
+	if iot.In, err = types.Decode(dec); err != nil {
+		return fmt.Errorf("decoding input type: %w", err)
+	}
+	if iot.Out, err = types.Decode(dec); err != nil {
+		return fmt.Errorf("decoding output type: %w", err)
+	}
+	return nil
+}
+
+var _ msgpack.CustomDecoder = (*PositionalArg)(nil)
+
+func (pa *PositionalArg) DecodeMsgpack(dec *msgpack.Decoder) error {
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		return err
+	}
+	for idx := 0; idx < n; idx++ {
+		key, err := dec.DecodeString()
+		if err != nil {
+			return fmt.Errorf("decoding field name [%d/%d] of positional argument: %w", idx+1, n, err)
+		}
+		switch key {
+		case "name":
+			pa.Name, err = dec.DecodeString()
+		case "desc":
+			pa.Desc, err = dec.DecodeString()
+		case "shape":
+			pa.Shape, err = syntaxshape.Decode(dec)
+		case "var_id":
+			pa.VarId, err = decodeOptionalUint(dec)
+		case "default_value":
+			pa.Default, err = decodeOptionalValue(dec)
+		default:
+			err = dec.Skip()
+		}
+		if err != nil {
+			return fmt.Errorf("decoding field %q of positional argument: %w", key, err)
+		}
+	}
+	return nil
+}
+
+var _ msgpack.CustomDecoder = (*Flag)(nil)
+
+func (f *Flag) DecodeMsgpack(dec *msgpack.Decoder) error {
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		return err
+	}
+	for idx := 0; idx < n; idx++ {
+		key, err := dec.DecodeString()
+		if err != nil {
+			return fmt.Errorf("decoding field name [%d/%d] of flag: %w", idx+1, n, err)
+		}
+		switch key {
+		case "long":
+			f.Long, err = dec.DecodeString()
+		case "short":
+			f.Short, err = dec.DecodeString()
+		case "arg":
+			var isNil bool
+			if isNil, err = decodeNil(dec); err == nil && !isNil {
+				f.Shape, err = syntaxshape.Decode(dec)
+			}
+		case "required":
+			f.Required, err = dec.DecodeBool()
+		case "desc":
+			f.Desc, err = dec.DecodeString()
+		case "var_id":
+			f.VarId, err = decodeOptionalUint(dec)
+		case "default_value":
+			f.Default, err = decodeOptionalValue(dec)
+		default:
+			err = dec.Skip()
+		}
+		if err != nil {
+			return fmt.Errorf("decoding field %q of flag %q: %w", key, f.Long, err)
+		}
+	}
+	return nil
+}
+
+// decodeNil consumes nil from the decoder and returns true when next value is nil.
+func decodeNil(dec *msgpack.Decoder) (bool, error) {
+	c, err := dec.PeekCode()
+	if err != nil || c != msgpcode.Nil {
+		return false, err
+	}
+	return true, dec.DecodeNil()
+}
+
+func decodeOptionalUint(dec *msgpack.Decoder) (uint, error) {
+	if isNil, err := decodeNil(dec); err != nil || isNil {
+		return 0, err
+	}
+	return dec.DecodeUint()
+}
+
+func decodeOptionalValue(dec *msgpack.Decoder) (*Value, error) {
+	if isNil, err := decodeNil(dec); err != nil || isNil {
+		return nil, err
+	}
+	v := &Value{}
+	return v, v.DecodeMsgpack(dec)
+}
@@ -0,0 +1,256 @@
+package nu
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/ainvaltin/nu-plugin/syntaxshape"
+	"github.com/ainvaltin/nu-plugin/types"
+)
+
+func Test_DecodeSignature(t *testing.T) {
+	// compare unexported fields of the syntax shapes and types too
+	exportAll := cmp.Exporter(func(reflect.Type) bool { return true })
+
+	t.Run("round trip", func(t *testing.T) {
+		sig := PluginSignature{
+			Name:        "demo",
+			Desc:        "test command",
+			Description: "longer description",
+			SearchTerms: []string{"foo", "bar"},
+			Category:    "Misc",
+			RequiredPositional: PositionalArgs{
+				{Name: "a", Desc: "first", Shape: syntaxshape.Int()},
+				{Name: "b", Desc: "second", Shape: syntaxshape.List(syntaxshape.OneOf(syntaxshape.String(), syntaxshape.Filepath()))},
+			},
+			OptionalPositional: PositionalArgs{
+				{Name: "c", Desc: "third", Shape: syntaxshape.Record(syntaxshape.RecordDef{"x": syntaxshape.Float()}), Default: &Value{Value: Record{"x": Value{Value: 1.5}}}},
+				{Name: "d", Desc: "fourth", Shape: syntaxshape.Keyword([]byte("as"), syntaxshape.String()), VarId: 7},
+			},
+			RestPositional: &PositionalArg{Name: "rest", Desc: "the rest", Shape: syntaxshape.Closure()},
+			Named: Flags{
+				{Long: "flag", Short: "f", Desc: "flag"},
+				{Long: "named", Desc: "named param", Shape: syntaxshape.Table(nil), Required: true, Default: &Value{Value: int64(5)}},
+			},
+			InputOutputTypes: []InOutTypes{
+				{In: types.String(), Out: types.Record(types.RecordDef{"y": types.List(types.Custom("thing"))})},
+				{In: types.Table(nil), Out: types.Nothing()},
+			},
+			IsFilter:             true,
+			AllowMissingExamples: true,
+		}
+		b, err := msgpack.Marshal(&sig)
+		if err != nil {
+			t.Fatalf("encoding signature: %v", err)
+		}
+		out, err := DecodeSignature(msgpack.NewDecoder(bytes.NewReader(b)))
+		if err != nil {
+			t.Fatalf("decoding signature: %v", err)
+		}
+		if diff := cmp.Diff(sig, out, exportAll); diff != "" {
+			t.Errorf("signature mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("unknown fields are skipped", func(t *testing.T) {
+		b, err := msgpack.Marshal(map[string]any{
+			"name":               "demo",
+			"new_field":          []any{1, "two", map[string]int{"three": 3}},
+			"named":              []any{map[string]any{"long": "flag", "arg": nil, "future": true}},
+			"input_output_types": []any{[]any{"Any", map[string]any{"List": "Int"}}},
+		})
+		if err != nil {
+			t.Fatalf("encoding signature: %v", err)
+		}
+		out, err := DecodeSignature(msgpack.NewDecoder(bytes.NewReader(b)))
+		if err != nil {
+			t.Fatalf("decoding signature: %v", err)
+		}
+		expect := PluginSignature{
+			Name:             "demo",
+			Named:            Flags{{Long: "flag"}},
+			InputOutputTypes: []InOutTypes{{In: types.Any(), Out: types.List(types.Int())}},
+		}
+		if diff := cmp.Diff(expect, out, exportAll); diff != "" {
+			t.Errorf("signature mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid type", func(t *testing.T) {
+		b, err := msgpack.Marshal(map[string]any{"input_output_types": []any{[]any{"Any", "Foo"}}})
+		if err != nil {
+			t.Fatalf("encoding signature: %v", err)
+		}
+		_, err = DecodeSignature(msgpack.NewDecoder(bytes.NewReader(b)))
+		expectErrorMsg(t, err, `decoding signature: decoding output type: unsupported Type: "Foo"`)
+	})
+}
+
+func Test_Examples_ResultFunc(t *testing.T) {
+	ex := Examples{
+		{Example: "static", Result: &Value{Value: "foo"}},
+		{Example: "dynamic", Result: &Value{Value: "ignored"}, ResultFunc: func() (*Value, error) { return &Value{Value: int64(42)}, nil }},
+		{Example: "no result", ResultFunc: func() (*Value, error) { return nil, nil }},
+	}
+	b, err := msgpack.Marshal(&ex)
+	if err != nil {
+		t.Fatalf("encoding examples: %v", err)
+	}
+	var out []Example
+	if err := msgpack.Unmarshal(b, &out); err != nil {
+		t.Fatalf("decoding examples: %v", err)
+	}
+	expect := []Example{
+		{Example: "static", Result: &Value{Value: "foo"}},
+		{Example: "dynamic", Result: &Value{Value: int64(42)}},
+		{Example: "no result"},
+	}
+	if diff := cmp.Diff(expect, out); diff != "" {
+		t.Errorf("examples mismatch (-want +got):\n%s", diff)
+	}
+
+	ex = Examples{{Example: "failing", ResultFunc: func() (*Value, error) { return nil, errors.New("oops") }}}
+	_, err = msgpack.Marshal(&ex)
+	expectErrorMsg(t, err, `evaluating result of the example "failing": oops`)
+}
+
+func Test_PluginSignature_Category(t *testing.T) {
+	for _, tc := range []struct {
+		in  string
+		out string
+	}{
+		{in: CategoryFilters, out: "Filters"},
+		{in: CategoryFileSystem, out: "FileSystem"},
+		{in: "Experimental", out: "Experimental"},
+	} {
+		b, err := msgpack.Marshal(&PluginSignature{Name: "cmd", Category: tc.in})
+		if err != nil {
+			t.Fatalf("encoding signature: %v", err)
+		}
+		var sig struct {
+			Category string `msgpack:"category"`
+		}
+		if err := msgpack.Unmarshal(b, &sig); err != nil {
+			t.Fatalf("decoding signature: %v", err)
+		}
+		if sig.Category != tc.out {
+			t.Errorf("expected category %q, got %q", tc.out, sig.Category)
+		}
+	}
+}
+
+func Test_PluginSignature_checkInputType(t *testing.T) {
+	rec := Record{"name": {Value: "foo"}, "size": {Value: Filesize(10)}}
+	testCases := []struct {
+		input    any
+		declared []types.Type
+		errMsg   string // empty when input is expected to match
+	}{
+		{input: nil, declared: []types.Type{types.Nothing()}},
+		{input: nil, declared: []types.Type{types.Any()}},
+		{input: Value{Value: int64(1)}, declared: []types.Type{types.Int()}},
+		{input: Value{Value: int64(1)}, declared: []types.Type{types.Number()}},
+		{input: Value{Value: 1.5}, declared: []types.Type{types.String(), types.Number()}},
+		{input: Value{Value: "str"}, declared: []types.Type{types.Int()}, errMsg: "got string input, expected one of: int"},
+		{input: Value{Value: []Value{{Value: int64(1)}}}, declared: []types.Type{types.List(types.Int())}},
+		{input: Value{Value: []Value{{Value: int64(1)}, {Value: "a"}}}, declared: []types.Type{types.List(types.Int())}, errMsg: "got list<any> input, expected one of: list<int>"},
+		{input: Value{Value: []Value{}}, declared: []types.Type{types.List(types.Any())}},
+		{input: Value{Value: rec}, declared: []types.Type{types.Record(nil)}},
+		{input: Value{Value: rec}, declared: []types.Type{types.Record(types.RecordDef{"name": types.String()})}},
+		{input: Value{Value: rec}, declared: []types.Type{types.Record(types.RecordDef{"name": types.Int()})}, errMsg: "got record<name: string, size: filesize> input, expected one of: record<name: int>"},
+		{input: Value{Value: []Value{{Value: rec}, {Value: Record{"name": {Value: "bar"}}}}}, declared: []types.Type{types.Table(types.RecordDef{"name": types.String()})}},
+		{input: Value{Value: []Value{{Value: rec}}}, declared: []types.Type{types.List(types.Any())}},
+		{input: Value{Value: []Value{{Value: rec}}}, declared: []types.Type{types.Int(), types.Table(types.RecordDef{"foo": types.Any()})}, errMsg: "got table<name: string, size: filesize> input, expected one of: int, table<foo: any>"},
+		{input: make(<-chan Value), declared: []types.Type{types.List(types.Int())}},
+		{input: make(<-chan Value), declared: []types.Type{types.Table(nil)}},
+		{input: make(<-chan Value), declared: []types.Type{types.ListStream()}},
+		{input: make(<-chan Value), declared: []types.Type{types.String()}, errMsg: "got list-stream input, expected one of: string"},
+		{input: bytes.NewReader(nil), declared: []types.Type{types.String()}},
+		{input: bytes.NewReader(nil), declared: []types.Type{types.Binary()}},
+		{input: bytes.NewReader(nil), declared: []types.Type{types.Int()}, errMsg: "got binary input, expected one of: int"},
+	}
+
+	for x, tc := range testCases {
+		sig := PluginSignature{Name: "cmd"}
+		for _, in := range tc.declared {
+			sig.InputOutputTypes = append(sig.InputOutputTypes, InOutTypes{In: in, Out: types.Any()})
+		}
+		err := sig.checkInputType(&ExecCommand{Input: tc.input})
+		switch {
+		case err == nil && tc.errMsg != "":
+			t.Errorf("[%d] expected error %q, got nil", x, tc.errMsg)
+		case err != nil && tc.errMsg == "":
+			t.Errorf("[%d] unexpected error: %v", x, err)
+		case err != nil:
+			var le *LabeledError
+			if !errors.As(err, &le) || len(le.Labels) != 1 {
+				t.Errorf("[%d] expected LabeledError with one label, got %#v", x, err)
+				continue
+			}
+			if le.Labels[0].Text != tc.errMsg {
+				t.Errorf("[%d] expected label %q, got %q", x, tc.errMsg, le.Labels[0].Text)
+			}
+		}
+	}
+}
+
+func Test_PluginSignature_Validate_defaults(t *testing.T) {
+	sig := func(named Flags, positional PositionalArgs) PluginSignature {
+		return PluginSignature{
+			Name:               "cmd",
+			Category:           "Experimental",
+			Desc:               "test cmd",
+			SearchTerms:        []string{"cmd"},
+			InputOutputTypes:   []InOutTypes{{types.Any(), types.Any()}},
+			Named:              named,
+			OptionalPositional: positional,
+		}
+	}
+
+	valid := []PluginSignature{
+		sig(Flags{{Long: "count", Shape: syntaxshape.Int(), Default: &Value{Value: 10}}}, nil),
+		sig(Flags{{Long: "count", Shape: syntaxshape.Number(), Default: &Value{Value: 1.5}}}, nil),
+		sig(Flags{{Long: "count", Shape: syntaxshape.Int(), Default: &Value{}}}, nil),
+		sig(Flags{{Long: "data", Shape: syntaxshape.Binary(), Default: &Value{Value: []byte{1, 2}}}}, nil),
+		sig(Flags{{Long: "path", Shape: syntaxshape.Filepath(), Default: &Value{Value: "/tmp"}}}, nil),
+		sig(Flags{{Long: "any", Shape: syntaxshape.OneOf(syntaxshape.Int(), syntaxshape.String()), Default: &Value{Value: "str"}}}, nil),
+		sig(nil, PositionalArgs{{Name: "items", Shape: syntaxshape.List(syntaxshape.Int()), Default: &Value{Value: []Value{{Value: 1}, {Value: 2}}}}}),
+		sig(nil, PositionalArgs{{Name: "rec", Shape: syntaxshape.Record(nil), Default: &Value{Value: Record{"a": {Value: 1}}}}}),
+	}
+	for x, s := range valid {
+		if err := s.Validate(); err != nil {
+			t.Errorf("[%d] unexpected error: %v", x, err)
+		}
+	}
+
+	invalid := []struct {
+		sig PluginSignature
+		msg string
+	}{
+		{
+			sig: sig(Flags{{Long: "count", Shape: syntaxshape.Int(), Default: &Value{Value: "ten"}}}, nil),
+			msg: `flag --count: default value of type string is not compatible with the shape of type int`,
+		},
+		{
+			sig: sig(Flags{{Long: "data", Shape: syntaxshape.Binary(), Default: &Value{Value: "str"}}}, nil),
+			msg: `flag --data: default value of type string is not compatible with the shape of type binary`,
+		},
+		{
+			sig: sig(nil, PositionalArgs{{Name: "items", Shape: syntaxshape.List(syntaxshape.Int()), Default: &Value{Value: []Value{{Value: "a"}}}}}),
+			msg: `positional argument "items": default value of type list<string> is not compatible with the shape of type list<int>`,
+		},
+	}
+	for _, tc := range invalid {
+		expectErrorMsg(t, tc.sig.Validate(), tc.msg)
+	}
+
+	// New must fail too
+	_, err := New([]*Command{{Signature: invalid[0].sig, OnRun: func(context.Context, *ExecCommand) error { return nil }}}, "", nil)
+	expectErrorMsg(t, err, `invalid command "cmd": `+invalid[0].msg)
+}
@@ -1,6 +1,7 @@
 package nu
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
@@ -29,6 +30,73 @@ type Config struct {
 	// if assigned outgoing data is also copied to this writer.
 	// NB! this writer must not block!
 	SniffOut io.Writer
+
+	// When greater than zero output is buffered using buffer of given
+	// size. Buffer is flushed after each message so this mostly helps
+	// when message is written using multiple Write calls.
+	OutputBufferSize int
+
+	// Whether to collect command execution statistics, see [Plugin.Stats].
+	CollectStats bool
+
+	// If assigned it is called with every decoded incoming message
+	// (direction is "in") and every outgoing message (direction is "out")
+	// before it is serialized. The msg is the internal Go struct of the
+	// message, this is meant for tests to observe protocol flow.
+	// NB! the callback must not block!
+	OnMessage func(direction string, msg any)
+
+	// When greater than zero incoming message bigger than MaxMessageBytes
+	// causes the plugin to exit with [ErrMessageTooLarge] error. As the
+	// input is a stream the plugin can't skip the rest of the message and
+	// continue so this is meant to protect against runaway memory usage.
+	MaxMessageBytes int64
+
+	// Whether to encode fields of the Record and NamedParams in sorted
+	// order (by default map iteration order is used). This makes the
+	// output deterministic, ie for golden tests.
+	SortMapKeys bool
+
+	// Whether Run should wait for the engine's Hello message before
+	// processing other messages. Hello must be the first message sent by
+	// the engine and it must arrive within HelloTimeout (defaults to 10s),
+	// otherwise Run returns error. The engine's protocol version is then
+	// available via [Plugin.EngineVersion] when the commands run.
+	WaitForHello bool
+	HelloTimeout time.Duration
+
+	// Whether to check the type of the input against the command's
+	// InputOutputTypes before calling OnRun. When the input doesn't match
+	// any declared input type the call fails with LabeledError and OnRun
+	// is not called. Items of list stream are not checked.
+	ValidateInput bool
+
+	// Whether to retain the raw msgpack encoding of the command's input
+	// Value, see [ExecCommand.RawInput]. This allows to inspect or forward
+	// the input losslessly but it requires additional memory and decoding
+	// work.
+	RetainRawValues bool
+
+	// Whether to reject incoming Record with duplicate field names. By
+	// default the last value of the field is used and warning is logged.
+	// When set the Call containing such Record is responded with error
+	// (OnRun is not called), in other messages (ie items of the input
+	// stream) the last value is used and the duplicate is logged as error.
+	RejectDuplicateFields bool
+
+	// When not empty the process name (as shown by ps and top) is set
+	// to ProcessName when Plugin.Run is called, ie "nu_plugin_foo" to make
+	// it easy to identify the plugin. Names longer than 15 bytes are
+	// truncated. Supported only on Linux, on other platforms the setting
+	// is ignored.
+	ProcessName string
+
+	// How many times to retry idempotent engine calls (GetEnvVar, GetConfig
+	// and FindDeclaration) when sending the call fails before any part of
+	// it has been written to the output, with exponential backoff between
+	// the attempts. Partially written call and error response from the
+	// engine are not retried. By default failed engine call is not retried.
+	EngineCallRetries int
 }
 
 func (cfg *Config) logger() *slog.Logger {
@@ -53,6 +121,9 @@ func (cfg *Config) ioStreams(args []string) (r io.Reader, w io.Writer, err error
 	if cfg != nil && cfg.SniffOut != nil {
 		w = io.MultiWriter(w, cfg.SniffOut)
 	}
+	if cfg != nil && cfg.OutputBufferSize > 0 {
+		w = bufio.NewWriterSize(w, cfg.OutputBufferSize)
+	}
 
 	return r, w, nil
 }
@@ -0,0 +1,111 @@
+package nu
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ainvaltin/nu-plugin/types"
+)
+
+/*
+FromConverter creates "from X" style command which parses it's input (string,
+binary or raw stream) into Value.
+
+The returned Command has Name, Category and InputOutputTypes of the Signature
+assigned, the caller must fill in other required fields (Desc, SearchTerms)
+and may change the pre-filled ones.
+
+The reader passed to the parse callback must not be used after the callback
+returns.
+*/
+func FromConverter(name string, parse func(ctx context.Context, r io.Reader) (Value, error)) *Command {
+	return &Command{
+		Signature: PluginSignature{
+			Name:     name,
+			Category: CategoryFormats,
+			InputOutputTypes: []InOutTypes{
+				{In: types.String(), Out: types.Any()},
+				{In: types.Binary(), Out: types.Any()},
+			},
+		},
+		OnRun: func(ctx context.Context, exec *ExecCommand) error {
+			var r io.Reader
+			switch in := exec.Input.(type) {
+			case Value:
+				switch data := in.Value.(type) {
+				case string:
+					r = strings.NewReader(data)
+				case []byte:
+					r = bytes.NewReader(data)
+				default:
+					return fmt.Errorf("unsupported input value type %T", data)
+				}
+			case io.ReadCloser:
+				defer in.Close()
+				r = in
+			case nil:
+				return fmt.Errorf("input is required")
+			default:
+				return fmt.Errorf("unsupported input type %T", in)
+			}
+
+			v, err := parse(ctx, r)
+			if err != nil {
+				return err
+			}
+			return exec.ReturnValue(ctx, v)
+		},
+	}
+}
+
+/*
+ToConverter creates "to X" style command which serializes it's input into
+raw output stream. List stream input is collected into List Value before
+calling the write callback.
+
+The opts are used to create the output stream, ie [StringStream] should be
+used when the format is text based.
+
+The returned Command has Name, Category and InputOutputTypes of the Signature
+assigned, the caller must fill in other required fields (Desc, SearchTerms)
+and may change the pre-filled ones.
+*/
+func ToConverter(name string, write func(ctx context.Context, v Value, w io.Writer) error, opts ...RawStreamOption) *Command {
+	return &Command{
+		Signature: PluginSignature{
+			Name:     name,
+			Category: CategoryFormats,
+			InputOutputTypes: []InOutTypes{
+				{In: types.Any(), Out: types.String()},
+				{In: types.Any(), Out: types.Binary()},
+			},
+		},
+		OnRun: func(ctx context.Context, exec *ExecCommand) error {
+			var v Value
+			switch in := exec.Input.(type) {
+			case Value:
+				v = in
+			case <-chan Value:
+				var lst []Value
+				for item := range in {
+					lst = append(lst, item)
+				}
+				v = Value{Value: lst, Span: exec.Head}
+			case nil:
+				return fmt.Errorf("input is required")
+			default:
+				return fmt.Errorf("unsupported input type %T", in)
+			}
+
+			out, err := exec.ReturnRawStream(ctx, opts...)
+			if err != nil {
+				return fmt.Errorf("opening output stream: %w", err)
+			}
+			defer out.Close()
+			return write(ctx, v, out)
+		},
+	}
+}
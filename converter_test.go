@@ -0,0 +1,90 @@
+package nu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func Test_FromConverter(t *testing.T) {
+	cmd := FromConverter("from upper", func(ctx context.Context, r io.Reader) (Value, error) {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{Value: strings.ToUpper(string(b))}, nil
+	})
+	cmd.Signature.Desc = "test cmd"
+	cmd.Signature.SearchTerms = []string{"upper"}
+
+	p, err := New([]*Command{cmd}, "", &Config{Logger: logger(t)})
+	if err != nil {
+		t.Fatalf("creating plugin: %v", err)
+	}
+
+	t.Run("string input", func(t *testing.T) {
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "from upper", Input: Value{Value: "foo"}}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: Value{Value: "FOO"}}}},
+		))
+	})
+
+	t.Run("binary input", func(t *testing.T) {
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "from upper", Input: Value{Value: []byte("bar")}}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: Value{Value: "BAR"}}}},
+		))
+	})
+
+	t.Run("unsupported input", func(t *testing.T) {
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "from upper", Input: Value{Value: 42}}}},
+			msgDef{recv: callResponse{ID: 1, Response: LabeledError{Msg: "unsupported input value type int64"}}},
+		))
+	})
+}
+
+func Test_ToConverter(t *testing.T) {
+	cmd := ToConverter("to text", func(ctx context.Context, v Value, w io.Writer) error {
+		_, err := fmt.Fprintf(w, "%v", v.Value)
+		return err
+	}, StringStream())
+	cmd.Signature.Desc = "test cmd"
+	cmd.Signature.SearchTerms = []string{"text"}
+
+	p, err := New([]*Command{cmd}, "", &Config{Logger: logger(t)})
+	if err != nil {
+		t.Fatalf("creating plugin: %v", err)
+	}
+
+	runEngine(t, p, append(protocolPrelude,
+		msgDef{send: &call{ID: 1, Call: run{Name: "to text", Input: Value{Value: 42}}}},
+		msgDef{recv: callResponse{ID: 1, Response: pipelineData{byteStream{ID: 1, Type: "String"}}}},
+		msgDef{recv: data{ID: 1, Data: []byte("42")}},
+		msgDef{send: &ack{ID: 1}},
+		msgDef{recv: end{ID: 1}},
+		msgDef{send: &drop{ID: 1}},
+	))
+}
+
+func ExampleFromConverter() {
+	// command which decodes JSON array of strings into List of String Values
+	cmd := FromConverter("from str-array", func(ctx context.Context, r io.Reader) (Value, error) {
+		var items []string
+		if err := json.NewDecoder(r).Decode(&items); err != nil {
+			return Value{}, fmt.Errorf("decoding input: %w", err)
+		}
+		lst := make([]Value, len(items))
+		for i, s := range items {
+			lst[i] = Value{Value: s}
+		}
+		return Value{Value: lst}, nil
+	})
+	cmd.Signature.Desc = "Convert JSON array of strings into list"
+	cmd.Signature.SearchTerms = []string{"json", "array"}
+
+	_, _ = New([]*Command{cmd}, "1.0.0", nil)
+}
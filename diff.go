@@ -0,0 +1,134 @@
+package nu
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"time"
+)
+
+type ChangeOp uint8
+
+const (
+	ChangeAdded    ChangeOp = 1 // cell exists only in the new value
+	ChangeRemoved  ChangeOp = 2 // cell exists only in the old value
+	ChangeModified ChangeOp = 3 // value of the cell is different
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangeAdded:
+		return "added"
+	case ChangeRemoved:
+		return "removed"
+	case ChangeModified:
+		return "modified"
+	default:
+		return fmt.Sprintf("ChangeOp(%d)", int(op))
+	}
+}
+
+/*
+Change describes difference between two Values found by [Diff].
+*/
+type Change struct {
+	Path CellPath // path of the cell, empty when the root values differ
+	Op   ChangeOp
+	Old  Value // zero Value when Op is ChangeAdded
+	New  Value // zero Value when Op is ChangeRemoved
+}
+
+/*
+Diff compares Values a and b and returns list of changes which turn a into b.
+
+Records and Lists are compared recursively - added and removed Record fields
+and List items (when lists have different length) are reported with the path
+of the cell. When the type of the cell differs (ie Record vs List) or scalar
+values are not equal the cell is reported as modified. Scalars of different
+Go type are not equal (ie int(1) and int64(1)). Spans of the Values are
+ignored. Record fields are reported in sorted order of the field names.
+
+Returns nil when the Values are equal.
+*/
+func Diff(a, b Value) []Change {
+	var changes []Change
+	diffValue(&changes, CellPath{}, a, b)
+	return changes
+}
+
+func diffValue(changes *[]Change, path CellPath, a, b Value) {
+	switch av := a.Value.(type) {
+	case Record:
+		if bv, ok := b.Value.(Record); ok {
+			diffRecord(changes, path, av, bv)
+			return
+		}
+	case []Value:
+		if bv, ok := b.Value.([]Value); ok {
+			diffList(changes, path, av, bv)
+			return
+		}
+	default:
+		if scalarEqual(a.Value, b.Value) {
+			return
+		}
+	}
+	*changes = append(*changes, Change{Path: path, Op: ChangeModified, Old: a, New: b})
+}
+
+func diffRecord(changes *[]Change, path CellPath, a, b Record) {
+	keys := slices.Sorted(maps.Keys(a))
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		p := subPath(path, PathMember{Type: PathMemberString, Name: k})
+		av, inA := a[k]
+		bv, inB := b[k]
+		switch {
+		case !inB:
+			*changes = append(*changes, Change{Path: p, Op: ChangeRemoved, Old: av})
+		case !inA:
+			*changes = append(*changes, Change{Path: p, Op: ChangeAdded, New: bv})
+		default:
+			diffValue(changes, p, av, bv)
+		}
+	}
+}
+
+func diffList(changes *[]Change, path CellPath, a, b []Value) {
+	for i := range max(len(a), len(b)) {
+		p := subPath(path, PathMember{Type: PathMemberInt, Index: uint(i)})
+		switch {
+		case i >= len(b):
+			*changes = append(*changes, Change{Path: p, Op: ChangeRemoved, Old: a[i]})
+		case i >= len(a):
+			*changes = append(*changes, Change{Path: p, Op: ChangeAdded, New: b[i]})
+		default:
+			diffValue(changes, p, a[i], b[i])
+		}
+	}
+}
+
+// subPath returns copy of the path with m appended.
+func subPath(path CellPath, m PathMember) CellPath {
+	return CellPath{Members: append(slices.Clip(path.Members), m)}
+}
+
+func scalarEqual(a, b any) bool {
+	switch av := a.(type) {
+	case time.Time:
+		bv, ok := b.(time.Time)
+		return ok && av.Equal(bv)
+	case []byte:
+		bv, ok := b.([]byte)
+		return ok && bytes.Equal(av, bv)
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,101 @@
+package nu
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_Diff(t *testing.T) {
+	path := func(segments ...any) CellPath {
+		cp, err := NewCellPath(segments...)
+		if err != nil {
+			t.Fatalf("creating cell path: %v", err)
+		}
+		return cp
+	}
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	testCases := []struct {
+		name    string
+		a, b    Value
+		changes []Change
+	}{
+		{
+			name: "equal scalars",
+			a:    Value{Value: int64(1), Span: Span{Start: 1, End: 2}},
+			b:    Value{Value: int64(1)},
+		},
+		{
+			name: "equal time in different location",
+			a:    Value{Value: ts},
+			b:    Value{Value: ts.In(time.FixedZone("X", 3600))},
+		},
+		{
+			name:    "modified scalar",
+			a:       Value{Value: "foo"},
+			b:       Value{Value: "bar"},
+			changes: []Change{{Path: CellPath{}, Op: ChangeModified, Old: Value{Value: "foo"}, New: Value{Value: "bar"}}},
+		},
+		{
+			name:    "different type",
+			a:       Value{Value: Record{"a": Value{Value: 1}}},
+			b:       Value{Value: []Value{{Value: 1}}},
+			changes: []Change{{Path: CellPath{}, Op: ChangeModified, Old: Value{Value: Record{"a": Value{Value: 1}}}, New: Value{Value: []Value{{Value: 1}}}}},
+		},
+		{
+			name: "record fields",
+			a:    Value{Value: Record{"a": Value{Value: 1}, "b": Value{Value: 2}, "c": Value{Value: 3}}},
+			b:    Value{Value: Record{"b": Value{Value: 2}, "c": Value{Value: 4}, "d": Value{Value: 5}}},
+			changes: []Change{
+				{Path: path("a"), Op: ChangeRemoved, Old: Value{Value: 1}},
+				{Path: path("c"), Op: ChangeModified, Old: Value{Value: 3}, New: Value{Value: 4}},
+				{Path: path("d"), Op: ChangeAdded, New: Value{Value: 5}},
+			},
+		},
+		{
+			name: "list items",
+			a:    Value{Value: []Value{{Value: 1}, {Value: 2}}},
+			b:    Value{Value: []Value{{Value: 1}, {Value: 3}, {Value: 4}}},
+			changes: []Change{
+				{Path: path(1), Op: ChangeModified, Old: Value{Value: 2}, New: Value{Value: 3}},
+				{Path: path(2), Op: ChangeAdded, New: Value{Value: 4}},
+			},
+		},
+		{
+			name:    "list item removed",
+			a:       Value{Value: []Value{{Value: 1}, {Value: 2}}},
+			b:       Value{Value: []Value{{Value: 1}}},
+			changes: []Change{{Path: path(1), Op: ChangeRemoved, Old: Value{Value: 2}}},
+		},
+		{
+			name: "nested",
+			a: Value{Value: Record{
+				"list": Value{Value: []Value{
+					{Value: Record{"name": Value{Value: "x"}, "data": Value{Value: []byte{1, 2}}}},
+					{Value: Record{"name": Value{Value: "y"}}},
+				}},
+			}},
+			b: Value{Value: Record{
+				"list": Value{Value: []Value{
+					{Value: Record{"name": Value{Value: "x"}, "data": Value{Value: []byte{1, 3}}}},
+					{Value: Record{"name": Value{Value: "y"}, "size": Value{Value: Filesize(10)}}},
+				}},
+			}},
+			changes: []Change{
+				{Path: path("list", 0, "data"), Op: ChangeModified, Old: Value{Value: []byte{1, 2}}, New: Value{Value: []byte{1, 3}}},
+				{Path: path("list", 1, "size"), Op: ChangeAdded, New: Value{Value: Filesize(10)}},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			changes := Diff(tc.a, tc.b)
+			if diff := cmp.Diff(tc.changes, changes); diff != "" {
+				t.Errorf("changes mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"io"
 	"reflect"
 	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/vmihailenco/msgpack/v5"
 )
@@ -75,7 +77,7 @@ Get the Nushell engine configuration.
 //TODO: need to implement decoding the response struct, the msgpack lib's
 //generic decode map doesn't seem to work...
 func (ec *ExecCommand) GetConfig(ctx context.Context) (any, error) {
-	ch, err := ec.p.engineCall(ctx, ec.callID, "GetConfig")
+	ch, err := ec.engineCall(ctx, idempotent{"GetConfig"})
 	if err != nil {
 		return nil, fmt.Errorf("engine call: %w", err)
 	}
@@ -111,9 +113,13 @@ func (ec *ExecCommand) GetPluginConfig(ctx context.Context) (*Value, error) {
 AddEnvVar engine call.
 
 Set an environment variable in the caller's scope. The environment variable can only
-be propagated to the caller's scope if called before the plugin call response is sent.
+be propagated to the caller's scope if called before the plugin call response is sent,
+[ErrResponseSent] is returned when called after the response.
 */
 func (ec *ExecCommand) AddEnvVar(ctx context.Context, name string, value Value) error {
+	if ec.Responded() {
+		return fmt.Errorf("AddEnvVar %q must be called before the response is sent: %w", name, ErrResponseSent)
+	}
 	type param struct {
 		Var []any `msgpack:"AddEnvVar"`
 	}
@@ -137,7 +143,7 @@ func (ec *ExecCommand) GetEnvVar(ctx context.Context, name string) (*Value, erro
 	type param struct {
 		Name string `msgpack:"GetEnvVar"`
 	}
-	return ec.engineCallValueReturn(ctx, param{Name: name})
+	return ec.engineCallValueReturn(ctx, idempotent{param{Name: name}})
 }
 
 /*
@@ -169,16 +175,41 @@ func (ec *ExecCommand) GetEnvVars(ctx context.Context) (map[string]Value, error)
 GetCurrentDir engine call.
 
 Get the current directory path in the caller's scope. This always returns an absolute path.
+
+As the current directory can't change during the plugin call the result is
+cached, ie only the first call makes the engine call. Use
+[ExecCommand.RefreshCurrentDir] to force re-fetch.
 */
 func (ec *ExecCommand) GetCurrentDir(ctx context.Context) (string, error) {
+	ec.cwdLock.Lock()
+	defer ec.cwdLock.Unlock()
+
+	if ec.cwd != nil {
+		return *ec.cwd, nil
+	}
+
 	v, err := ec.engineCallValueReturn(ctx, "GetCurrentDir")
 	if err != nil {
 		return "", err
 	}
-	if v == nil {
-		return "", nil
+	dir := ""
+	if v != nil {
+		dir = v.Value.(string)
 	}
-	return v.Value.(string), nil
+	ec.cwd = &dir
+	return dir, nil
+}
+
+/*
+RefreshCurrentDir discards the current directory cached by
+[ExecCommand.GetCurrentDir] and fetches it from the engine again.
+*/
+func (ec *ExecCommand) RefreshCurrentDir(ctx context.Context) (string, error) {
+	ec.cwdLock.Lock()
+	ec.cwd = nil
+	ec.cwdLock.Unlock()
+
+	return ec.GetCurrentDir(ctx)
 }
 
 /*
@@ -259,8 +290,63 @@ func (ec *ExecCommand) GetSpanContents(ctx context.Context, span Span) ([]byte,
 	return v.Value.([]byte), nil
 }
 
+/*
+ErrorAt creates LabeledError with message msg and single label pointing to
+the span. The label text is the source code of the span (obtained using
+[ExecCommand.GetSpanContents]), when the contents can't be fetched the msg
+is used as label text.
+*/
+func (ec *ExecCommand) ErrorAt(ctx context.Context, span Span, msg string) *LabeledError {
+	text := msg
+	if src, err := ec.GetSpanContents(ctx, span); err != nil {
+		ec.p.log.DebugContext(ctx, "getting span contents for error label", attrError(err))
+	} else if len(src) != 0 {
+		text = string(src)
+	}
+	return &LabeledError{Msg: msg, Labels: []ErrorLabel{{Text: text, Span: span}}}
+}
+
+/*
+idempotent wraps engine call query which is safe to send again, when sending
+such query fails it is retried up to [Config.EngineCallRetries] times.
+*/
+type idempotent struct{ query any }
+
+// engineCallBackoff is the delay before the first retry of the engine call,
+// it is doubled for every subsequent retry.
+const engineCallBackoff = 10 * time.Millisecond
+
+/*
+engineCall sends the engine call query in the context of the command call.
+
+Only failure to send the query before any part of it was written to the
+output is considered to be transient error. Error response from the engine
+(LabeledError) is returned via the chan and thus never retried.
+*/
+func (ec *ExecCommand) engineCall(ctx context.Context, query any) (<-chan any, error) {
+	q, ok := query.(idempotent)
+	if !ok {
+		return ec.p.engineCall(ctx, ec.callID, query)
+	}
+
+	delay := engineCallBackoff
+	for attempt := 0; ; attempt++ {
+		ch, err := ec.p.engineCall(ctx, ec.callID, q.query)
+		if err == nil || attempt >= ec.p.engineCallRetries || ctx.Err() != nil || !errors.As(err, new(notSentError)) {
+			return ch, err
+		}
+		ec.p.log.DebugContext(ctx, "retrying engine call", attrError(err), attrCallID(ec.callID))
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			return nil, errors.Join(err, context.Cause(ctx))
+		}
+	}
+}
+
 func (ec *ExecCommand) engineCallValueReturn(ctx context.Context, arg any) (*Value, error) {
-	ch, err := ec.p.engineCall(ctx, ec.callID, arg)
+	ch, err := ec.engineCall(ctx, arg)
 	if err != nil {
 		return nil, fmt.Errorf("engine call: %w", err)
 	}
@@ -317,7 +403,118 @@ func (ec *ExecCommand) EvalClosure(ctx context.Context, closure Value, args ...E
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	case v := <-ch:
-		return ec.p.getInput(ctx, v)
+		in, err := ec.p.getInput(ctx, v)
+		if err != nil {
+			return nil, err
+		}
+		return cfg.reSpanResult(ctx, in), nil
+	}
+}
+
+/*
+mapClosureConcurrency is the max number of closure evaluations
+[ExecCommand.MapClosure] has in flight.
+*/
+const mapClosureConcurrency = 4
+
+/*
+MapClosure evaluates the closure for each Value received from items (the
+item is passed to the closure both as input and as the first positional
+argument, like Nushell's "each" command does) and sends the results into
+the returned chan. Up to four closures are evaluated concurrently but the
+order of the results is the same as the order of items.
+
+When the closure returns list stream all the items of the stream are sent
+to the output, raw stream is collected into single String (or Binary when
+it's not valid UTF-8) Value. Empty result (nil) is dropped. When evaluation
+fails the error is sent to the output as Error Value (see [ErrorValue]).
+
+The output chan is closed when items is closed and all the results have
+been sent or when ctx is cancelled.
+*/
+func (ec *ExecCommand) MapClosure(ctx context.Context, closure Value, items <-chan Value) (<-chan Value, error) {
+	if _, ok := closure.Value.(Closure); !ok {
+		return nil, fmt.Errorf("closure argument must be of type Closure, got %T", closure.Value)
+	}
+
+	// results of the evaluations in the order of the items, the buffer
+	// size limits the number of the evaluations in flight
+	pending := make(chan chan []Value, mapClosureConcurrency-1)
+	go func() {
+		defer close(pending)
+		for {
+			var item Value
+			var ok bool
+			select {
+			case item, ok = <-items:
+				if !ok {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+
+			res := make(chan []Value, 1)
+			select {
+			case pending <- res:
+			case <-ctx.Done():
+				return
+			}
+			go func() { res <- ec.mapClosureItem(ctx, closure, item) }()
+		}
+	}()
+
+	out := make(chan Value)
+	go func() {
+		defer close(out)
+		for res := range pending {
+			var values []Value
+			select {
+			case values = <-res:
+			case <-ctx.Done():
+				return
+			}
+			for _, v := range values {
+				select {
+				case out <- v:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+// mapClosureItem evaluates closure for single item, see [ExecCommand.MapClosure].
+func (ec *ExecCommand) mapClosureItem(ctx context.Context, closure Value, item Value) []Value {
+	result, err := ec.EvalClosure(ctx, closure, InputValue(item), Positional(item))
+	if err != nil {
+		return []Value{ErrorValue(err, item.Span)}
+	}
+
+	switch data := result.(type) {
+	case nil:
+		return nil
+	case Value:
+		return []Value{data}
+	case <-chan Value:
+		var values []Value
+		for v := range data {
+			values = append(values, v)
+		}
+		return values
+	case io.Reader:
+		b, err := io.ReadAll(data)
+		if err != nil {
+			return []Value{ErrorValue(fmt.Errorf("reading closure output: %w", err), item.Span)}
+		}
+		if utf8.Valid(b) {
+			return []Value{{Value: string(b), Span: item.Span}}
+		}
+		return []Value{{Value: b, Span: item.Span}}
+	default:
+		return []Value{ErrorValue(fmt.Errorf("unsupported closure result type %T", data), item.Span)}
 	}
 }
 
@@ -381,6 +578,8 @@ in the scope of the plugin call (NB! use [errors.Is] to check for the error as
 it might be wrapped into more descriptive error).
 
 In case of success the returned Declaration can be used to call the command.
+The protocol has no engine call to enumerate the available commands so the
+name of the command must be known in advance.
 
 [FindDecl engine call]: https://www.nushell.sh/contributor-book/plugin_protocol_reference.html#finddecl-engine-call
 */
@@ -388,7 +587,7 @@ func (ec *ExecCommand) FindDeclaration(ctx context.Context, name string) (*Decla
 	type param struct {
 		Name string `msgpack:"FindDecl"`
 	}
-	ch, err := ec.p.engineCall(ctx, ec.callID, param{Name: name})
+	ch, err := ec.engineCall(ctx, idempotent{param{Name: name}})
 	if err != nil {
 		return nil, fmt.Errorf("engine call: %w", err)
 	}
@@ -443,7 +642,11 @@ func (d Declaration) Call(ctx context.Context, args ...EvalArgument) (any, error
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	case v := <-ch:
-		return d.ec.p.getInput(ctx, v)
+		in, err := d.ec.p.getInput(ctx, v)
+		if err != nil {
+			return nil, err
+		}
+		return cfg.reSpanResult(ctx, in), nil
 	}
 }
 
@@ -490,6 +693,7 @@ type (
 		input           any
 		redirect_stdout bool
 		redirect_stderr bool
+		span            *Span // when not nil spans of the result are replaced with it
 
 		p   *Plugin
 		run func(ctx context.Context)
@@ -533,6 +737,54 @@ func (args *evalArguments) encodeCommonFields(enc *msgpack.Encoder) error {
 	return nil
 }
 
+/*
+reSpanResult replaces the spans of the call result with the span set by
+[ReSpan] argument. Items of the list stream are re-spanned as they are read.
+*/
+func (args *evalArguments) reSpanResult(ctx context.Context, result any) any {
+	if args.span == nil {
+		return result
+	}
+
+	switch in := result.(type) {
+	case Value:
+		reSpan(&in, *args.span)
+		return in
+	case <-chan Value:
+		out := make(chan Value)
+		go func() {
+			defer close(out)
+			for v := range in {
+				reSpan(&v, *args.span)
+				select {
+				case out <- v:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return (<-chan Value)(out)
+	default:
+		return result
+	}
+}
+
+// reSpan sets the span of v and all the Values nested in it to span.
+func reSpan(v *Value, span Span) {
+	v.Span = span
+	switch data := v.Value.(type) {
+	case []Value:
+		for i := range data {
+			reSpan(&data[i], span)
+		}
+	case Record:
+		for k, fv := range data {
+			reSpan(&fv, span)
+			data[k] = fv
+		}
+	}
+}
+
 func (args *evalArguments) setInput(arg any) error {
 	if _, ok := args.input.(empty); !ok {
 		return fmt.Errorf("the Input parameter has already been set to %T", args.input)
@@ -616,3 +868,13 @@ Default is "false", this argument sets it to "true".
 func RedirectStderr() EvalArgument {
 	return evalArgument{fn: func(ec *evalArguments) error { ec.redirect_stderr = true; return nil }}
 }
+
+/*
+ReSpan replaces the spans of the result of the call (including Values nested
+in Lists and Records and items of the list stream) with span. By default the
+spans point into the source of the closure or declaration, use ReSpan (ie
+with [ExecCommand.Head] as argument) to make them point to the plugin call.
+*/
+func ReSpan(span Span) EvalArgument {
+	return evalArgument{fn: func(ec *evalArguments) error { ec.span = &span; return nil }}
+}
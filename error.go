@@ -1,5 +1,20 @@
 package nu
 
+import "errors"
+
+/*
+LabeledError is the error type of the plugin protocol.
+
+Nushell treats every error response as failure of the plugin call, the
+protocol has no notion of error severity (ie warning or recoverable error).
+Commands which want to report non-fatal problems should include them into
+the output data instead of returning an error.
+
+Any Go error returned by the command's OnRun handler is converted into
+LabeledError (see [AsLabeledError]), use LabeledError directly to assign
+labels, help text etc. Only pointer implements the error interface so
+return *LabeledError, it may be wrapped (ie with [fmt.Errorf] and %w verb).
+*/
 type LabeledError struct {
 	Msg    string         `msgpack:"msg"`
 	Labels []ErrorLabel   `msgpack:"labels,omitempty"`
@@ -18,14 +33,42 @@ type ErrorLabel struct {
 }
 
 /*
-AsLabeledError "converts" error to LabeledError - if the
-error is already LabeledError it will be "unwrapped",
-otherwise new LabeledError will be created wrapping the err.
+AsLabeledError converts err to LabeledError, this is how errors are sent to
+the engine (ie error returned by the OnRun handler or error Value):
+
+  - nil error is converted to nil;
+  - when err is *LabeledError it is returned as is;
+  - when err is created by [errors.Join] (or otherwise wraps multiple errors)
+    each of the joined errors is converted and added to the Inner list;
+  - when err wraps *LabeledError (see [errors.As]) copy of the wrapped error
+    is returned with Msg replaced by the message of err so the context added
+    by wrapping is preserved together with labels, help text etc;
+  - otherwise new LabeledError is created with the message of err.
 */
 func AsLabeledError(err error) *LabeledError {
+	if err == nil {
+		return nil
+	}
 	if le, ok := err.(*LabeledError); ok {
 		return le
 	}
+
+	if je, ok := err.(interface{ Unwrap() []error }); ok {
+		out := &LabeledError{Msg: err.Error()}
+		for _, e := range je.Unwrap() {
+			if e != nil {
+				out.Inner = append(out.Inner, *AsLabeledError(e))
+			}
+		}
+		return out
+	}
+
+	var le *LabeledError
+	if errors.As(err, &le) {
+		out := *le
+		out.Msg = err.Error()
+		return &out
+	}
 	return &LabeledError{Msg: err.Error()}
 }
 
@@ -0,0 +1,62 @@
+package nu
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_AsLabeledError(t *testing.T) {
+	span := Span{Start: 5, End: 8}
+	le := &LabeledError{Msg: "invalid value", Labels: []ErrorLabel{{Text: "here", Span: span}}, Help: "use number"}
+
+	testCases := []struct {
+		name string
+		in   error
+		out  *LabeledError
+	}{
+		{name: "nil", in: nil, out: nil},
+		{name: "plain error", in: errors.New("oops"), out: &LabeledError{Msg: "oops"}},
+		{name: "LabeledError", in: le, out: le},
+		{
+			name: "wrapped LabeledError",
+			in:   fmt.Errorf("reading config: %w", le),
+			out:  &LabeledError{Msg: "reading config: invalid value", Labels: []ErrorLabel{{Text: "here", Span: span}}, Help: "use number"},
+		},
+		{
+			name: "wrapped twice",
+			in:   fmt.Errorf("cmd: %w", fmt.Errorf("reading config: %w", le)),
+			out:  &LabeledError{Msg: "cmd: reading config: invalid value", Labels: []ErrorLabel{{Text: "here", Span: span}}, Help: "use number"},
+		},
+		{
+			name: "joined errors",
+			in:   errors.Join(errors.New("first"), errors.New("second")),
+			out:  &LabeledError{Msg: "first\nsecond", Inner: []LabeledError{{Msg: "first"}, {Msg: "second"}}},
+		},
+		{
+			name: "joined LabeledError",
+			in:   errors.Join(errors.New("first"), fmt.Errorf("second: %w", le)),
+			out: &LabeledError{Msg: "first\nsecond: invalid value", Inner: []LabeledError{
+				{Msg: "first"},
+				{Msg: "second: invalid value", Labels: []ErrorLabel{{Text: "here", Span: span}}, Help: "use number"},
+			}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.out, AsLabeledError(tc.in)); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("original is not modified", func(t *testing.T) {
+		AsLabeledError(fmt.Errorf("wrapped: %w", le))
+		if le.Msg != "invalid value" {
+			t.Errorf("original error message has been changed to %q", le.Msg)
+		}
+	})
+}
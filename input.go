@@ -0,0 +1,243 @@
+package nu
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"maps"
+)
+
+/*
+InputAsSeq returns iterator over the Values of the command's Input:
+
+  - nil (no input): iterator yields nothing;
+  - Value of type List: items of the list are yielded;
+  - Value of type [Range]: values of the range are yielded as Int or Float
+    Values;
+  - other Value: the Value itself is yielded;
+  - list stream: Values read from the stream are yielded;
+  - raw stream: error is yielded as raw stream input is not supported.
+
+When the ctx is cancelled iterator yields the context's error and stops.
+
+By default Error Values (engine may send errors as items of the list stream)
+are yielded as any other Value, use [ErrorValuesAsErrors] option to get them
+as Go errors instead.
+*/
+func (ec *ExecCommand) InputAsSeq(ctx context.Context, opts ...InputOption) iter.Seq2[Value, error] {
+	cfg := inputCfg{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return func(yield func(Value, error) bool) {
+		if cfg.errorValues {
+			yield = yieldErrorValues(yield)
+		}
+		switch in := ec.Input.(type) {
+		case nil:
+		case Value:
+			yieldValue(ctx, in, yield)
+		case <-chan Value:
+			for {
+				select {
+				case <-ctx.Done():
+					yield(Value{}, ctx.Err())
+					return
+				case v, ok := <-in:
+					if !ok || !yield(v, nil) {
+						return
+					}
+				}
+			}
+		case io.Reader:
+			yield(Value{}, fmt.Errorf("raw stream input is not supported"))
+		default:
+			yield(Value{}, fmt.Errorf("unsupported input type %T", in))
+		}
+	}
+}
+
+/*
+CollectInput returns the Values of the command's input as slice, the Values
+are read using [ExecCommand.InputAsSeq] (ie List input is returned as its
+items). Error is returned when the input has more than limit Values so it is
+safe to use with unbounded input stream. The error is [LabeledError] pointing
+to the command's head so it can be returned to the engine as is.
+*/
+func (ec *ExecCommand) CollectInput(ctx context.Context, limit int) ([]Value, error) {
+	if limit < 0 {
+		return nil, fmt.Errorf("limit must not be negative, got %d", limit)
+	}
+	var lst []Value
+	for v, err := range ec.InputAsSeq(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		if len(lst) == limit {
+			return nil, &LabeledError{
+				Msg:    fmt.Sprintf("input has more than %d values", limit),
+				Labels: []ErrorLabel{{Text: "too many input values", Span: ec.Head}},
+			}
+		}
+		lst = append(lst, v)
+	}
+	return lst, nil
+}
+
+/*
+InputMergedRecord merges the Records of the command's input (read using
+[ExecCommand.InputAsSeq]) into single Record, from left to right, ie when
+the same field is present in multiple records the last one wins.
+Non-Record item in the input is an error.
+*/
+func (ec *ExecCommand) InputMergedRecord(ctx context.Context) (Record, error) {
+	rec := Record{}
+	idx := 0
+	for v, err := range ec.InputAsSeq(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		r, ok := v.Value.(Record)
+		if !ok {
+			return nil, &LabeledError{
+				Msg:    "input must consist of records",
+				Labels: []ErrorLabel{{Text: fmt.Sprintf("item [%d] is %s, expected record", idx, typeOf(v.Value)), Span: v.Span}},
+			}
+		}
+		maps.Copy(rec, r)
+		idx++
+	}
+	return rec, nil
+}
+
+/*
+InputOption configures the iterator returned by [ExecCommand.InputAsSeq].
+*/
+type InputOption func(*inputCfg)
+
+type inputCfg struct {
+	errorValues bool
+}
+
+/*
+ErrorValuesAsErrors makes the [ExecCommand.InputAsSeq] iterator to yield
+Error Values (Value of type [LabeledError] or error) as Go error, ie the
+Value is yielded together with non-nil error. This is symmetric with
+[ExecCommand.ReturnListStream] where sending error Value means that the
+command failed.
+
+The iteration is not stopped by the error Value, it is up to the consumer
+to decide whether to continue.
+*/
+func ErrorValuesAsErrors() InputOption {
+	return func(cfg *inputCfg) { cfg.errorValues = true }
+}
+
+// yieldErrorValues wraps yield so that Error Values are yielded as errors.
+func yieldErrorValues(yield func(Value, error) bool) func(Value, error) bool {
+	return func(v Value, err error) bool {
+		if err == nil {
+			switch e := v.Value.(type) {
+			case LabeledError:
+				err = &e
+			case error:
+				err = e
+			}
+		}
+		return yield(v, err)
+	}
+}
+
+// yieldValue yields v or, when v is List or Range, the items of it.
+func yieldValue(ctx context.Context, v Value, yield func(Value, error) bool) {
+	switch data := v.Value.(type) {
+	case []Value:
+		for _, item := range data {
+			if err := ctx.Err(); err != nil {
+				yield(Value{}, err)
+				return
+			}
+			if !yield(item, nil) {
+				return
+			}
+		}
+	case Range:
+		for item := range data.Values() {
+			if err := ctx.Err(); err != nil {
+				yield(Value{}, err)
+				return
+			}
+			item.Span = v.Span
+			if !yield(item, nil) {
+				return
+			}
+		}
+	default:
+		yield(v, nil)
+	}
+}
+
+/*
+MapPreservingShape applies fn to the command's input and returns the result
+in the same "shape" as the input was:
+
+  - nil (no input): nothing is returned, fn is not called;
+  - Value of type List or [Range]: fn is applied to each item and List
+    Value is returned;
+  - other Value: fn is applied to the Value and result is returned;
+  - list stream: fn is applied to each item and list stream is returned.
+
+Error returned by fn aborts the processing and is returned by
+MapPreservingShape.
+*/
+func (ec *ExecCommand) MapPreservingShape(ctx context.Context, fn func(Value) (Value, error)) error {
+	switch in := ec.Input.(type) {
+	case nil:
+		return nil
+	case Value:
+		switch in.Value.(type) {
+		case []Value, IntRange, FloatRange:
+			lst := []Value{}
+			for v, err := range ec.InputAsSeq(ctx) {
+				if err != nil {
+					return err
+				}
+				if v, err = fn(v); err != nil {
+					return err
+				}
+				lst = append(lst, v)
+			}
+			return ec.ReturnValue(ctx, Value{Value: lst, Span: in.Span})
+		default:
+			v, err := fn(in)
+			if err != nil {
+				return err
+			}
+			return ec.ReturnValue(ctx, v)
+		}
+	case <-chan Value:
+		out, err := ec.ReturnListStream(ctx)
+		if err != nil {
+			return fmt.Errorf("opening output stream: %w", err)
+		}
+		defer close(out)
+		for v, err := range ec.InputAsSeq(ctx) {
+			if err != nil {
+				return err
+			}
+			if v, err = fn(v); err != nil {
+				return err
+			}
+			select {
+			case out <- v:
+			case <-ctx.Done():
+				return context.Cause(ctx)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported input type %T", in)
+	}
+}
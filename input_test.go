@@ -0,0 +1,365 @@
+package nu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ainvaltin/nu-plugin/types"
+)
+
+func Test_ExecCommand_InputAsSeq(t *testing.T) {
+	collect := func(t *testing.T, input any) (out []Value) {
+		ec := &ExecCommand{Input: input}
+		for v, err := range ec.InputAsSeq(context.Background()) {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			out = append(out, v)
+		}
+		return out
+	}
+
+	t.Run("no input", func(t *testing.T) {
+		if out := collect(t, nil); len(out) != 0 {
+			t.Errorf("expected no values, got %v", out)
+		}
+	})
+
+	t.Run("single value", func(t *testing.T) {
+		in := Value{Value: "foo", Span: Span{Start: 1, End: 4}}
+		if diff := cmp.Diff([]Value{in}, collect(t, in)); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("list value", func(t *testing.T) {
+		items := []Value{{Value: "foo"}, {Value: int64(2)}}
+		if diff := cmp.Diff(items, collect(t, Value{Value: items})); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("range value", func(t *testing.T) {
+		span := Span{Start: 5, End: 10}
+		in := Value{Value: IntRange{Start: 1, Step: 2, End: 5}, Span: span}
+		expect := []Value{{Value: int64(1), Span: span}, {Value: int64(3), Span: span}, {Value: int64(5), Span: span}}
+		if diff := cmp.Diff(expect, collect(t, in)); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("list stream", func(t *testing.T) {
+		ch := make(chan Value, 2)
+		ch <- Value{Value: 1}
+		ch <- Value{Value: 2}
+		close(ch)
+		if diff := cmp.Diff([]Value{{Value: 1}, {Value: 2}}, collect(t, (<-chan Value)(ch))); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		ec := &ExecCommand{Input: Value{Value: IntRange{Start: 1, Step: 1, Bound: Unbounded}}}
+		for _, err := range ec.InputAsSeq(ctx) {
+			if err != context.Canceled {
+				t.Errorf("expected context.Canceled error, got %v", err)
+			}
+		}
+	})
+}
+
+func Test_ExecCommand_InputAsSeq_ErrorValues(t *testing.T) {
+	collect := func(input any, opts ...InputOption) (vals []Value, errs []string) {
+		ec := &ExecCommand{Input: input}
+		for v, err := range ec.InputAsSeq(context.Background(), opts...) {
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+			vals = append(vals, v)
+		}
+		return vals, errs
+	}
+
+	newStream := func(items ...Value) <-chan Value {
+		ch := make(chan Value, len(items))
+		for _, v := range items {
+			ch <- v
+		}
+		close(ch)
+		return ch
+	}
+
+	items := []Value{{Value: 1}, {Value: LabeledError{Msg: "first"}}, {Value: 2}, {Value: fmt.Errorf("second")}}
+
+	t.Run("without option", func(t *testing.T) {
+		vals, errs := collect(newStream(items...))
+		if len(errs) != 0 {
+			t.Errorf("expected no errors, got %v", errs)
+		}
+		if diff := cmp.Diff(items, vals, cmp.Comparer(func(a, b error) bool { return a.Error() == b.Error() })); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("list stream", func(t *testing.T) {
+		vals, errs := collect(newStream(items...), ErrorValuesAsErrors())
+		if diff := cmp.Diff([]string{"first", "second"}, errs); diff != "" {
+			t.Errorf("errors mismatch (-want +got):\n%s", diff)
+		}
+		if len(vals) != len(items) {
+			t.Errorf("expected %d values, got %d", len(items), len(vals))
+		}
+	})
+
+	t.Run("list value", func(t *testing.T) {
+		_, errs := collect(Value{Value: items}, ErrorValuesAsErrors())
+		if diff := cmp.Diff([]string{"first", "second"}, errs); diff != "" {
+			t.Errorf("errors mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("single value", func(t *testing.T) {
+		_, errs := collect(Value{Value: LabeledError{Msg: "single"}}, ErrorValuesAsErrors())
+		if diff := cmp.Diff([]string{"single"}, errs); diff != "" {
+			t.Errorf("errors mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("stop on error", func(t *testing.T) {
+		ec := &ExecCommand{Input: newStream(items...)}
+		cnt := 0
+		for _, err := range ec.InputAsSeq(context.Background(), ErrorValuesAsErrors()) {
+			cnt++
+			if err != nil {
+				break
+			}
+		}
+		if cnt != 2 {
+			t.Errorf("expected iteration to stop after 2 items, got %d", cnt)
+		}
+	})
+}
+
+func Test_ExecCommand_CollectInput(t *testing.T) {
+	newStream := func(cnt int) <-chan Value {
+		ch := make(chan Value, cnt)
+		for i := range cnt {
+			ch <- Value{Value: i}
+		}
+		close(ch)
+		return ch
+	}
+
+	t.Run("within the limit", func(t *testing.T) {
+		testCases := []struct {
+			in  any
+			out []Value
+		}{
+			{in: nil, out: nil},
+			{in: Value{Value: "foo"}, out: []Value{{Value: "foo"}}},
+			{in: Value{Value: []Value{{Value: 1}, {Value: 2}}}, out: []Value{{Value: 1}, {Value: 2}}},
+			{in: newStream(3), out: []Value{{Value: 0}, {Value: 1}, {Value: 2}}},
+		}
+		for _, tc := range testCases {
+			ec := &ExecCommand{Input: tc.in}
+			lst, err := ec.CollectInput(context.Background(), 3)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.out, lst); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	})
+
+	t.Run("stream exceeds the limit", func(t *testing.T) {
+		ec := &ExecCommand{Input: newStream(5), Head: Span{Start: 10, End: 15}}
+		lst, err := ec.CollectInput(context.Background(), 3)
+		expectErrorMsg(t, err, `input has more than 3 values`)
+		if lst != nil {
+			t.Errorf("expected no values, got %v", lst)
+		}
+		var le *LabeledError
+		if !errors.As(err, &le) {
+			t.Fatalf("expected LabeledError, got %T", err)
+		}
+		if diff := cmp.Diff([]ErrorLabel{{Text: "too many input values", Span: ec.Head}}, le.Labels); diff != "" {
+			t.Errorf("labels mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("negative limit", func(t *testing.T) {
+		ec := &ExecCommand{Input: Value{Value: "foo"}}
+		_, err := ec.CollectInput(context.Background(), -1)
+		expectErrorMsg(t, err, `limit must not be negative, got -1`)
+	})
+
+	t.Run("raw stream", func(t *testing.T) {
+		ec := &ExecCommand{Input: io.NopCloser(strings.NewReader("foo"))}
+		_, err := ec.CollectInput(context.Background(), 3)
+		expectErrorMsg(t, err, `raw stream input is not supported`)
+	})
+}
+
+func Test_ExecCommand_InputMergedRecord(t *testing.T) {
+	newStream := func(items ...Value) <-chan Value {
+		ch := make(chan Value, len(items))
+		for _, v := range items {
+			ch <- v
+		}
+		close(ch)
+		return ch
+	}
+
+	t.Run("records", func(t *testing.T) {
+		ec := &ExecCommand{Input: newStream(
+			Value{Value: Record{"a": {Value: 1}, "b": {Value: 2}}},
+			Value{Value: Record{}},
+			Value{Value: Record{"b": {Value: 20}, "c": {Value: 3}}},
+		)}
+		rec, err := ec.InputMergedRecord(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if diff := cmp.Diff(Record{"a": {Value: 1}, "b": {Value: 20}, "c": {Value: 3}}, rec); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("no input", func(t *testing.T) {
+		rec, err := (&ExecCommand{}).InputMergedRecord(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if diff := cmp.Diff(Record{}, rec); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("non-record item", func(t *testing.T) {
+		ec := &ExecCommand{Input: newStream(
+			Value{Value: Record{"a": {Value: 1}}},
+			Value{Value: []Value{{Value: "foo"}}, Span: Span{Start: 4, End: 9}},
+		)}
+		_, err := ec.InputMergedRecord(context.Background())
+		expect := &LabeledError{
+			Msg:    "input must consist of records",
+			Labels: []ErrorLabel{{Text: "item [1] is list<string>, expected record", Span: Span{Start: 4, End: 9}}},
+		}
+		if diff := cmp.Diff(error(expect), err); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func Test_InputAsSeq_range(t *testing.T) {
+	var got []Value
+	p, err := New(
+		[]*Command{{
+			Signature: PluginSignature{
+				Name:             "sum",
+				Category:         "Experimental",
+				Desc:             "test cmd",
+				SearchTerms:      []string{"sum"},
+				InputOutputTypes: []InOutTypes{{types.Range(), types.Int()}},
+			},
+			OnRun: func(ctx context.Context, exec *ExecCommand) error {
+				for v, err := range exec.InputAsSeq(ctx) {
+					if err != nil {
+						return err
+					}
+					got = append(got, v)
+				}
+				return nil
+			},
+		}},
+		"",
+		&Config{Logger: logger(t)},
+	)
+	if err != nil {
+		t.Fatalf("creating plugin: %v", err)
+	}
+
+	runEngine(t, p, append(protocolPrelude,
+		msgDef{send: &call{ID: 1, Call: run{Name: "sum", Input: Value{Value: IntRange{Start: 1, Step: 1, End: 3, Bound: Included}}}}},
+		msgDef{recv: callResponse{ID: 1, Response: pipelineData{empty{}}}},
+	))
+
+	if diff := cmp.Diff([]Value{{Value: int64(1)}, {Value: int64(2)}, {Value: int64(3)}}, got); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_ExecCommand_MapPreservingShape(t *testing.T) {
+	newPlugin := func(t *testing.T, fn func(Value) (Value, error)) *Plugin {
+		p, err := New(
+			[]*Command{{
+				Signature: PluginSignature{
+					Name:             "double",
+					Category:         "Filters",
+					Desc:             "test cmd",
+					SearchTerms:      []string{"double"},
+					InputOutputTypes: []InOutTypes{{In: types.Any(), Out: types.Any()}},
+				},
+				OnRun: func(ctx context.Context, exec *ExecCommand) error {
+					return exec.MapPreservingShape(ctx, fn)
+				},
+			}},
+			"",
+			&Config{Logger: logger(t)},
+		)
+		if err != nil {
+			t.Fatalf("creating plugin: %v", err)
+		}
+		return p
+	}
+	double := func(v Value) (Value, error) {
+		return Value{Value: 2 * v.Value.(int64), Span: v.Span}, nil
+	}
+
+	t.Run("single value", func(t *testing.T) {
+		runEngine(t, newPlugin(t, double), append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "double", Input: Value{Value: 4}}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: Value{Value: int64(8)}}}},
+		))
+	})
+
+	t.Run("list value", func(t *testing.T) {
+		runEngine(t, newPlugin(t, double), append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "double", Input: Value{Value: []Value{{Value: 1}, {Value: 2}}}}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: Value{Value: []Value{{Value: int64(2)}, {Value: int64(4)}}}}}},
+		))
+	})
+
+	t.Run("list stream", func(t *testing.T) {
+		runEngine(t, newPlugin(t, double), append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "double", Input: listStream{ID: 7}}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: listStream{ID: 1}}}},
+			msgDef{send: &data{ID: 7, Data: Value{Value: 3}}},
+			// Ack of the input and the result are sent concurrently
+			msgDef{recv: unordered{ack{ID: 7}, data{ID: 1, Data: Value{Value: int64(6)}}}},
+			// End output stream can't be sent before the last Data is Ack-ed
+			msgDef{send: &end{ID: 7}},
+			msgDef{recv: drop{ID: 7}},
+			msgDef{send: &ack{ID: 1}},
+			msgDef{recv: end{ID: 1}},
+			msgDef{send: &drop{ID: 1}},
+		))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		p := newPlugin(t, func(v Value) (Value, error) { return Value{}, fmt.Errorf("nope") })
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "double", Input: Value{Value: 4}}}},
+			msgDef{recv: callResponse{ID: 1, Response: LabeledError{Msg: "nope"}}},
+		))
+	})
+}
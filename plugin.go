@@ -1,14 +1,19 @@
 package nu
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/vmihailenco/msgpack/v5"
 )
@@ -19,10 +24,27 @@ var ErrGoodbye = errors.New("Goodbye")
 // ErrInterrupt is the exit cause when plugin received Interrupt signal.
 var ErrInterrupt = errors.New("received Interrupt signal")
 
-// ErrDropStream is context cancellation (command's OnRun handler) or stream close error
-// when consumer sent Drop message (ie plugin should stop producing into output stream).
+// ErrMessageTooLarge is the exit cause when plugin received message bigger
+// than [Config.MaxMessageBytes].
+var ErrMessageTooLarge = errors.New("message size limit exceeded")
+
+/*
+ErrDropStream is context cancellation cause (command's OnRun handler) or stream
+write error when consumer sent Drop message (ie plugin should stop producing
+into output stream).
+
+When consumer drops the output stream (list or raw) before it has ended the
+context passed to the command's OnRun handler is cancelled with ErrDropStream
+as the cause, handlers should check context.Cause(ctx) to detect it.
+*/
 var ErrDropStream = errors.New("received Drop stream message")
 
+/*
+ErrCommandTimeout is context cancellation cause (command's OnRun handler) when
+the command's [Command.Timeout] has elapsed.
+*/
+var ErrCommandTimeout = errors.New("command timed out")
+
 /*
 New creates new Nushell Plugin with given commands.
 
@@ -41,6 +63,25 @@ func New(cmd []*Command, version string, cfg *Config) (_ *Plugin, err error) {
 		log:  cfg.logger(),
 	}
 
+	if cfg != nil && cfg.CollectStats {
+		p.stats = newStatsCollector()
+	}
+	if cfg != nil {
+		p.onMsg = cfg.OnMessage
+		p.maxMsgSize = cfg.MaxMessageBytes
+		p.sortKeys = cfg.SortMapKeys
+		p.validateInput = cfg.ValidateInput
+		p.retainRaw = cfg.RetainRawValues
+		p.rejectDupFields = cfg.RejectDuplicateFields
+		p.engineCallRetries = cfg.EngineCallRetries
+		p.waitHello = cfg.WaitForHello
+		p.helloTimeout = cfg.HelloTimeout
+		p.procName = cfg.ProcessName
+	}
+	if p.helloTimeout <= 0 {
+		p.helloTimeout = 10 * time.Second
+	}
+
 	if p.in, p.out, err = cfg.ioStreams(os.Args); err != nil {
 		return nil, fmt.Errorf("opening I/O streams: %w", err)
 	}
@@ -57,6 +98,16 @@ func New(cmd []*Command, version string, cfg *Config) (_ *Plugin, err error) {
 			return nil, fmt.Errorf("invalid command %q: %w", cmdName, err)
 		}
 		p.cmds[cmdName] = v
+
+		for _, name := range v.Signature.Aliases {
+			if _, ok := p.cmds[name]; ok || name == "" {
+				return nil, fmt.Errorf("invalid alias %q of the command %q: empty or already registered", name, cmdName)
+			}
+			alias := *v
+			alias.Signature.Name = name
+			alias.Signature.Aliases = nil
+			p.cmds[name] = &alias
+		}
 	}
 
 	if len(p.cmds) == 0 {
@@ -79,14 +130,30 @@ type Plugin struct {
 	outs  map[int]outputStream
 	inls  map[int]inputStream
 	engc  map[int]chan any // in-flight engine calls
-	idGen atomic.Uint32    // id generator
+	idGen atomic.Uint64    // id generator, use nextID to get new ID
 
 	in io.Reader
 	// output might be accessed by multiple goroutines so guard it with mutex
 	m   sync.Mutex
 	out io.Writer
 
-	log *slog.Logger
+	log        *slog.Logger
+	stats      *statsCollector // nil when stats collection is not enabled
+	onMsg      func(direction string, msg any)
+	maxMsgSize int64 // when > 0 max size of the incoming message
+	sortKeys   bool  // encode map keys in sorted order
+
+	validateInput bool // check input type before calling OnRun
+	retainRaw     bool // retain raw msgpack of the decoded Values
+
+	rejectDupFields   bool // respond with error to Call with duplicate Record fields
+	engineCallRetries int  // how many times to retry failed idempotent engine call
+
+	procName string // process name to set when Run is called, see Config.ProcessName
+
+	waitHello    bool
+	helloTimeout time.Duration
+	engineHello  atomic.Pointer[hello] // Hello message received from the engine
 }
 
 type inputStream interface {
@@ -110,9 +177,17 @@ type closeCtx interface {
 /*
 Run starts the plugin.
 It is blocking until Plugin exits (ie because plugin engine sent Goodbye
-message, the ctx was cancelled or unrecoverable error happened).
+message, the ctx was cancelled or unrecoverable error happened). Reading
+from the connection failing (ie the engine crashed) is unrecoverable error,
+Run returns it and the commands in flight are cancelled with it as cause.
 */
 func (p *Plugin) Run(ctx context.Context) error {
+	if p.procName != "" {
+		if err := setProcessName(p.procName); err != nil {
+			p.log.WarnContext(ctx, "setting process name", attrError(err))
+		}
+	}
+
 	// send encoding type and Hello
 	p.outputRaw(ctx, []byte(format_mpack))
 	h := hello{Protocol: protocol_name, Version: protocol_version, Features: features{LocalSocket: true}}
@@ -120,9 +195,6 @@ func (p *Plugin) Run(ctx context.Context) error {
 		return fmt.Errorf("sending Hello: %w", err)
 	}
 
-	// wait for server to send Hello? ie do not start
-	// main message loop before we have received Hello?
-
 	// launch a watchdog which closes the input stream when
 	// context is cancelled? As otherwise we could be stuck
 	// waiting for next message data...
@@ -136,11 +208,40 @@ func (p *Plugin) Run(ctx context.Context) error {
 }
 
 func (p *Plugin) mainMsgLoop(ctx context.Context) error {
-	dec := msgpack.NewDecoder(p.in)
+	conn := &inputReader{r: p.in}
+	var in io.Reader = conn
+	var limit *limitReader
+	if p.maxMsgSize > 0 {
+		limit = &limitReader{r: bufio.NewReader(conn), limit: p.maxMsgSize}
+		in = limit
+	}
+	br, ok := in.(byteReader)
+	if !ok {
+		br = bufio.NewReader(in)
+	}
+	opts := &decodeOpts{retainRaw: p.retainRaw}
+	dec := msgpack.NewDecoder(optsReader{br, opts})
 	dec.SetMapDecoder(decodeInputMsg)
 
+	if p.waitHello {
+		if limit != nil {
+			limit.reset()
+		}
+		if err := p.receiveHello(ctx, dec); err != nil {
+			return err
+		}
+	}
+
 	for ctx.Err() == nil {
+		if limit != nil {
+			limit.reset()
+		}
+		opts.duplicates = nil
 		v, err := dec.DecodeInterface()
+		if errors.Is(err, ErrMessageTooLarge) {
+			// can't skip the rest of the message and continue
+			return err
+		}
 		switch err {
 		case nil:
 		case io.EOF:
@@ -148,6 +249,11 @@ func (p *Plugin) mainMsgLoop(ctx context.Context) error {
 		case ErrInterrupt:
 			return ErrInterrupt
 		default:
+			if err := conn.Err(); err != nil {
+				// the engine has closed the connection (or crashed), there
+				// will be no more messages
+				return fmt.Errorf("reading input: %w", err)
+			}
 			p.log.ErrorContext(ctx, "decoding top-level message", attrError(err))
 			continue
 		}
@@ -156,6 +262,10 @@ func (p *Plugin) mainMsgLoop(ctx context.Context) error {
 			return ErrGoodbye
 		}
 
+		if len(opts.duplicates) > 0 && p.duplicateFields(ctx, v, opts.duplicates) {
+			continue
+		}
+
 		if err := p.handleMessage(ctx, v); err != nil {
 			p.log.ErrorContext(ctx, "handling message", attrError(err), attrMsg(v))
 		}
@@ -163,9 +273,84 @@ func (p *Plugin) mainMsgLoop(ctx context.Context) error {
 	return ctx.Err()
 }
 
+/*
+duplicateFields reports Records with duplicate field names in the message
+msg, see [Config.RejectDuplicateFields]. Returns true when the message has
+been handled (Call responded with error) and must not be processed further.
+*/
+func (p *Plugin) duplicateFields(ctx context.Context, msg any, names []string) bool {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = strconv.Quote(n)
+	}
+	err := fmt.Errorf("duplicate field names in Record: %s", strings.Join(quoted, ", "))
+	if !p.rejectDupFields {
+		p.log.WarnContext(ctx, "decoding message, the last value of the field is used", attrError(err), attrMsg(msg))
+		return false
+	}
+	if c, ok := msg.(call); ok {
+		if err := p.handleCallError(ctx, c.ID, err); err != nil {
+			p.log.ErrorContext(ctx, "handling message", attrError(err), attrMsg(msg))
+		}
+		return true
+	}
+	p.log.ErrorContext(ctx, "decoding message, the last value of the field is used", attrError(err), attrMsg(msg))
+	return false
+}
+
+/*
+receiveHello decodes the first message which must be engine's Hello. The
+decoder can't be interrupted so on timeout (or ctx cancellation) decoding
+goroutine is left running, it is expected that plugin exits.
+*/
+func (p *Plugin) receiveHello(ctx context.Context, dec *msgpack.Decoder) error {
+	type result struct {
+		msg any
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		v, err := dec.DecodeInterface()
+		ch <- result{msg: v, err: err}
+	}()
+
+	timer := time.NewTimer(p.helloTimeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return fmt.Errorf("decoding Hello: %w", r.err)
+		}
+		if _, ok := r.msg.(hello); !ok {
+			return fmt.Errorf("expected Hello as the first message, got %T", r.msg)
+		}
+		return p.handleMessage(ctx, r.msg)
+	case <-timer.C:
+		return fmt.Errorf("engine didn't send Hello within %s", p.helloTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+EngineVersion returns the protocol version the engine sent in it's Hello
+message, empty string is returned when Hello hasn't been received yet. See
+[Config.WaitForHello].
+*/
+func (p *Plugin) EngineVersion() string {
+	if h := p.engineHello.Load(); h != nil {
+		return h.Version
+	}
+	return ""
+}
+
 // handleMessage processes top level message
 func (p *Plugin) handleMessage(ctx context.Context, msg any) error {
 	p.log.DebugContext(ctx, "handleMessage", attrMsg(msg))
+	if p.onMsg != nil {
+		p.onMsg("in", msg)
+	}
 	switch m := msg.(type) {
 	case call:
 		if err := p.handleCall(ctx, m); err != nil {
@@ -186,6 +371,7 @@ func (p *Plugin) handleMessage(ctx context.Context, msg any) error {
 		p.log.InfoContext(ctx, "got Signal: "+m.Signal)
 		return nil
 	case hello:
+		p.engineHello.Store(&m)
 		return nil
 	default:
 		return fmt.Errorf("unknown top-level message %T", msg)
@@ -231,6 +417,7 @@ func (p *Plugin) handleRun(ctx context.Context, msg run, callID int) error {
 		Head:       msg.Call.Head,
 		Positional: msg.Call.Positional,
 		Named:      msg.Call.Named,
+		raw:        msg.RawInput,
 	}
 	ctx, exec.cancel = context.WithCancelCause(ctx)
 
@@ -239,10 +426,39 @@ func (p *Plugin) handleRun(ctx context.Context, msg run, callID int) error {
 		return err
 	}
 
+	cmd.Signature.deprecationWarnings(ctx, p.log, exec)
+
 	p.runs.registerInFlight(exec)
 	go func() {
 		defer p.runs.removeInFlight(exec)
-		if err := cmd.OnRun(ctx, exec); err != nil {
+		if p.stats != nil {
+			defer func(start time.Time) { p.stats.record(msg.Name, time.Since(start)) }(time.Now())
+		}
+		run := cmd.OnRun
+		if p.validateInput {
+			if err := cmd.Signature.checkInputType(exec); err != nil {
+				run = func(context.Context, *ExecCommand) error { return err }
+			}
+		}
+		if !cmd.Signature.HandleHelpManually {
+			if v, _ := exec.FlagValue("help"); v.Value == true {
+				run = returnHelp
+			}
+		}
+		runCtx := ctx
+		if cmd.Timeout > 0 {
+			var cancel context.CancelFunc
+			runCtx, cancel = context.WithTimeoutCause(ctx, cmd.Timeout, ErrCommandTimeout)
+			defer cancel()
+		}
+		if err := run(runCtx, exec); err != nil {
+			if context.Cause(runCtx) == ErrCommandTimeout {
+				err = &LabeledError{
+					Msg:    fmt.Sprintf("command %s timed out", msg.Name),
+					Labels: []ErrorLabel{{Text: fmt.Sprintf("didn't finish within %s", cmd.Timeout), Span: exec.Head}},
+					Inner:  []LabeledError{*AsLabeledError(err)},
+				}
+			}
 			if err := exec.returnError(ctx, err); err != nil {
 				p.log.ErrorContext(ctx, "sending error response", attrError(err), attrCallID(callID))
 			}
@@ -259,6 +475,18 @@ func (p *Plugin) handleRun(ctx context.Context, msg run, callID int) error {
 	return nil
 }
 
+/*
+returnHelp is used instead of OnRun handler when user invokes command with
+the "help" flag, it responds with the help text of the command.
+*/
+func returnHelp(ctx context.Context, exec *ExecCommand) error {
+	help, err := exec.GetHelp(ctx)
+	if err != nil {
+		return fmt.Errorf("getting help text: %w", err)
+	}
+	return exec.ReturnValue(ctx, Value{Value: help, Span: exec.Head})
+}
+
 /*
 given instance of internal type returns instance of type the plugin author uses to
 consume the input data.
@@ -327,10 +555,16 @@ func (p *Plugin) handleEnd(ctx context.Context, id int) error {
 	delete(p.inls, id)
 	p.iom.Unlock()
 	if !ok {
-		return fmt.Errorf("unknown input stream %d", id)
+		// the stream has already ended (duplicate End) or plugin has dropped
+		// it - in both cases protocol doesn't require Drop in reply.
+		p.log.DebugContext(ctx, "End for unknown input stream", attrStreamID(id))
+		return nil
 	}
+	// send Drop before signaling the end of data, otherwise command might
+	// finish and send it's response before the Drop
+	err := p.outputMsg(ctx, drop{ID: id})
 	in.endOfData()
-	return p.outputMsg(ctx, drop{ID: id})
+	return err
 }
 
 func (p *Plugin) handleDrop(_ context.Context, id int) error {
@@ -360,7 +594,7 @@ func (p *Plugin) registerOutputStream(ctx context.Context, stream outputStream)
 }
 
 func (p *Plugin) engineCall(ctx context.Context, callID int, query any) (<-chan any, error) {
-	ecID := int(p.idGen.Add(1))
+	ecID := p.nextID()
 	ch := make(chan any, 1)
 	p.iom.Lock()
 	p.engc[ecID] = ch
@@ -370,11 +604,24 @@ func (p *Plugin) engineCall(ctx context.Context, callID int, query any) (<-chan
 		Call *engineCall `msgpack:"EngineCall"`
 	}
 	if err := p.outputMsg(ctx, &eCall{&engineCall{Context: callID, ID: ecID, Call: query}}); err != nil {
+		p.iom.Lock()
+		delete(p.engc, ecID)
+		p.iom.Unlock()
 		return nil, fmt.Errorf("sending engine call: %w", err)
 	}
 	return ch, nil
 }
 
+/*
+nextID returns new unique ID for stream or engine call.
+
+The protocol uses platform sized unsigned integer for IDs so 64 bit counter is
+used to avoid collisions (on 64 bit platforms) even in long running plugins.
+*/
+func (p *Plugin) nextID() int {
+	return int(p.idGen.Add(1))
+}
+
 func (p *Plugin) handleEngineCallResponse(_ context.Context, ecr engineCallResponse) error {
 	p.iom.Lock()
 	c, ok := p.engc[ecr.ID]
@@ -409,11 +656,41 @@ func (p *Plugin) handleCallError(ctx context.Context, callID int, callErr error)
 Encode data as message pack and send it out.
 */
 func (p *Plugin) outputMsg(ctx context.Context, data any) error {
-	b, err := msgpack.Marshal(data)
-	if err != nil {
+	if p.onMsg != nil {
+		p.onMsg("out", data)
+	}
+
+	buf := outBufPool.Get().(*bytes.Buffer)
+	defer putOutBuf(buf)
+	buf.Reset()
+
+	enc := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(enc)
+	if p.sortKeys {
+		enc.Reset(sortedKeysBuffer{buf})
+		enc.SetSortMapKeys(true)
+	} else {
+		enc.Reset(buf)
+	}
+
+	if err := enc.Encode(data); err != nil {
 		return fmt.Errorf("serializing %T: %w", data, err)
 	}
-	return p.outputRaw(ctx, b)
+	return p.outputRaw(ctx, buf.Bytes())
+}
+
+// outBufPool holds buffers used by outputMsg to serialize messages,
+// outputRaw doesn't retain the data so buffer can be reused once it returns.
+var outBufPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// maxPooledBufSize is the capacity above which the buffer is not returned
+// into outBufPool so that single large message doesn't pin the memory.
+const maxPooledBufSize = 64 << 10
+
+func putOutBuf(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBufSize {
+		outBufPool.Put(buf)
+	}
 }
 
 func (p *Plugin) outputRaw(ctx context.Context, data []byte) error {
@@ -421,8 +698,31 @@ func (p *Plugin) outputRaw(ctx context.Context, data []byte) error {
 	defer p.m.Unlock()
 	p.log.DebugContext(ctx, "output", "msg", data)
 
-	if _, err := p.out.Write(data); err != nil {
+	if n, err := p.out.Write(data); err != nil {
+		if n == 0 {
+			err = notSentError{err}
+		}
 		return fmt.Errorf("writing to output: %w", err)
 	}
+	if f, ok := p.out.(flusher); ok {
+		if err := f.Flush(); err != nil {
+			return fmt.Errorf("flushing output: %w", err)
+		}
+	}
 	return nil
 }
+
+/*
+notSentError is returned by outputRaw when writing the message failed before
+any part of it was written, ie it is safe to send the message again (when the
+message was partially written resending it would corrupt the output stream).
+*/
+type notSentError struct{ error }
+
+func (e notSentError) Unwrap() error { return e.error }
+
+// flusher is implemented by buffered writers (ie bufio.Writer), when the
+// output implements it it is flushed after each message.
+type flusher interface {
+	Flush() error
+}
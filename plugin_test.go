@@ -6,6 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
+	"net"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -13,6 +18,7 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/vmihailenco/msgpack/v5"
 
+	"github.com/ainvaltin/nu-plugin/syntaxshape"
 	"github.com/ainvaltin/nu-plugin/types"
 )
 
@@ -174,6 +180,158 @@ func Test_Plugin_Signature(t *testing.T) {
 	t.Logf("plugin response:\n0x[%x] | from msgpack", rsp)
 }
 
+func Test_Plugin_aliases(t *testing.T) {
+	newCmd := func(aliases ...string) *Command {
+		return &Command{
+			Signature: PluginSignature{
+				Name:             "foo",
+				Aliases:          aliases,
+				Category:         "Experimental",
+				Desc:             "test cmd",
+				SearchTerms:      []string{"foo"},
+				InputOutputTypes: []InOutTypes{{types.Any(), types.Any()}},
+			},
+			OnRun: func(ctx context.Context, exec *ExecCommand) error {
+				return exec.ReturnValue(ctx, Value{Value: exec.Name})
+			},
+		}
+	}
+
+	p, err := New([]*Command{newCmd("bar", "baz")}, "", &Config{Logger: logger(t)})
+	if err != nil {
+		t.Fatalf("creating plugin: %v", err)
+	}
+	for _, name := range []string{"foo", "bar", "baz"} {
+		cmd, ok := p.cmds[name]
+		if !ok {
+			t.Fatalf("command %q not registered", name)
+		}
+		if cmd.Signature.Name != name {
+			t.Errorf("expected signature name %q, got %q", name, cmd.Signature.Name)
+		}
+	}
+
+	runEngine(t, p, append(protocolPrelude,
+		msgDef{send: &call{ID: 1, Call: run{Name: "bar"}}},
+		msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: Value{Value: "bar"}}}},
+	))
+
+	_, err = New([]*Command{newCmd("bar", "bar")}, "", &Config{Logger: logger(t)})
+	expectErrorMsg(t, err, `invalid alias "bar" of the command "foo": empty or already registered`)
+
+	_, err = New([]*Command{newCmd("")}, "", &Config{Logger: logger(t)})
+	expectErrorMsg(t, err, `invalid alias "" of the command "foo": empty or already registered`)
+}
+
+func Test_Plugin_deprecated(t *testing.T) {
+	logs := &bytes.Buffer{}
+	p, err := New(
+		[]*Command{
+			{
+				Signature: PluginSignature{
+					Name:             "old",
+					Deprecated:       "use 'new' instead",
+					Category:         "Experimental",
+					Desc:             "test cmd",
+					SearchTerms:      []string{"old"},
+					InputOutputTypes: []InOutTypes{{types.Any(), types.Any()}},
+					Named: Flags{
+						{Long: "keep", Desc: "not deprecated"},
+						{Long: "legacy", Desc: "deprecated", Deprecated: "legacy mode is the default now"},
+					},
+				},
+				OnRun: func(ctx context.Context, exec *ExecCommand) error { return nil },
+			},
+		},
+		"",
+		&Config{Logger: slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelWarn}))},
+	)
+	if err != nil {
+		t.Fatalf("creating plugin: %v", err)
+	}
+
+	runEngine(t, p, append(protocolPrelude,
+		msgDef{send: &call{ID: 1, Call: run{Name: "old", Call: evaluatedCall{Named: NamedParams{"keep": Value{}, "legacy": Value{}}}}}},
+		msgDef{recv: callResponse{ID: 1, Response: pipelineData{empty{}}}},
+	))
+
+	out := logs.String()
+	for _, s := range []string{
+		`msg="deprecated command used" command=old deprecation="use 'new' instead"`,
+		`msg="deprecated flag used" command=old flag=legacy deprecation="legacy mode is the default now"`,
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected log to contain\n%s\ngot\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, "flag=keep") {
+		t.Errorf("unexpected warning about not deprecated flag:\n%s", out)
+	}
+}
+
+func Test_Plugin_OnMessage(t *testing.T) {
+	type observed struct {
+		dir string
+		msg any
+	}
+	var mu sync.Mutex
+	var msgs []observed
+
+	p, err := New(
+		[]*Command{{
+			Signature: PluginSignature{
+				Name:             "inc",
+				Category:         "Experimental",
+				Desc:             "test cmd",
+				SearchTerms:      []string{"foo"},
+				InputOutputTypes: []InOutTypes{{types.Any(), types.Any()}},
+			},
+			OnRun: func(ctx context.Context, exec *ExecCommand) error {
+				return exec.ReturnValue(ctx, Value{Value: 42})
+			},
+		}},
+		"",
+		&Config{
+			Logger: logger(t),
+			OnMessage: func(direction string, msg any) {
+				mu.Lock()
+				defer mu.Unlock()
+				msgs = append(msgs, observed{dir: direction, msg: msg})
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("creating plugin: %v", err)
+	}
+
+	runEngine(t, p, append(protocolPrelude,
+		msgDef{send: &call{ID: 1, Call: run{Name: "inc"}}},
+		msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: Value{Value: int64(42)}}}},
+	))
+
+	mu.Lock()
+	defer mu.Unlock()
+	var gotCall, gotResponse bool
+	for _, m := range msgs {
+		switch msg := m.msg.(type) {
+		case call:
+			if r, ok := msg.Call.(run); ok && m.dir == "in" && msg.ID == 1 && r.Name == "inc" {
+				gotCall = true
+			}
+		case *callResponse:
+			if m.dir == "out" && msg.ID == 1 {
+				gotResponse = true
+			}
+		}
+	}
+	if !gotCall {
+		t.Errorf("incoming Run Call was not observed: %#v", msgs)
+	}
+	if !gotResponse {
+		t.Errorf("outgoing CallResponse was not observed: %#v", msgs)
+	}
+}
+
 func Test_Plugin_response(t *testing.T) {
 	signature := PluginSignature{
 		Name:             "inc",
@@ -206,6 +364,39 @@ func Test_Plugin_response(t *testing.T) {
 		))
 	})
 
+	t.Run("LabeledError response", func(t *testing.T) {
+		le := &LabeledError{Msg: "sorry", Labels: []ErrorLabel{{Text: "here", Span: Span{Start: 1, End: 2}}}}
+		testCases := []struct {
+			err    error
+			expect LabeledError
+		}{
+			{err: le, expect: *le},
+			{err: fmt.Errorf("wrapped: %w", le), expect: LabeledError{Msg: "wrapped: sorry", Labels: le.Labels}},
+		}
+		for _, tc := range testCases {
+			p, err := New(
+				[]*Command{
+					{
+						Signature: signature,
+						OnRun: func(ctx context.Context, exec *ExecCommand) error {
+							return tc.err
+						},
+					},
+				},
+				"",
+				&Config{Logger: logger(t)},
+			)
+			if err != nil {
+				t.Fatalf("creating plugin: %v", err)
+			}
+
+			runEngine(t, p, append(protocolPrelude,
+				msgDef{send: &call{ID: 1, Call: run{Name: "inc"}}},
+				msgDef{recv: callResponse{ID: 1, Response: tc.expect}},
+			))
+		}
+	})
+
 	t.Run("Single Value response", func(t *testing.T) {
 		p, err := New(
 			[]*Command{
@@ -297,6 +488,46 @@ func Test_Plugin_response(t *testing.T) {
 			msgDef{send: &drop{ID: 1}},
 		))
 	})
+
+	t.Run("stream with content type", func(t *testing.T) {
+		md := pipelineMetadata{DataSource: "None", ContentType: "application/json"}
+		newPlugin := func(t *testing.T, onRun func(context.Context, *ExecCommand) error) *Plugin {
+			p, err := New([]*Command{{Signature: signature, OnRun: onRun}}, "", &Config{Logger: logger(t)})
+			if err != nil {
+				t.Fatalf("creating plugin: %v", err)
+			}
+			return p
+		}
+
+		p := newPlugin(t, func(ctx context.Context, exec *ExecCommand) error {
+			out, err := exec.ReturnRawStream(ctx, StringStream(), ContentType("application/json"))
+			if err != nil {
+				return fmt.Errorf("getting output writer: %w", err)
+			}
+			return out.Close()
+		})
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "inc"}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{byteStream{ID: 1, Type: "String", MD: md}}}},
+			msgDef{recv: end{ID: 1}},
+			msgDef{send: &drop{ID: 1}},
+		))
+
+		p = newPlugin(t, func(ctx context.Context, exec *ExecCommand) error {
+			out, err := exec.ReturnListStream(ctx, ContentType("application/json"))
+			if err != nil {
+				return fmt.Errorf("getting the return list: %w", err)
+			}
+			close(out)
+			return nil
+		})
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "inc"}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: listStream{ID: 1, MD: md}}}},
+			msgDef{recv: end{ID: 1}},
+			msgDef{send: &drop{ID: 1}},
+		))
+	})
 }
 
 func Test_Plugin_input(t *testing.T) {
@@ -408,6 +639,110 @@ func Test_Plugin_input(t *testing.T) {
 	})
 }
 
+func Test_Plugin_handleEnd(t *testing.T) {
+	out := &bytes.Buffer{}
+	p := &Plugin{out: out, inls: map[int]inputStream{}, log: logger(t)}
+	ls := newInputStreamList(5)
+	ls.onAck = func(ctx context.Context, id int) {}
+	p.inls[ls.id] = ls
+	ls.Run(context.Background())
+
+	if err := p.handleEnd(context.Background(), 5); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Drop must be sent in reply to End
+	expect, err := msgpack.Marshal(drop{ID: 5})
+	if err != nil {
+		t.Fatalf("encoding Drop: %v", err)
+	}
+	if diff := cmp.Diff(expect, out.Bytes()); diff != "" {
+		t.Errorf("output mismatch (-want +got):\n%s", diff)
+	}
+
+	// duplicate End is tolerated and nothing is sent in reply
+	out.Reset()
+	if err := p.handleEnd(context.Background(), 5); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected no output, got %x", out.Bytes())
+	}
+}
+
+func Test_Plugin_nextID(t *testing.T) {
+	p := &Plugin{}
+	if id := p.nextID(); id != 1 {
+		t.Errorf("expected first ID to be 1, got %d", id)
+	}
+
+	// ID must not wrap around after 32 bit range has been exhausted
+	p.idGen.Store(math.MaxUint32 - 1)
+	if id := uint64(p.nextID()); id != math.MaxUint32 {
+		t.Errorf("expected ID %d, got %d", uint64(math.MaxUint32), id)
+	}
+	if id := uint64(p.nextID()); id != math.MaxUint32+1 {
+		t.Errorf("expected ID %d, got %d", uint64(math.MaxUint32+1), id)
+	}
+}
+
+func Test_Plugin_outputFlush(t *testing.T) {
+	out := &flushWriter{}
+	p := &Plugin{out: out, log: logger(t)}
+
+	if err := p.outputMsg(context.Background(), ack{ID: 1}); err != nil {
+		t.Fatalf("sending first message: %v", err)
+	}
+	if out.flushed != 1 {
+		t.Errorf("expected output to be flushed once, got %d", out.flushed)
+	}
+
+	if err := p.outputMsg(context.Background(), drop{ID: 1}); err != nil {
+		t.Fatalf("sending second message: %v", err)
+	}
+	if out.flushed != 2 {
+		t.Errorf("expected output to be flushed twice, got %d", out.flushed)
+	}
+
+	out.err = fmt.Errorf("nope")
+	err := p.outputMsg(context.Background(), end{ID: 1})
+	expectErrorMsg(t, err, `flushing output: nope`)
+}
+
+func Test_putOutBuf(t *testing.T) {
+	large := bytes.NewBuffer(make([]byte, 0, maxPooledBufSize+1))
+	putOutBuf(large)
+	for range 10 {
+		if buf := outBufPool.Get().(*bytes.Buffer); buf == large {
+			t.Fatal("large buffer was returned into the pool")
+		}
+	}
+}
+
+func Benchmark_outputMsg(b *testing.B) {
+	p := &Plugin{out: io.Discard, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	ctx := context.Background()
+	msg := &callResponse{ID: 1, Response: &pipelineData{Data: Value{Value: "foo bar"}}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := p.outputMsg(ctx, msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type flushWriter struct {
+	bytes.Buffer
+	flushed int
+	err     error
+}
+
+func (fw *flushWriter) Flush() error {
+	fw.flushed++
+	return fw.err
+}
+
 func runEngine(t *testing.T, p *Plugin, msg []msgDef) {
 	t.Helper()
 
@@ -459,7 +794,11 @@ func runEngine(t *testing.T, p *Plugin, msg []msgDef) {
 		dec.SetMapDecoder(decodeNuMsgAll(handleMsgDecode))
 
 		for k, v := range msg {
-			if v.recv != nil {
+			if u, ok := v.recv.(unordered); ok {
+				if err := recvUnordered(dec, u); err != nil {
+					errch <- fmt.Errorf("[%d] %w", k, err)
+				}
+			} else if v.recv != nil {
 				inmsg, err := dec.DecodeInterface()
 				if err != nil {
 					errch <- fmt.Errorf("decoding msg [%d]: %w", k, err)
@@ -505,6 +844,29 @@ type msgDef struct {
 	recv any // plugin sends message to engine
 }
 
+/*
+unordered can be used as msgDef.recv when the plugin sends multiple messages
+whose order is not deterministic - each message must be received exactly once
+but in any order.
+*/
+type unordered []any
+
+func recvUnordered(dec *msgpack.Decoder, want unordered) error {
+	want = slices.Clone(want)
+	for len(want) > 0 {
+		inmsg, err := dec.DecodeInterface()
+		if err != nil {
+			return fmt.Errorf("decoding msg: %w", err)
+		}
+		idx := slices.IndexFunc(want, func(m any) bool { return cmp.Equal(m, inmsg) })
+		if idx < 0 {
+			return fmt.Errorf("unexpected message %#v, expected one of %#v", inmsg, want)
+		}
+		want = slices.Delete(want, idx, idx+1)
+	}
+	return nil
+}
+
 /*
 msgBytes returns the message described by the def as bytes.
 */
@@ -539,3 +901,673 @@ var protocolPrelude = []msgDef{
 	{recv: hello{Protocol: protocol_name, Version: protocol_version, Features: features{LocalSocket: true}}},
 	{send: &hello{Protocol: "nu-plugin", Version: "0.92.2"}},
 }
+
+func Test_Plugin_MaxMessageBytes(t *testing.T) {
+	createPlugin := func(t *testing.T, limit int64) *Plugin {
+		p, err := New(
+			[]*Command{{
+				Signature: PluginSignature{
+					Name:             "foo",
+					Category:         "Experimental",
+					Desc:             "test cmd",
+					SearchTerms:      []string{"foo"},
+					InputOutputTypes: []InOutTypes{{types.Any(), types.Any()}},
+				},
+				OnRun: func(ctx context.Context, exec *ExecCommand) error { return nil },
+			}},
+			"",
+			&Config{Logger: logger(t), MaxMessageBytes: limit},
+		)
+		if err != nil {
+			t.Fatalf("creating plugin: %v", err)
+		}
+		p.out = io.Discard
+		return p
+	}
+
+	encode := func(t *testing.T, msgs ...any) io.Reader {
+		buf := &bytes.Buffer{}
+		enc := msgpack.NewEncoder(buf)
+		for _, m := range msgs {
+			if err := enc.Encode(m); err != nil {
+				t.Fatalf("encoding %T: %v", m, err)
+			}
+		}
+		return buf
+	}
+
+	t.Run("messages within the limit", func(t *testing.T) {
+		// together the messages are bigger than the limit
+		p := createPlugin(t, 32)
+		p.in = encode(t, signal{Signal: "Reset"}, signal{Signal: "Reset"}, signal{Signal: "Reset"}, "Goodbye")
+		if err := p.Run(context.Background()); !errors.Is(err, ErrGoodbye) {
+			t.Errorf("expected Goodbye, got: %v", err)
+		}
+	})
+
+	t.Run("message exceeds the limit", func(t *testing.T) {
+		p := createPlugin(t, 1024)
+		msg := &call{ID: 1, Call: run{Name: "foo", Input: Value{Value: strings.Repeat("x", 2000)}}}
+		p.in = encode(t, msg, "Goodbye")
+		err := p.Run(context.Background())
+		if !errors.Is(err, ErrMessageTooLarge) {
+			t.Fatalf("expected ErrMessageTooLarge, got: %v", err)
+		}
+		if !strings.HasSuffix(err.Error(), `message is bigger than 1024 bytes: message size limit exceeded`) {
+			t.Errorf("unexpected error message: %v", err)
+		}
+	})
+}
+
+func Test_Plugin_SortMapKeys(t *testing.T) {
+	rec := Record{}
+	named := NamedParams{}
+	for i := range 20 {
+		rec[fmt.Sprintf("field%02d", i)] = Value{Value: i}
+		named[fmt.Sprintf("flag%02d", i)] = Value{Value: i}
+	}
+
+	encode := func(t *testing.T, data any) []byte {
+		out := &bytes.Buffer{}
+		p := &Plugin{out: out, log: logger(t), sortKeys: true}
+		if err := p.outputMsg(context.Background(), data); err != nil {
+			t.Fatalf("encoding message: %v", err)
+		}
+		return out.Bytes()
+	}
+
+	t.Run("Record", func(t *testing.T) {
+		msg := &callResponse{ID: 1, Response: &pipelineData{Data: &pipelineValue{V: Value{Value: rec}}}}
+		first := encode(t, msg)
+		for range 10 {
+			if b := encode(t, msg); !bytes.Equal(first, b) {
+				t.Fatalf("encoding is not stable:\n%x\n%x", first, b)
+			}
+		}
+		// keys must be in sorted order
+		prev := -1
+		for i := range 20 {
+			idx := bytes.Index(first, []byte(fmt.Sprintf("field%02d", i)))
+			if idx <= prev {
+				t.Fatalf("field%02d is not in sorted order", i)
+			}
+			prev = idx
+		}
+	})
+
+	t.Run("NamedParams", func(t *testing.T) {
+		first := encode(t, &named)
+		for range 10 {
+			if b := encode(t, &named); !bytes.Equal(first, b) {
+				t.Fatalf("encoding is not stable:\n%x\n%x", first, b)
+			}
+		}
+	})
+}
+
+func Test_Plugin_concurrent_streams(t *testing.T) {
+	// command reads input stream and writes output stream concurrently while
+	// engine sends input without waiting for Ack-s (up to it's own window).
+	// Main loop must not block on the input stream as it also has to deliver
+	// the Ack-s of the output stream.
+	const itemCount = 200
+	p, err := New(
+		[]*Command{{
+			Signature: PluginSignature{
+				Name:             "echo",
+				Category:         "Experimental",
+				Desc:             "test cmd",
+				SearchTerms:      []string{"echo"},
+				InputOutputTypes: []InOutTypes{{types.Any(), types.Any()}},
+			},
+			OnRun: func(ctx context.Context, exec *ExecCommand) error {
+				out, err := exec.ReturnListStream(ctx)
+				if err != nil {
+					return err
+				}
+				defer close(out)
+				for v, err := range exec.InputAsSeq(ctx) {
+					if err != nil {
+						return err
+					}
+					select {
+					case out <- v:
+					case <-ctx.Done():
+						return context.Cause(ctx)
+					}
+				}
+				return nil
+			},
+		}},
+		"",
+		&Config{Logger: logger(t)},
+	)
+	if err != nil {
+		t.Fatalf("creating plugin: %v", err)
+	}
+
+	engineIn, pluginOut := io.Pipe()
+	pluginIn, engineOut := io.Pipe()
+	p.in, p.out = pluginIn, pluginOut
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		pluginIn.Close()
+		engineIn.Close()
+	}()
+
+	runDone := make(chan error, 1)
+	go func() { runDone <- p.Run(ctx) }()
+
+	var m sync.Mutex
+	send := func(msg any) {
+		m.Lock()
+		defer m.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		if err := msgpack.NewEncoder(engineOut).Encode(msg); err != nil {
+			t.Errorf("sending %T: %v", msg, err)
+		}
+	}
+
+	// engine's reader: Ack the output stream Data and collect the Values
+	var got []Value
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		dec := msgpack.NewDecoder(engineIn)
+		dec.SetMapDecoder(decodeNuMsgAll(handleMsgDecode))
+		for {
+			msg, err := dec.DecodeInterface()
+			if err != nil {
+				t.Errorf("decoding plugin message: %v", err)
+				return
+			}
+			switch m := msg.(type) {
+			case data:
+				got = append(got, m.Data.(Value))
+				go send(&ack{ID: m.ID})
+			case end:
+				send(&drop{ID: m.ID})
+				return
+			}
+		}
+	}()
+
+	send(&hello{Protocol: "nu-plugin", Version: "0.101.0"})
+	send(&call{ID: 1, Call: run{Name: "echo", Input: listStream{ID: 100}}})
+	for i := range itemCount {
+		send(&data{ID: 100, Data: Value{Value: i}})
+	}
+	send(&end{ID: 100})
+
+	select {
+	case <-outputDone:
+	case <-ctx.Done():
+		t.Fatal("deadlock: output stream hasn't ended")
+	}
+	if len(got) != itemCount {
+		t.Errorf("expected %d values, got %d", itemCount, len(got))
+	}
+	for i, v := range got {
+		if v.Value != int64(i) {
+			t.Errorf("item [%d]: expected %d, got %v", i, i, v.Value)
+			break
+		}
+	}
+	send("Goodbye")
+	select {
+	case <-runDone:
+	case <-ctx.Done():
+		t.Error("plugin hasn't exited")
+	}
+}
+
+func Test_Plugin_help_flag(t *testing.T) {
+	createPlugin := func(t *testing.T, manual bool) (*Plugin, chan any, *bool) {
+		onRunCalled := false
+		p, err := New(
+			[]*Command{{
+				Signature: PluginSignature{
+					Name:               "foo",
+					Category:           "Experimental",
+					Desc:               "test cmd",
+					SearchTerms:        []string{"foo"},
+					InputOutputTypes:   []InOutTypes{{types.Nothing(), types.String()}},
+					HandleHelpManually: manual,
+				},
+				OnRun: func(ctx context.Context, exec *ExecCommand) error {
+					onRunCalled = true
+					return exec.ReturnValue(ctx, Value{Value: "OnRun"})
+				},
+			}},
+			"0.0.1",
+			&Config{Logger: logger(t)},
+		)
+		if err != nil {
+			t.Fatal("creating plugin:", err)
+		}
+
+		responses := make(chan any, 1)
+		p.out = writerFunc(func(b []byte) (int, error) {
+			var msg struct {
+				EngineCall *struct {
+					ID   int    `msgpack:"id"`
+					Call string `msgpack:"call"`
+				}
+			}
+			if err := msgpack.Unmarshal(b, &msg); err == nil && msg.EngineCall != nil {
+				if msg.EngineCall.Call != "GetHelp" {
+					return 0, fmt.Errorf("unexpected engine call %q", msg.EngineCall.Call)
+				}
+				ecr := engineCallResponse{ID: msg.EngineCall.ID, Response: pipelineData{Data: Value{Value: "help text"}}}
+				return len(b), p.handleEngineCallResponse(context.Background(), ecr)
+			}
+
+			dec := msgpack.NewDecoder(bytes.NewReader(b))
+			dec.SetMapDecoder(decodeNuMsgAll(handleMsgDecode))
+			v, err := dec.DecodeInterface()
+			if err != nil {
+				return 0, err
+			}
+			responses <- v
+			return len(b), nil
+		})
+		return p, responses, &onRunCalled
+	}
+
+	runWithHelp := func(t *testing.T, p *Plugin, responses <-chan any) any {
+		msg := run{Name: "foo", Call: evaluatedCall{Named: NamedParams{"help": Value{}}}}
+		if err := p.handleRun(context.Background(), msg, 1); err != nil {
+			t.Fatalf("handleRun: %v", err)
+		}
+		select {
+		case v := <-responses:
+			return v
+		case <-time.After(time.Second):
+			t.Fatal("didn't receive response in time")
+		}
+		return nil
+	}
+
+	t.Run("automatic", func(t *testing.T) {
+		p, responses, onRunCalled := createPlugin(t, false)
+		resp := runWithHelp(t, p, responses)
+		if diff := cmp.Diff(callResponse{ID: 1, Response: pipelineData{Data: Value{Value: "help text"}}}, resp); diff != "" {
+			t.Errorf("response mismatch (-want +got):\n%s", diff)
+		}
+		if *onRunCalled {
+			t.Error("OnRun handler was called")
+		}
+	})
+
+	t.Run("manual", func(t *testing.T) {
+		p, responses, onRunCalled := createPlugin(t, true)
+		resp := runWithHelp(t, p, responses)
+		if diff := cmp.Diff(callResponse{ID: 1, Response: pipelineData{Data: Value{Value: "OnRun"}}}, resp); diff != "" {
+			t.Errorf("response mismatch (-want +got):\n%s", diff)
+		}
+		if !*onRunCalled {
+			t.Error("OnRun handler was not called")
+		}
+	})
+}
+
+func Test_Plugin_WaitForHello(t *testing.T) {
+	createPlugin := func(t *testing.T, onRun func(context.Context, *ExecCommand) error) *Plugin {
+		p, err := New(
+			[]*Command{{
+				Signature: PluginSignature{
+					Name:             "foo",
+					Category:         "Experimental",
+					Desc:             "test cmd",
+					SearchTerms:      []string{"foo"},
+					InputOutputTypes: []InOutTypes{{types.Any(), types.Any()}},
+				},
+				OnRun: onRun,
+			}},
+			"",
+			&Config{Logger: logger(t), WaitForHello: true, HelloTimeout: 50 * time.Millisecond},
+		)
+		if err != nil {
+			t.Fatalf("creating plugin: %v", err)
+		}
+		return p
+	}
+
+	t.Run("Hello is stored", func(t *testing.T) {
+		var p *Plugin
+		p = createPlugin(t, func(ctx context.Context, exec *ExecCommand) error {
+			return exec.ReturnValue(ctx, Value{Value: p.EngineVersion()})
+		})
+		if v := p.EngineVersion(); v != "" {
+			t.Errorf("expected empty version before Hello, got %q", v)
+		}
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "foo"}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: Value{Value: "0.92.2"}}}},
+		))
+	})
+
+	noRun := func(ctx context.Context, exec *ExecCommand) error {
+		t.Error("unexpected OnRun call")
+		return nil
+	}
+
+	t.Run("first message is not Hello", func(t *testing.T) {
+		p := createPlugin(t, noRun)
+		p.out = io.Discard
+		buf := &bytes.Buffer{}
+		if err := msgpack.NewEncoder(buf).Encode(&call{ID: 1, Call: run{Name: "foo"}}); err != nil {
+			t.Fatalf("encoding call: %v", err)
+		}
+		p.in = buf
+		err := p.Run(context.Background())
+		expectErrorMsg(t, err, `expected Hello as the first message, got nu.call`)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		p := createPlugin(t, noRun)
+		p.out = io.Discard
+		in, w := io.Pipe()
+		defer w.Close()
+		p.in = in
+		err := p.Run(context.Background())
+		expectErrorMsg(t, err, `engine didn't send Hello within 50ms`)
+	})
+}
+
+func Test_Plugin_ValidateInput(t *testing.T) {
+	createPlugin := func(t *testing.T, validate bool) *Plugin {
+		p, err := New(
+			[]*Command{{
+				Signature: PluginSignature{
+					Name:             "foo",
+					Category:         "Experimental",
+					Desc:             "test cmd",
+					SearchTerms:      []string{"foo"},
+					InputOutputTypes: []InOutTypes{{types.Int(), types.String()}, {types.List(types.Int()), types.String()}},
+				},
+				OnRun: func(ctx context.Context, exec *ExecCommand) error {
+					return exec.ReturnValue(ctx, Value{Value: "OnRun"})
+				},
+			}},
+			"0.0.1",
+			&Config{Logger: logger(t), ValidateInput: validate},
+		)
+		if err != nil {
+			t.Fatal("creating plugin:", err)
+		}
+		return p
+	}
+
+	t.Run("valid input", func(t *testing.T) {
+		runEngine(t, createPlugin(t, true), append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "foo", Input: Value{Value: int64(5)}}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: Value{Value: "OnRun"}}}},
+		))
+	})
+
+	t.Run("invalid input", func(t *testing.T) {
+		span := Span{Start: 5, End: 10}
+		expect := LabeledError{
+			Msg:    "input type not supported by the command foo",
+			Labels: []ErrorLabel{{Text: "got string input, expected one of: int, list<int>", Span: span}},
+		}
+		runEngine(t, createPlugin(t, true), append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "foo", Input: Value{Value: "five", Span: span}}}},
+			msgDef{recv: callResponse{ID: 1, Response: expect}},
+		))
+	})
+
+	t.Run("validation disabled", func(t *testing.T) {
+		runEngine(t, createPlugin(t, false), append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "foo", Input: Value{Value: "five"}}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: Value{Value: "OnRun"}}}},
+		))
+	})
+}
+
+func Test_Plugin_command_Timeout(t *testing.T) {
+	newCmd := func(name string, timeout time.Duration, onRun func(context.Context, *ExecCommand) error) *Command {
+		return &Command{
+			Signature: PluginSignature{
+				Name:             name,
+				Category:         "Experimental",
+				Desc:             "test cmd",
+				SearchTerms:      []string{name},
+				InputOutputTypes: []InOutTypes{{types.Nothing(), types.String()}},
+			},
+			Timeout: timeout,
+			OnRun:   onRun,
+		}
+	}
+	p, err := New(
+		[]*Command{
+			newCmd("slow", 50*time.Millisecond, func(ctx context.Context, exec *ExecCommand) error {
+				<-ctx.Done()
+				return context.Cause(ctx)
+			}),
+			newCmd("fast", time.Second, func(ctx context.Context, exec *ExecCommand) error {
+				return exec.ReturnValue(ctx, Value{Value: "fast"})
+			}),
+		},
+		"0.0.1",
+		&Config{Logger: logger(t)},
+	)
+	if err != nil {
+		t.Fatal("creating plugin:", err)
+	}
+
+	head := Span{Start: 1, End: 5}
+	expect := LabeledError{
+		Msg:    "command slow timed out",
+		Labels: []ErrorLabel{{Text: "didn't finish within 50ms", Span: head}},
+		Inner:  []LabeledError{{Msg: ErrCommandTimeout.Error()}},
+	}
+	// the fast command responds while the slow one is still running
+	runEngine(t, p, append(protocolPrelude,
+		msgDef{send: &call{ID: 1, Call: run{Name: "slow", Call: evaluatedCall{Head: head}}}},
+		msgDef{send: &call{ID: 2, Call: run{Name: "fast"}}},
+		msgDef{recv: callResponse{ID: 2, Response: pipelineData{Data: Value{Value: "fast"}}}},
+		msgDef{recv: callResponse{ID: 1, Response: expect}},
+	))
+}
+
+func Test_Plugin_RetainRawValues(t *testing.T) {
+	input := Value{Value: []Value{{Value: int64(1)}, {Value: "two", Span: Span{Start: 3, End: 6}}}, Span: Span{Start: 1, End: 8}}
+	expectRaw, err := msgpack.Marshal(&input)
+	if err != nil {
+		t.Fatalf("encoding input: %v", err)
+	}
+
+	createPlugin := func(t *testing.T, retain bool, onRun func(exec *ExecCommand)) *Plugin {
+		p, err := New(
+			[]*Command{{
+				Signature: PluginSignature{
+					Name:             "foo",
+					Category:         "Experimental",
+					Desc:             "test cmd",
+					SearchTerms:      []string{"foo"},
+					InputOutputTypes: []InOutTypes{{types.Any(), types.Any()}},
+				},
+				OnRun: func(ctx context.Context, exec *ExecCommand) error {
+					onRun(exec)
+					return nil
+				},
+			}},
+			"0.0.1",
+			&Config{Logger: logger(t), RetainRawValues: retain},
+		)
+		if err != nil {
+			t.Fatal("creating plugin:", err)
+		}
+		return p
+	}
+	msg := &call{ID: 1, Call: run{Name: "foo", Input: input}}
+
+	t.Run("enabled", func(t *testing.T) {
+		p := createPlugin(t, true, func(exec *ExecCommand) {
+			if diff := cmp.Diff(input, exec.Input); diff != "" {
+				t.Errorf("decoded input mismatch (-want +got):\n%s", diff)
+			}
+			if !bytes.Equal(exec.RawInput(), expectRaw) {
+				t.Errorf("raw input mismatch:\nwant %x\ngot  %x", expectRaw, exec.RawInput())
+			}
+
+			// raw can be written into encoder as is and decoded back
+			buf := bytes.NewBuffer(nil)
+			if err := msgpack.NewEncoder(buf).Encode(exec.RawInput()); err != nil {
+				t.Errorf("encoding raw: %v", err)
+			}
+			var v Value
+			if err := msgpack.Unmarshal(buf.Bytes(), &v); err != nil {
+				t.Errorf("decoding raw: %v", err)
+			}
+			if diff := cmp.Diff(input, v); diff != "" {
+				t.Errorf("decoded raw mismatch (-want +got):\n%s", diff)
+			}
+		})
+		runEngine(t, p, append(protocolPrelude, msgDef{send: msg}, msgDef{recv: callResponse{ID: 1, Response: pipelineData{empty{}}}}))
+	})
+
+	t.Run("stream input", func(t *testing.T) {
+		p := createPlugin(t, true, func(exec *ExecCommand) {
+			if exec.RawInput() != nil {
+				t.Errorf("raw assigned for stream input: %x", exec.RawInput())
+			}
+		})
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "foo", Input: listStream{ID: 7}}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{empty{}}}},
+		))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		p := createPlugin(t, false, func(exec *ExecCommand) {
+			if exec.RawInput() != nil {
+				t.Errorf("raw assigned when not enabled: %x", exec.RawInput())
+			}
+		})
+		runEngine(t, p, append(protocolPrelude, msgDef{send: msg}, msgDef{recv: callResponse{ID: 1, Response: pipelineData{empty{}}}}))
+	})
+}
+
+func Test_Plugin_RejectDuplicateFields(t *testing.T) {
+	createPlugin := func(t *testing.T, reject bool) *Plugin {
+		p, err := New(
+			[]*Command{{
+				Signature: PluginSignature{
+					Name:               "foo",
+					Category:           "Experimental",
+					Desc:               "test cmd",
+					SearchTerms:        []string{"foo"},
+					InputOutputTypes:   []InOutTypes{{types.Nothing(), types.Any()}},
+					RequiredPositional: PositionalArgs{{Name: "arg", Shape: syntaxshape.Any()}},
+				},
+				OnRun: func(ctx context.Context, exec *ExecCommand) error {
+					return exec.ReturnValue(ctx, exec.Positional[0])
+				},
+			}},
+			"0.0.1",
+			&Config{Logger: logger(t), RejectDuplicateFields: reject},
+		)
+		if err != nil {
+			t.Fatal("creating plugin:", err)
+		}
+		return p
+	}
+
+	// Run call with Record argument which has field "dupX" twice
+	buf := bytes.NewBuffer(nil)
+	enc := msgpack.NewEncoder(sortedKeysBuffer{buf})
+	enc.SetSortMapKeys(true)
+	arg := Value{Value: Record{"dupX": {Value: int64(1)}, "dupY": {Value: int64(2)}}}
+	if err := enc.Encode(&call{ID: 1, Call: run{Name: "foo", Call: evaluatedCall{Positional: []Value{arg}}}}); err != nil {
+		t.Fatalf("encoding call: %v", err)
+	}
+	dupCall := msgpack.RawMessage(bytes.Replace(buf.Bytes(), []byte("dupY"), []byte("dupX"), 1))
+	// the next call must be processed as usual, ie the stream is in sync
+	nextCall := &call{ID: 2, Call: run{Name: "foo", Call: evaluatedCall{Positional: []Value{{Value: "next"}}}}}
+
+	t.Run("last value is used", func(t *testing.T) {
+		runEngine(t, createPlugin(t, false), append(protocolPrelude,
+			msgDef{send: dupCall},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: Value{Value: Record{"dupX": {Value: int64(2)}}}}}},
+			msgDef{send: nextCall},
+			msgDef{recv: callResponse{ID: 2, Response: pipelineData{Data: Value{Value: "next"}}}},
+		))
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		runEngine(t, createPlugin(t, true), append(protocolPrelude,
+			msgDef{send: dupCall},
+			msgDef{recv: callResponse{ID: 1, Response: LabeledError{Msg: `duplicate field names in Record: "dupX"`}}},
+			msgDef{send: nextCall},
+			msgDef{recv: callResponse{ID: 2, Response: pipelineData{Data: Value{Value: "next"}}}},
+		))
+	})
+}
+
+func Test_Plugin_connection_closed(t *testing.T) {
+	started := make(chan struct{})
+	cause := make(chan error, 1)
+	p, err := New(
+		[]*Command{{
+			Signature: PluginSignature{
+				Name:             "foo",
+				Category:         "Experimental",
+				Desc:             "test cmd",
+				SearchTerms:      []string{"foo"},
+				InputOutputTypes: []InOutTypes{{types.Any(), types.Any()}},
+			},
+			OnRun: func(ctx context.Context, exec *ExecCommand) error {
+				close(started)
+				<-ctx.Done()
+				cause <- context.Cause(ctx)
+				return nil
+			},
+		}},
+		"",
+		&Config{Logger: logger(t)},
+	)
+	if err != nil {
+		t.Fatalf("creating plugin: %v", err)
+	}
+
+	conn, engine := net.Pipe()
+	defer engine.Close()
+	p.in = conn
+	p.out = io.Discard
+
+	done := make(chan error, 1)
+	go func() { done <- p.Run(context.Background()) }()
+
+	if err := msgpack.NewEncoder(engine).Encode(&call{ID: 1, Call: run{Name: "foo"}}); err != nil {
+		t.Fatalf("sending call: %v", err)
+	}
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("command didn't start")
+	}
+
+	// connection breaks while command is running
+	conn.Close()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, io.ErrClosedPipe) {
+			t.Errorf("expected Run to return io.ErrClosedPipe, got %v", err)
+		}
+		expectErrorMsg(t, err, `reading input: io: read/write on closed pipe`)
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't exit after connection was closed")
+	}
+	if err := <-cause; !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("expected command to be cancelled with io.ErrClosedPipe, got %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+package nu
+
+import (
+	"fmt"
+	"os"
+	"unicode/utf8"
+)
+
+/*
+setProcessName sets the name of the process as shown by ps and top. Writing
+to /proc/self/comm renames the main thread, kernel limits the name to 15
+bytes so longer names are truncated (at rune boundary).
+*/
+func setProcessName(name string) error {
+	if len(name) > 15 {
+		n := 15
+		for n > 0 && !utf8.RuneStart(name[n]) {
+			n--
+		}
+		name = name[:n]
+	}
+	if err := os.WriteFile("/proc/self/comm", []byte(name), 0); err != nil {
+		return fmt.Errorf("setting process name: %w", err)
+	}
+	return nil
+}
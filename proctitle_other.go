@@ -0,0 +1,7 @@
+//go:build !linux
+
+package nu
+
+// setProcessName is no-op on platforms where setting the process name is
+// not supported.
+func setProcessName(name string) error { return nil }
@@ -0,0 +1,91 @@
+package nu
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/ainvaltin/nu-plugin/types"
+)
+
+func Test_setProcessName(t *testing.T) {
+	orig, _ := os.ReadFile("/proc/self/comm")
+	if len(orig) != 0 {
+		t.Cleanup(func() { setProcessName(string(bytes.TrimSpace(orig))) })
+	}
+
+	// on platforms where it is not supported setProcessName must be no-op
+	if err := setProcessName("nu_plugin_test_long_name"); err != nil {
+		t.Fatalf("setProcessName: %v", err)
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	comm, err := os.ReadFile("/proc/self/comm")
+	if err != nil {
+		t.Fatalf("reading process name: %v", err)
+	}
+	if s := string(bytes.TrimSpace(comm)); s != "nu_plugin_test_" {
+		t.Errorf("expected name to be truncated to %q, got %q", "nu_plugin_test_", s)
+	}
+
+	// 15th byte is in the middle of the multibyte rune
+	if err := setProcessName("nu_plugin_testää"); err != nil {
+		t.Fatalf("setProcessName: %v", err)
+	}
+	if comm, err = os.ReadFile("/proc/self/comm"); err != nil {
+		t.Fatalf("reading process name: %v", err)
+	}
+	if s := string(bytes.TrimSpace(comm)); s != "nu_plugin_test" {
+		t.Errorf("expected name to be truncated to %q, got %q", "nu_plugin_test", s)
+	}
+}
+
+func Test_New_ProcessName(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("setting process name is supported only on Linux")
+	}
+	orig, err := os.ReadFile("/proc/self/comm")
+	if err != nil {
+		t.Fatalf("reading process name: %v", err)
+	}
+	t.Cleanup(func() { setProcessName(string(bytes.TrimSpace(orig))) })
+
+	// New must not rename the process, it's done by Run
+	cmd := &Command{Signature: PluginSignature{Name: "foo"}}
+	if _, err := New([]*Command{cmd, cmd}, "0.0.1", &Config{Logger: logger(t), ProcessName: "nu_plugin_new"}); err == nil {
+		t.Fatal("expected error creating plugin with duplicate command")
+	}
+	comm, err := os.ReadFile("/proc/self/comm")
+	if err != nil {
+		t.Fatalf("reading process name: %v", err)
+	}
+	if !bytes.Equal(comm, orig) {
+		t.Errorf("process was renamed to %q", bytes.TrimSpace(comm))
+	}
+
+	cmd = &Command{
+		Signature: PluginSignature{
+			Name:             "foo",
+			Category:         "Experimental",
+			Desc:             "test cmd",
+			SearchTerms:      []string{"foo"},
+			InputOutputTypes: []InOutTypes{{types.Any(), types.Any()}},
+		},
+		OnRun: func(ctx context.Context, exec *ExecCommand) error { return nil },
+	}
+	p, err := New([]*Command{cmd}, "0.0.1", &Config{Logger: logger(t), ProcessName: "nu_plugin_run"})
+	if err != nil {
+		t.Fatalf("creating plugin: %v", err)
+	}
+	runEngine(t, p, protocolPrelude)
+	if comm, err = os.ReadFile("/proc/self/comm"); err != nil {
+		t.Fatalf("reading process name: %v", err)
+	}
+	if s := string(bytes.TrimSpace(comm)); s != "nu_plugin_run" {
+		t.Errorf("expected Run to set process name %q, got %q", "nu_plugin_run", s)
+	}
+}
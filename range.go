@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"iter"
 	"math"
+	"strconv"
+	"strings"
 
 	"github.com/vmihailenco/msgpack/v5"
 	"github.com/vmihailenco/msgpack/v5/msgpcode"
@@ -31,6 +33,24 @@ func (rb RangeBound) String() string {
 	}
 }
 
+/*
+Range is implemented by the variants of the [Nushell Range] type, ie
+[IntRange] and [FloatRange].
+
+[Nushell Range]: https://www.nushell.sh/contributor-book/plugin_protocol_reference.html#range
+*/
+type Range interface {
+	// Values generates all the values in the range as Int or Float Values.
+	Values() iter.Seq[Value]
+	// Validate checks that the range definition is valid.
+	Validate() error
+}
+
+var (
+	_ Range = IntRange{}
+	_ Range = FloatRange{}
+)
+
 /*
 IntRange is the IntRange variant of [Nushell Range] type.
 
@@ -61,6 +81,58 @@ func (v *IntRange) String() string {
 	return fmt.Sprintf("%d..%d..%s", v.Start, v.Start+v.Step, s)
 }
 
+/*
+ParseIntRange parses Nushell style range definition (the format returned by
+the [IntRange.String] method), supported forms are:
+
+  - "1..5": range with inferred step (1 or -1 when end is smaller than start);
+  - "1..3..9": start, next value (step is next-start) and end;
+  - "1..<5", "1..3..<9": range where end value is excluded;
+  - "1..", "1..3..": unbounded range.
+
+Returned range is validated, ie step must not be zero.
+*/
+func ParseIntRange(s string) (IntRange, error) {
+	parts := strings.Split(s, "..")
+	if len(parts) < 2 || len(parts) > 3 {
+		return IntRange{}, fmt.Errorf("invalid range %q: expected start..end or start..next..end", s)
+	}
+
+	var err error
+	r := IntRange{Step: 1}
+	if r.Start, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return IntRange{}, fmt.Errorf("invalid range %q: parsing start value: %w", s, err)
+	}
+
+	switch end := parts[len(parts)-1]; {
+	case end == "":
+		r.Bound = Unbounded
+	case strings.HasPrefix(end, "<"):
+		r.Bound = Excluded
+		end = end[1:]
+		fallthrough
+	default:
+		if r.End, err = strconv.ParseInt(end, 10, 64); err != nil {
+			return IntRange{}, fmt.Errorf("invalid range %q: parsing end value: %w", s, err)
+		}
+	}
+
+	if len(parts) == 3 {
+		next, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return IntRange{}, fmt.Errorf("invalid range %q: parsing next value: %w", s, err)
+		}
+		r.Step = next - r.Start
+	} else if r.Bound != Unbounded && r.End < r.Start {
+		r.Step = -1
+	}
+
+	if err := r.Validate(); err != nil {
+		return IntRange{}, fmt.Errorf("invalid range %q: %w", s, err)
+	}
+	return r, nil
+}
+
 func (v IntRange) Validate() error {
 	// should we check that End == 0 for Unbounded?
 	switch {
@@ -96,6 +168,19 @@ func (v IntRange) All() iter.Seq[int64] {
 	}
 }
 
+/*
+Values generates all the values in the range as Int Values, see [IntRange.All].
+*/
+func (v IntRange) Values() iter.Seq[Value] {
+	return func(yield func(Value) bool) {
+		for i := range v.All() {
+			if !yield(Value{Value: i}) {
+				return
+			}
+		}
+	}
+}
+
 func add(a, b int64) (int64, bool) {
 	c := a + b
 	return c, (c > a) == (b > 0)
@@ -179,59 +264,75 @@ func (v *IntRange) EncodeMsgpack(enc *msgpack.Encoder) error {
 }
 
 func (v *IntRange) encodeEndBound(enc *msgpack.Encoder) (err error) {
-	if v.Bound == Unbounded {
-		return enc.EncodeString("Unbounded")
+	if ok, err := encodeBoundName(enc, v.Bound); !ok || err != nil {
+		return err
+	}
+	return enc.EncodeInt(v.End)
+}
+
+/*
+encodeBoundName encodes the end bound kind of the range, returns true when
+caller must encode the end value (ie bound is not Unbounded).
+*/
+func encodeBoundName(enc *msgpack.Encoder, bound RangeBound) (bool, error) {
+	if bound == Unbounded {
+		return false, enc.EncodeString("Unbounded")
 	}
 
 	if err := enc.EncodeMapLen(1); err != nil {
-		return err
+		return false, err
 	}
-	switch v.Bound {
+	switch bound {
 	case Included:
-		err = enc.EncodeString("Included")
+		return true, enc.EncodeString("Included")
 	case Excluded:
-		err = enc.EncodeString("Excluded")
+		return true, enc.EncodeString("Excluded")
 	default:
-		return fmt.Errorf("unsupported bound value: %d", v.Bound)
+		return false, fmt.Errorf("unsupported bound value: %d", bound)
 	}
-	if err != nil {
+}
+
+func (v *IntRange) decodeEndBound(dec *msgpack.Decoder) (err error) {
+	if v.Bound, err = decodeBoundName(dec); err != nil || v.Bound == Unbounded {
 		return err
 	}
-	return enc.EncodeInt(v.End)
+	v.End, err = dec.DecodeInt64()
+	return err
 }
 
-func (v *IntRange) decodeEndBound(dec *msgpack.Decoder) (err error) {
+/*
+decodeBoundName decodes the end bound kind of the range, unless the bound
+is Unbounded caller must decode the end value next.
+*/
+func decodeBoundName(dec *msgpack.Decoder) (RangeBound, error) {
 	code, err := dec.PeekCode()
 	if err != nil {
-		return fmt.Errorf("peek the type of the end bound of IntRange: %w", err)
+		return 0, fmt.Errorf("peek the type of the end bound of range: %w", err)
 	}
 	var name string
 	switch {
 	case msgpcode.IsFixedMap(code) || code == msgpcode.Map16 || code == msgpcode.Map32:
 		if n, err := dec.DecodeMapLen(); err != nil || n != 1 {
-			return fmt.Errorf("expected single item map as end bound, got [%d] or error: %w", n, err)
+			return 0, fmt.Errorf("expected single item map as end bound, got [%d] or error: %w", n, err)
 		}
 		name, err = dec.DecodeString()
 	case msgpcode.IsString(code):
 		name, err = dec.DecodeString()
 	}
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	switch name {
 	case "Unbounded":
-		v.Bound = Unbounded
-		return nil
+		return Unbounded, nil
 	case "Included":
-		v.Bound = Included
+		return Included, nil
 	case "Excluded":
-		v.Bound = Excluded
+		return Excluded, nil
 	default:
-		return fmt.Errorf("unsupported bound name %q", name)
+		return 0, fmt.Errorf("unsupported bound name %q", name)
 	}
-	v.End, err = dec.DecodeInt64()
-	return err
 }
 
 var _ msgpack.CustomDecoder = (*IntRange)(nil)
@@ -278,8 +379,174 @@ func decodeMsgpackRange(dec *msgpack.Decoder) (any, error) {
 		v := IntRange{}
 		return v, v.DecodeMsgpack(dec)
 	case "FloatRange":
-		return nil, fmt.Errorf("FloatRange is not implemented")
+		v := FloatRange{}
+		return v, v.DecodeMsgpack(dec)
 	default:
 		return nil, fmt.Errorf("unsupported Range type: %q", name)
 	}
 }
+
+/*
+FloatRange is the FloatRange variant of [Nushell Range] type.
+
+To iterate over values in the range use [FloatRange.All] method.
+
+[Nushell Range]: https://www.nushell.sh/contributor-book/plugin_protocol_reference.html#range
+*/
+type FloatRange struct {
+	Start float64
+	Step  float64
+	End   float64
+	Bound RangeBound // end bound kind of the range
+}
+
+func (v *FloatRange) String() string {
+	f := func(n float64) string { return strconv.FormatFloat(n, 'g', -1, 64) }
+	s := ""
+	switch v.Bound {
+	case Included:
+		s = f(v.End)
+	case Excluded:
+		s = "<" + f(v.End)
+	}
+	return fmt.Sprintf("%s..%s..%s", f(v.Start), f(v.Start+v.Step), s)
+}
+
+func (v FloatRange) Validate() error {
+	if math.IsNaN(v.Start) || math.IsInf(v.Start, 0) {
+		return fmt.Errorf("start value must be finite number, got %v", v.Start)
+	}
+	if v.Bound != Unbounded && math.IsNaN(v.End) {
+		return errors.New("end value must not be NaN")
+	}
+	switch {
+	case v.Step > 0:
+		if v.Bound != Unbounded && v.Start > v.End {
+			return fmt.Errorf("start value must be smaller than end value, got %v..%v (step %v)", v.Start, v.End, v.Step)
+		}
+	case v.Step < 0:
+		if v.Bound != Unbounded && v.Start <= v.End {
+			return fmt.Errorf("start value must be greater than end value, got %v..%v (step %v)", v.Start, v.End, v.Step)
+		}
+	default:
+		return errors.New("step must be non-zero number")
+	}
+	return nil
+}
+
+/*
+All generates all the values in the Range. To avoid accumulating rounding
+errors n-th value is calculated as Start + n*Step.
+
+Invalid range doesn't generate any values.
+*/
+func (v FloatRange) All() iter.Seq[float64] {
+	return func(yield func(float64) bool) {
+		if v.Validate() != nil {
+			return
+		}
+		inRange := func(f float64) bool {
+			switch {
+			case v.Bound == Unbounded:
+				return !math.IsInf(f, 0)
+			case v.Step > 0 && v.Bound == Included:
+				return f <= v.End
+			case v.Step > 0:
+				return f < v.End
+			case v.Bound == Included:
+				return f >= v.End
+			default:
+				return f > v.End
+			}
+		}
+		for n := 0.0; ; n++ {
+			f := v.Start + n*v.Step
+			if !inRange(f) || !yield(f) {
+				return
+			}
+		}
+	}
+}
+
+/*
+Values generates all the values in the range as Float Values, see [FloatRange.All].
+*/
+func (v FloatRange) Values() iter.Seq[Value] {
+	return func(yield func(Value) bool) {
+		for f := range v.All() {
+			if !yield(Value{Value: f}) {
+				return
+			}
+		}
+	}
+}
+
+var _ msgpack.CustomEncoder = (*FloatRange)(nil)
+
+func (v *FloatRange) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if err := v.Validate(); err != nil {
+		return fmt.Errorf("invalid FloatRange definition: %w", err)
+	}
+
+	if err := encodeMapStart(enc, "FloatRange"); err != nil {
+		return err
+	}
+
+	if err := enc.EncodeMapLen(3); err != nil {
+		return err
+	}
+	if err := enc.EncodeString("start"); err != nil {
+		return err
+	}
+	if err := enc.EncodeFloat64(v.Start); err != nil {
+		return err
+	}
+	if err := enc.EncodeString("step"); err != nil {
+		return err
+	}
+	if err := enc.EncodeFloat64(v.Step); err != nil {
+		return err
+	}
+	if err := enc.EncodeString("end"); err != nil {
+		return err
+	}
+	if ok, err := encodeBoundName(enc, v.Bound); !ok || err != nil {
+		return err
+	}
+	return enc.EncodeFloat64(v.End)
+}
+
+var _ msgpack.CustomDecoder = (*FloatRange)(nil)
+
+func (v *FloatRange) DecodeMsgpack(dec *msgpack.Decoder) error {
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		return err
+	}
+	if n == -1 {
+		return nil
+	}
+
+	for idx := 0; idx < n; idx++ {
+		fieldName, err := dec.DecodeString()
+		if err != nil {
+			return fmt.Errorf("decoding field name [%d/%d] of FloatRange: %w", idx+1, n, err)
+		}
+		switch fieldName {
+		case "start":
+			v.Start, err = dec.DecodeFloat64()
+		case "step":
+			v.Step, err = dec.DecodeFloat64()
+		case "end":
+			if v.Bound, err = decodeBoundName(dec); err == nil && v.Bound != Unbounded {
+				v.End, err = dec.DecodeFloat64()
+			}
+		default:
+			return fmt.Errorf("unexpected key %q in FloatRange", fieldName)
+		}
+		if err != nil {
+			return fmt.Errorf("decode field %q: %w", fieldName, err)
+		}
+	}
+	return nil
+}
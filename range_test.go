@@ -33,6 +33,65 @@ func Test_IntRange_String(t *testing.T) {
 	}
 }
 
+func Test_ParseIntRange(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		var testCases = []struct {
+			s string
+			r IntRange
+		}{
+			{s: "1..5", r: IntRange{Start: 1, Step: 1, End: 5, Bound: Included}},
+			{s: "5..1", r: IntRange{Start: 5, Step: -1, End: 1, Bound: Included}},
+			{s: "1..<5", r: IntRange{Start: 1, Step: 1, End: 5, Bound: Excluded}},
+			{s: "-1..<-5", r: IntRange{Start: -1, Step: -1, End: -5, Bound: Excluded}},
+			{s: "1..", r: IntRange{Start: 1, Step: 1, Bound: Unbounded}},
+			{s: "1..3..9", r: IntRange{Start: 1, Step: 2, End: 9, Bound: Included}},
+			{s: "1..3..<9", r: IntRange{Start: 1, Step: 2, End: 9, Bound: Excluded}},
+			{s: "8..13..", r: IntRange{Start: 8, Step: 5, Bound: Unbounded}},
+			{s: "-10..-15..-15", r: IntRange{Start: -10, Step: -5, End: -15, Bound: Included}},
+			{s: "3..3", r: IntRange{Start: 3, Step: 1, End: 3, Bound: Included}},
+		}
+		for _, tc := range testCases {
+			r, err := ParseIntRange(tc.s)
+			if err != nil {
+				t.Errorf("parsing %q: %v", tc.s, err)
+				continue
+			}
+			if diff := cmp.Diff(tc.r, r); diff != "" {
+				t.Errorf("parsing %q mismatch (-expected +got):\n%s", tc.s, diff)
+			}
+			// parsing the String representation must give back the same range
+			if r2, err := ParseIntRange(r.String()); err != nil {
+				t.Errorf("parsing %q: %v", r.String(), err)
+			} else if diff := cmp.Diff(r, r2); diff != "" {
+				t.Errorf("parsing %q mismatch (-expected +got):\n%s", r.String(), diff)
+			}
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		var testCases = []struct {
+			s   string
+			err string
+		}{
+			{s: "", err: `invalid range "": expected start..end or start..next..end`},
+			{s: "1", err: `invalid range "1": expected start..end or start..next..end`},
+			{s: "1..2..3..4", err: `invalid range "1..2..3..4": expected start..end or start..next..end`},
+			{s: "..5", err: `invalid range "..5": parsing start value: strconv.ParseInt: parsing "": invalid syntax`},
+			{s: "a..5", err: `invalid range "a..5": parsing start value: strconv.ParseInt: parsing "a": invalid syntax`},
+			{s: "1..b", err: `invalid range "1..b": parsing end value: strconv.ParseInt: parsing "b": invalid syntax`},
+			{s: "1..<", err: `invalid range "1..<": parsing end value: strconv.ParseInt: parsing "": invalid syntax`},
+			{s: "1..x..5", err: `invalid range "1..x..5": parsing next value: strconv.ParseInt: parsing "x": invalid syntax`},
+			{s: "1..1..5", err: `invalid range "1..1..5": step must be non-zero`},
+			{s: "1..2..0", err: `invalid range "1..2..0": start value must be smaller than end value, got 1..0 (step 1)`},
+			{s: "5..4..9", err: `invalid range "5..4..9": start value must be greater than end value, got 5..9 (step -1)`},
+		}
+		for _, tc := range testCases {
+			_, err := ParseIntRange(tc.s)
+			expectErrorMsg(t, err, tc.err)
+		}
+	})
+}
+
 func Test_IntRange_EndBound(t *testing.T) {
 	t.Run("input equals output", func(t *testing.T) {
 		// cases where encode - decode cycle results in
@@ -252,3 +311,116 @@ func ExampleIntRange() {
 	// Included: [-1 1 3 5]
 	// Excluded: [-1 1 3]
 }
+
+func Test_FloatRange_Iterator(t *testing.T) {
+	t.Run("invalid ranges", func(t *testing.T) {
+		cases := []FloatRange{
+			{}, // Step is zero
+			{Start: 1, Step: math.NaN(), End: 2},
+			{Start: math.NaN(), Step: 1, End: 2},
+			{Start: math.Inf(-1), Step: 1, End: 2},
+			{Start: 1, Step: 1, End: math.NaN()},
+			{Start: 1, Step: 0.5, End: 0, Bound: Included},  // count up, Start > End
+			{Start: 0, Step: -0.5, End: 1, Bound: Included}, // count down, Start < End
+		}
+		for x, tc := range cases {
+			if err := tc.Validate(); err == nil {
+				t.Errorf("[%d] expected error for invalid FloatRange %#v", x, tc)
+				continue
+			}
+			if diff := cmp.Diff([]float64(nil), slices.Collect(tc.All())); diff != "" {
+				t.Errorf("[%d] sequence mismatch for %#v (-expected +got):\n%s", x, tc, diff)
+			}
+		}
+	})
+
+	t.Run("valid ranges", func(t *testing.T) {
+		cases := []struct {
+			r   FloatRange
+			out []float64
+		}{
+			{r: FloatRange{Start: 1, Step: 0.5, End: 1, Bound: Excluded}, out: nil},
+			{r: FloatRange{Start: 1, Step: 0.5, End: 1, Bound: Included}, out: []float64{1}},
+			{r: FloatRange{Start: 1, Step: 0.5, End: 3, Bound: Included}, out: []float64{1, 1.5, 2, 2.5, 3}},
+			{r: FloatRange{Start: 1, Step: 0.5, End: 3, Bound: Excluded}, out: []float64{1, 1.5, 2, 2.5}},
+			{r: FloatRange{Start: 0, Step: 0.1, End: 0.3, Bound: Included}, out: []float64{0, 0.1, 0.2}}, // 3*0.1 > 0.3
+			{r: FloatRange{Start: 1, Step: -0.75, End: -1, Bound: Included}, out: []float64{1, 0.25, -0.5}},
+			{r: FloatRange{Start: 1, Step: -0.5, End: 0, Bound: Excluded}, out: []float64{1, 0.5}},
+		}
+		for x, tc := range cases {
+			if err := tc.r.Validate(); err != nil {
+				t.Errorf("[%d] unexpected error for FloatRange %#v: %v", x, tc.r, err)
+				continue
+			}
+			if diff := cmp.Diff(tc.out, slices.Collect(tc.r.All())); diff != "" {
+				t.Errorf("[%d] sequence mismatch for %#v (-expected +got):\n%s", x, tc.r, diff)
+			}
+		}
+	})
+
+	t.Run("unbounded", func(t *testing.T) {
+		r := FloatRange{Start: 1, Step: 0.5, Bound: Unbounded}
+		var out []float64
+		for f := range r.All() {
+			if out = append(out, f); len(out) == 4 {
+				break
+			}
+		}
+		if diff := cmp.Diff([]float64{1, 1.5, 2, 2.5}, out); diff != "" {
+			t.Errorf("sequence mismatch (-expected +got):\n%s", diff)
+		}
+	})
+}
+
+func Test_FloatRange_String(t *testing.T) {
+	cases := []struct {
+		r FloatRange
+		s string
+	}{
+		{r: FloatRange{Start: 0, Step: 0.5, End: 2, Bound: Included}, s: "0..0.5..2"},
+		{r: FloatRange{Start: 0.5, Step: 0.25, End: 2, Bound: Excluded}, s: "0.5..0.75..<2"},
+		{r: FloatRange{Start: -1, Step: -1.5, Bound: Unbounded}, s: "-1..-2.5.."},
+	}
+	for _, tc := range cases {
+		if s := tc.r.String(); s != tc.s {
+			t.Errorf("expected %q, got %q", tc.s, s)
+		}
+	}
+}
+
+func Test_Range(t *testing.T) {
+	cases := []struct {
+		r   Range
+		out []Value
+	}{
+		{r: IntRange{Start: 1, Step: 2, End: 5}, out: []Value{{Value: int64(1)}, {Value: int64(3)}, {Value: int64(5)}}},
+		{r: FloatRange{Start: 1, Step: 2, End: 5}, out: []Value{{Value: 1.0}, {Value: 3.0}, {Value: 5.0}}},
+	}
+	for _, tc := range cases {
+		if diff := cmp.Diff(tc.out, slices.Collect(tc.r.Values())); diff != "" {
+			t.Errorf("values of %T mismatch (-expected +got):\n%s", tc.r, diff)
+		}
+
+		// decodeMsgpackRange must return the same Range variant
+		b, err := msgpack.Marshal(&Value{Value: tc.r})
+		if err != nil {
+			t.Fatalf("encoding %T: %v", tc.r, err)
+		}
+		var v Value
+		if err := msgpack.Unmarshal(b, &v); err != nil {
+			t.Fatalf("decoding %T: %v", tc.r, err)
+		}
+		if diff := cmp.Diff(tc.r, v.Value); diff != "" {
+			t.Errorf("decoded Range mismatch (-expected +got):\n%s", diff)
+		}
+	}
+
+	t.Run("unsupported variant", func(t *testing.T) {
+		b, err := msgpack.Marshal(map[string]any{"DurationRange": map[string]any{}})
+		if err != nil {
+			t.Fatalf("encoding: %v", err)
+		}
+		_, err = decodeMsgpackRange(msgpack.NewDecoder(bytes.NewReader(b)))
+		expectErrorMsg(t, err, `unsupported Range type: "DurationRange"`)
+	})
+}
@@ -0,0 +1,247 @@
+package nu
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ainvaltin/nu-plugin/types"
+)
+
+/*
+SetPath assigns v to the cell selected by the cell path cp.
+
+Missing intermediate cells are created - String member creates Record and
+Int member creates List (list is extended with Nothing values when the index
+is out of range, by at most 10000 items - index further out of range is an
+error). Existing cell of incompatible type (ie String member selecting from
+List) is an error.
+
+The record is modified in place, the returned Record is the same as r unless
+r is nil in which case new Record is created.
+*/
+func (r Record) SetPath(cp CellPath, v Value) (Record, error) {
+	if len(cp.Members) == 0 {
+		return r, fmt.Errorf("cell path must not be empty")
+	}
+	if cp.Members[0].Type != PathMemberString {
+		return r, fmt.Errorf("cell path %s: can't select item %s from Record", cp, cp.Members[0])
+	}
+	if r == nil {
+		r = Record{}
+	}
+	nv, err := setPath(Value{Value: r}, cp, 0, v)
+	if err != nil {
+		return r, err
+	}
+	return nv.Value.(Record), nil
+}
+
+// setPathMaxGrow is the maximum count of items SetPath adds to the List.
+const setPathMaxGrow = 10000
+
+func setPath(cur Value, cp CellPath, idx int, v Value) (Value, error) {
+	if idx == len(cp.Members) {
+		return v, nil
+	}
+
+	m := cp.Members[idx]
+	switch m.Type {
+	case PathMemberString:
+		rec, ok := cur.Value.(Record)
+		switch {
+		case ok:
+		case cur.Value == nil:
+			rec = Record{}
+		default:
+			return cur, fmt.Errorf("cell path %s: can't select field %q from %s", cp, m.Name, typeOf(cur.Value))
+		}
+		item, err := setPath(rec[m.Name], cp, idx+1, v)
+		if err != nil {
+			return cur, err
+		}
+		rec[m.Name] = item
+		cur.Value = rec
+	case PathMemberInt:
+		lst, ok := cur.Value.([]Value)
+		switch {
+		case ok:
+		case cur.Value == nil:
+		default:
+			return cur, fmt.Errorf("cell path %s: can't select item %d from %s", cp, m.Index, typeOf(cur.Value))
+		}
+		if m.Index >= uint(len(lst))+setPathMaxGrow {
+			return cur, fmt.Errorf("cell path %s: index %d out of range, list has %d items and can be extended by at most %d", cp, m.Index, len(lst), setPathMaxGrow)
+		}
+		if n := int(m.Index) + 1; n > len(lst) {
+			lst = append(lst, make([]Value, n-len(lst))...)
+		}
+		item, err := setPath(lst[m.Index], cp, idx+1, v)
+		if err != nil {
+			return cur, err
+		}
+		lst[m.Index] = item
+		cur.Value = lst
+	default:
+		return cur, fmt.Errorf("unsupported path member type %d", m.Type)
+	}
+	return cur, nil
+}
+
+/*
+DeletePath removes the cell selected by the cell path cp - field is deleted
+from the Record or item is removed from the List.
+
+Missing cell is an error unless the path member is optional.
+
+The record is modified in place but Lists on the path are copied so the
+slices in the original record are not modified.
+*/
+func (r Record) DeletePath(cp CellPath) (Record, error) {
+	if len(cp.Members) == 0 {
+		return r, fmt.Errorf("cell path must not be empty")
+	}
+	nv, err := deletePath(Value{Value: r}, cp, 0)
+	if err != nil {
+		return r, err
+	}
+	return nv.Value.(Record), nil
+}
+
+func deletePath(cur Value, cp CellPath, idx int) (Value, error) {
+	m := cp.Members[idx]
+	last := idx == len(cp.Members)-1
+	switch m.Type {
+	case PathMemberString:
+		rec, ok := cur.Value.(Record)
+		if !ok {
+			return cur, fmt.Errorf("cell path %s: can't select field %q from %s", cp, m.Name, typeOf(cur.Value))
+		}
+		item, ok := rec[m.Name]
+		switch {
+		case !ok && m.Optional:
+			return cur, nil
+		case !ok:
+			return cur, fmt.Errorf("cell path %s: field %q not found", cp, m.Name)
+		case last:
+			delete(rec, m.Name)
+			return cur, nil
+		}
+		item, err := deletePath(item, cp, idx+1)
+		if err != nil {
+			return cur, err
+		}
+		rec[m.Name] = item
+	case PathMemberInt:
+		lst, ok := cur.Value.([]Value)
+		if !ok {
+			return cur, fmt.Errorf("cell path %s: can't select item %d from %s", cp, m.Index, typeOf(cur.Value))
+		}
+		switch {
+		case m.Index >= uint(len(lst)) && m.Optional:
+			return cur, nil
+		case m.Index >= uint(len(lst)):
+			return cur, fmt.Errorf("cell path %s: index %d out of range, list has %d items", cp, m.Index, len(lst))
+		case last:
+			cur.Value = slices.Delete(slices.Clone(lst), int(m.Index), int(m.Index)+1)
+			return cur, nil
+		}
+		item, err := deletePath(lst[m.Index], cp, idx+1)
+		if err != nil {
+			return cur, err
+		}
+		lst = slices.Clone(lst)
+		lst[m.Index] = item
+		cur.Value = lst
+	default:
+		return cur, fmt.Errorf("unsupported path member type %d", m.Type)
+	}
+	return cur, nil
+}
+
+/*
+PairsToRecord converts list of key-value pairs into Record. Each item of
+the list must be either
+
+  - List of two items where the first item is String (the key);
+  - Record with fields "key" (String) and "value".
+
+Malformed item results in [LabeledError] with the item's span as a label.
+When the same key appears multiple times the last value wins.
+*/
+func PairsToRecord(list []Value) (Record, error) {
+	r := make(Record, len(list))
+	for i, item := range list {
+		var key, value Value
+		switch data := item.Value.(type) {
+		case []Value:
+			if len(data) != 2 {
+				return nil, pairError(i, item, fmt.Sprintf("expected list of two items, got %d items", len(data)))
+			}
+			key, value = data[0], data[1]
+		case Record:
+			var ok bool
+			if key, ok = data["key"]; !ok {
+				return nil, pairError(i, item, `record must have "key" field`)
+			}
+			if value, ok = data["value"]; !ok {
+				return nil, pairError(i, item, `record must have "value" field`)
+			}
+		default:
+			return nil, pairError(i, item, fmt.Sprintf("expected list or record, got %s", typeOf(data)))
+		}
+
+		name, ok := key.Value.(string)
+		if !ok {
+			return nil, pairError(i, key, fmt.Sprintf("key must be string, got %s", typeOf(key.Value)))
+		}
+		r[name] = value
+	}
+	return r, nil
+}
+
+func pairError(idx int, item Value, text string) error {
+	return &LabeledError{
+		Msg:    fmt.Sprintf("invalid key-value pair at index %d", idx),
+		Labels: []ErrorLabel{{Text: text, Span: item.Span}},
+	}
+}
+
+/*
+ValidateRecord checks that r has all the fields listed in the schema and
+that the types of the field values are compatible with the schema (see
+[types.IsSubtype]). Fields of the record not mentioned in the schema are
+ignored.
+
+When the record doesn't match the schema [LabeledError] is returned, each
+mistyped field is reported as a label with the field's span and missing
+fields are listed in the help text.
+*/
+func ValidateRecord(r Record, schema types.RecordDef) error {
+	var missing []string
+	var labels []ErrorLabel
+	for _, name := range slices.Sorted(maps.Keys(schema)) {
+		v, ok := r[name]
+		if !ok {
+			missing = append(missing, strconv.Quote(name))
+			continue
+		}
+		if vt := typeOf(v.Value); !types.IsSubtype(vt, schema[name]) {
+			labels = append(labels, ErrorLabel{
+				Text: fmt.Sprintf("field %q: expected %s, got %s", name, schema[name], vt),
+				Span: v.Span,
+			})
+		}
+	}
+	if missing == nil && labels == nil {
+		return nil
+	}
+
+	err := &LabeledError{Msg: "record doesn't match the schema", Labels: labels}
+	if missing != nil {
+		err.Help = "missing fields: " + strings.Join(missing, ", ")
+	}
+	return err
+}
@@ -0,0 +1,357 @@
+package nu
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ainvaltin/nu-plugin/types"
+)
+
+func Test_Record_SetPath(t *testing.T) {
+	path := func(members ...any) CellPath {
+		cp := CellPath{}
+		for _, m := range members {
+			switch m := m.(type) {
+			case string:
+				cp.AddString(m)
+			case int:
+				cp.AddInteger(uint(m))
+			}
+		}
+		return cp
+	}
+
+	testCases := []struct {
+		name string
+		in   Record
+		path CellPath
+		out  Record
+	}{
+		{
+			name: "nil record",
+			path: path("a"),
+			out:  Record{"a": Value{Value: 1}},
+		},
+		{
+			name: "overwrite field",
+			in:   Record{"a": Value{Value: "foo"}, "b": Value{Value: 2}},
+			path: path("a"),
+			out:  Record{"a": Value{Value: 1}, "b": Value{Value: 2}},
+		},
+		{
+			name: "intermediate records",
+			in:   Record{},
+			path: path("a", "b", "c"),
+			out:  Record{"a": Value{Value: Record{"b": Value{Value: Record{"c": Value{Value: 1}}}}}},
+		},
+		{
+			name: "intermediate list",
+			in:   Record{},
+			path: path("a", 2),
+			out:  Record{"a": Value{Value: []Value{{}, {}, {Value: 1}}}},
+		},
+		{
+			name: "record in list",
+			in:   Record{"a": Value{Value: []Value{{Value: "x"}}}},
+			path: path("a", 1, "b"),
+			out:  Record{"a": Value{Value: []Value{{Value: "x"}, {Value: Record{"b": Value{Value: 1}}}}}},
+		},
+		{
+			// backing array has stale items beyond len, new items must be Nothing
+			name: "list with spare capacity",
+			in:   Record{"a": Value{Value: []Value{{Value: "x"}, {Value: "stale"}, {Value: "stale"}, {Value: "stale"}}[:1]}},
+			path: path("a", 3),
+			out:  Record{"a": Value{Value: []Value{{Value: "x"}, {}, {}, {Value: 1}}}},
+		},
+		{
+			name: "existing list item",
+			in:   Record{"a": Value{Value: []Value{{Value: "x"}, {Value: "y"}}}},
+			path: path("a", 0),
+			out:  Record{"a": Value{Value: []Value{{Value: 1}, {Value: "y"}}}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := tc.in.SetPath(tc.path, Value{Value: 1})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.out, r); diff != "" {
+				t.Errorf("record mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		errCases := []struct {
+			in   Record
+			path CellPath
+			err  string
+		}{
+			{path: path(), err: `cell path must not be empty`},
+			{path: path(0), err: `cell path 0: can't select item 0 from Record`},
+			{in: Record{"a": Value{Value: 5}}, path: path("a", "b"), err: `cell path a.b: can't select field "b" from int`},
+			{in: Record{"a": Value{Value: 5}}, path: path("a", 0), err: `cell path a.0: can't select item 0 from int`},
+			{in: Record{"a": Value{Value: []Value{}}}, path: path("a", "b"), err: `cell path a.b: can't select field "b" from list<any>`},
+			{in: Record{"a": Value{Value: Record{}}}, path: path("a", 1), err: `cell path a.1: can't select item 1 from record`},
+			{in: Record{"a": Value{Value: []Value{{}}}}, path: path("a", 1<<40), err: `cell path a.1099511627776: index 1099511627776 out of range, list has 1 items and can be extended by at most 10000`},
+			{path: *(&CellPath{}).AddString("a").AddInteger(math.MaxUint), err: `cell path a.18446744073709551615: index 18446744073709551615 out of range, list has 0 items and can be extended by at most 10000`},
+		}
+		for _, tc := range errCases {
+			_, err := tc.in.SetPath(tc.path, Value{Value: 1})
+			expectErrorMsg(t, err, tc.err)
+		}
+	})
+}
+
+func Test_Record_DeletePath(t *testing.T) {
+	newRec := func() Record {
+		return Record{
+			"a": Value{Value: 1},
+			"b": Value{Value: Record{"c": Value{Value: 2}, "d": Value{Value: 3}}},
+			"e": Value{Value: []Value{{Value: 4}, {Value: Record{"f": Value{Value: 5}}}}},
+		}
+	}
+
+	testCases := []struct {
+		name string
+		path CellPath
+		out  Record
+	}{
+		{
+			name: "top level field",
+			path: *(&CellPath{}).AddString("a"),
+			out: Record{
+				"b": Value{Value: Record{"c": Value{Value: 2}, "d": Value{Value: 3}}},
+				"e": Value{Value: []Value{{Value: 4}, {Value: Record{"f": Value{Value: 5}}}}},
+			},
+		},
+		{
+			name: "nested field",
+			path: *(&CellPath{}).AddString("b").AddString("c"),
+			out: Record{
+				"a": Value{Value: 1},
+				"b": Value{Value: Record{"d": Value{Value: 3}}},
+				"e": Value{Value: []Value{{Value: 4}, {Value: Record{"f": Value{Value: 5}}}}},
+			},
+		},
+		{
+			name: "list item",
+			path: *(&CellPath{}).AddString("e").AddInteger(0),
+			out: Record{
+				"a": Value{Value: 1},
+				"b": Value{Value: Record{"c": Value{Value: 2}, "d": Value{Value: 3}}},
+				"e": Value{Value: []Value{{Value: Record{"f": Value{Value: 5}}}}},
+			},
+		},
+		{
+			name: "field of record in list",
+			path: *(&CellPath{}).AddString("e").AddInteger(1).AddString("f"),
+			out: Record{
+				"a": Value{Value: 1},
+				"b": Value{Value: Record{"c": Value{Value: 2}, "d": Value{Value: 3}}},
+				"e": Value{Value: []Value{{Value: 4}, {Value: Record{}}}},
+			},
+		},
+		{
+			name: "optional missing field",
+			path: CellPath{Members: []PathMember{{Type: PathMemberString, Name: "x", Optional: true}}},
+			out:  newRec(),
+		},
+		{
+			name: "optional missing item",
+			path: CellPath{Members: []PathMember{{Type: PathMemberString, Name: "e"}, {Type: PathMemberInt, Index: 5, Optional: true}}},
+			out:  newRec(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := newRec().DeletePath(tc.path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.out, r); diff != "" {
+				t.Errorf("record mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		errCases := []struct {
+			path CellPath
+			err  string
+		}{
+			{path: CellPath{}, err: `cell path must not be empty`},
+			{path: *(&CellPath{}).AddString("x"), err: `cell path x: field "x" not found`},
+			{path: *(&CellPath{}).AddString("e").AddInteger(2), err: `cell path e.2: index 2 out of range, list has 2 items`},
+			{path: *(&CellPath{}).AddString("a").AddString("x"), err: `cell path a.x: can't select field "x" from int`},
+			{path: *(&CellPath{}).AddString("b").AddInteger(0), err: `cell path b.0: can't select item 0 from record<c: int, d: int>`},
+		}
+		for _, tc := range errCases {
+			_, err := newRec().DeletePath(tc.path)
+			expectErrorMsg(t, err, tc.err)
+		}
+	})
+	t.Run("lists are copied", func(t *testing.T) {
+		inner := []Value{{Value: 1}, {Value: 2}}
+		outer := []Value{{Value: inner}}
+		r, err := Record{"a": Value{Value: outer}}.DeletePath(*(&CellPath{}).AddString("a").AddInteger(0).AddInteger(0))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if diff := cmp.Diff(Record{"a": Value{Value: []Value{{Value: []Value{{Value: 2}}}}}}, r); diff != "" {
+			t.Errorf("record mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]Value{{Value: inner}}, outer); diff != "" {
+			t.Errorf("original list was modified (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]Value{{Value: 1}, {Value: 2}}, inner); diff != "" {
+			t.Errorf("original list was modified (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func Test_PairsToRecord(t *testing.T) {
+	t.Run("valid pairs", func(t *testing.T) {
+		r, err := PairsToRecord([]Value{
+			{Value: []Value{{Value: "a"}, {Value: 1}}},
+			{Value: Record{"key": Value{Value: "b"}, "value": Value{Value: "two"}}},
+			{Value: []Value{{Value: "c"}, {Value: []Value{{Value: 3}}}}},
+			{Value: []Value{{Value: "a"}, {Value: 4}}},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expect := Record{
+			"a": Value{Value: 4},
+			"b": Value{Value: "two"},
+			"c": Value{Value: []Value{{Value: 3}}},
+		}
+		if diff := cmp.Diff(expect, r); diff != "" {
+			t.Errorf("record mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("empty list", func(t *testing.T) {
+		r, err := PairsToRecord(nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(r) != 0 {
+			t.Errorf("expected empty record, got %v", r)
+		}
+	})
+
+	t.Run("malformed pairs", func(t *testing.T) {
+		span := Span{Start: 4, End: 9}
+		testCases := []struct {
+			item Value
+			err  LabeledError
+		}{
+			{
+				item: Value{Value: []Value{{Value: "a"}}, Span: span},
+				err:  LabeledError{Msg: "invalid key-value pair at index 1", Labels: []ErrorLabel{{Text: "expected list of two items, got 1 items", Span: span}}},
+			},
+			{
+				item: Value{Value: Record{"key": Value{Value: "a"}}, Span: span},
+				err:  LabeledError{Msg: "invalid key-value pair at index 1", Labels: []ErrorLabel{{Text: `record must have "value" field`, Span: span}}},
+			},
+			{
+				item: Value{Value: Record{"value": Value{Value: "a"}}, Span: span},
+				err:  LabeledError{Msg: "invalid key-value pair at index 1", Labels: []ErrorLabel{{Text: `record must have "key" field`, Span: span}}},
+			},
+			{
+				item: Value{Value: "a", Span: span},
+				err:  LabeledError{Msg: "invalid key-value pair at index 1", Labels: []ErrorLabel{{Text: "expected list or record, got string", Span: span}}},
+			},
+			{
+				item: Value{Value: []Value{{Value: 1, Span: span}, {Value: "a"}}},
+				err:  LabeledError{Msg: "invalid key-value pair at index 1", Labels: []ErrorLabel{{Text: "key must be string, got int", Span: span}}},
+			},
+			{
+				item: Value{Value: int64(5), Span: span},
+				err:  LabeledError{Msg: "invalid key-value pair at index 1", Labels: []ErrorLabel{{Text: "expected list or record, got int", Span: span}}},
+			},
+			{
+				item: Value{Value: []Value{{Value: Record{}, Span: span}, {Value: "a"}}},
+				err:  LabeledError{Msg: "invalid key-value pair at index 1", Labels: []ErrorLabel{{Text: "key must be string, got record", Span: span}}},
+			},
+		}
+		for _, tc := range testCases {
+			_, err := PairsToRecord([]Value{{Value: []Value{{Value: "ok"}, {}}}, tc.item})
+			le, ok := err.(*LabeledError)
+			if !ok {
+				t.Errorf("expected LabeledError, got %T (%v)", err, err)
+				continue
+			}
+			if diff := cmp.Diff(tc.err, *le); diff != "" {
+				t.Errorf("error mismatch (-want +got):\n%s", diff)
+			}
+		}
+	})
+}
+
+func Test_ValidateRecord(t *testing.T) {
+	schema := types.RecordDef{
+		"db":    types.String(),
+		"item":  types.String(),
+		"count": types.Number(),
+	}
+
+	t.Run("valid record", func(t *testing.T) {
+		r := Record{
+			"db":    {Value: "data.db"},
+			"item":  {Value: "key"},
+			"count": {Value: int64(1)},
+			"extra": {Value: true},
+		}
+		if err := ValidateRecord(r, schema); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if err := ValidateRecord(nil, nil); err != nil {
+			t.Errorf("unexpected error for empty schema: %v", err)
+		}
+	})
+
+	t.Run("invalid record", func(t *testing.T) {
+		testCases := []struct {
+			rec Record
+			err LabeledError
+		}{
+			{
+				rec: Record{"count": {Value: 1.5}},
+				err: LabeledError{Msg: "record doesn't match the schema", Help: `missing fields: "db", "item"`},
+			},
+			{
+				rec: Record{"db": {Value: "data.db"}, "item": {Value: int64(5), Span: Span{Start: 10, End: 11}}, "count": {Value: "one", Span: Span{Start: 20, End: 25}}},
+				err: LabeledError{Msg: "record doesn't match the schema", Labels: []ErrorLabel{
+					{Text: `field "count": expected number, got string`, Span: Span{Start: 20, End: 25}},
+					{Text: `field "item": expected string, got int`, Span: Span{Start: 10, End: 11}},
+				}},
+			},
+			{
+				rec: Record{"item": {Value: nil, Span: Span{Start: 3, End: 7}}, "count": {Value: int64(0)}},
+				err: LabeledError{
+					Msg:    "record doesn't match the schema",
+					Labels: []ErrorLabel{{Text: `field "item": expected string, got nothing`, Span: Span{Start: 3, End: 7}}},
+					Help:   `missing fields: "db"`,
+				},
+			},
+		}
+		for x, tc := range testCases {
+			err := ValidateRecord(tc.rec, schema)
+			le, ok := err.(*LabeledError)
+			if !ok {
+				t.Errorf("[%d] expected LabeledError, got %T (%v)", x, err, err)
+				continue
+			}
+			if diff := cmp.Diff(tc.err, *le); diff != "" {
+				t.Errorf("[%d] error mismatch (-want +got):\n%s", x, diff)
+			}
+		}
+	})
+}
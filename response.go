@@ -2,12 +2,18 @@ package nu
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 /*
@@ -15,6 +21,23 @@ ExecCommand is passed as argument to the plugin command's OnRun handler.
 
 It allows to make engine calls, access command's input (see Input, Named
 and Positional fields) and send response (see Return* methods).
+
+Engine calls are safe to be made concurrently from multiple goroutines.
+Only one response can be sent, concurrent Return* calls are safe in the
+sense that only one of them succeeds (ReturnListStream and ReturnRawStream
+return the already opened stream when called again).
+
+The handler may keep working after the response has been sent (ie to write
+into the output stream) but some engine calls only have effect when made
+before the response, ie [ExecCommand.AddEnvVar] returns [ErrResponseSent]
+error when called after the response has been sent.
+
+Reading the input stream and writing into the output stream concurrently
+(in the same loop or in separate goroutines) is safe, ie filter command can
+open the output with [ExecCommand.ReturnListStream] and then send Values to
+it while reading the input with [ExecCommand.InputAsSeq]. Both operations
+should be done in select with ctx.Done so that the handler exits when the
+call is cancelled.
 */
 type ExecCommand struct {
 	Name string
@@ -39,7 +62,38 @@ type ExecCommand struct {
 	p      *Plugin
 	callID int // call ID which launched the cmd
 	cancel context.CancelCauseFunc
-	output atomic.Value
+	raw    msgpack.RawMessage // raw msgpack of the Value input
+	output responseHolder
+
+	cwdLock sync.Mutex
+	cwd     *string // cached result of GetCurrentDir
+}
+
+// ErrResponseSent is returned when the response to the plugin call has
+// already been sent, see [ExecCommand.Responded].
+var ErrResponseSent = errors.New("response has been already sent")
+
+// errMultipleResponses is returned by the Return* methods when the response
+// has been already sent, the only way to output multiple Values is a stream.
+var errMultipleResponses = fmt.Errorf("%w, command can respond only once (use ReturnListStream for multiple values)", ErrResponseSent)
+
+/*
+RawInput returns the msgpack encoding of the command's input Value as it was
+received from the engine. It is available only when the plugin is created with
+[Config.RetainRawValues] set and the input is single Value (not a stream),
+otherwise nil is returned. To forward the input as is write it directly into
+msgpack encoder.
+*/
+func (ec *ExecCommand) RawInput() msgpack.RawMessage {
+	return ec.raw
+}
+
+/*
+Responded reports whether the response to the plugin call has been sent (ie
+one of the Return* methods has been called successfully).
+*/
+func (ec *ExecCommand) Responded() bool {
+	return ec.output.Load() != nil
 }
 
 /*
@@ -87,35 +141,199 @@ func (ec *ExecCommand) FlagValue(name string) (Value, bool) {
 	return v, false
 }
 
+/*
+FlagEnum returns value of the string flag which must be one of the allowed
+values. Value is obtained using [ExecCommand.FlagValue] so the default value
+from the signature is used when flag was not set by user, empty string is
+returned when the flag has no value.
+
+Value which is not a string or not in the allowed list is reported as
+LabeledError pointing to the flag's value (or to the command when the
+invalid value is the default from the signature).
+*/
+func (ec *ExecCommand) FlagEnum(name string, allowed []string) (string, error) {
+	v, set := ec.FlagValue(name)
+	if v.Value == nil {
+		return "", nil
+	}
+	span := ec.Head
+	if set {
+		span = v.Span
+	}
+
+	s, ok := v.Value.(string)
+	if !ok {
+		return "", &LabeledError{
+			Msg:    fmt.Sprintf("invalid value of the flag --%s", name),
+			Labels: []ErrorLabel{{Text: fmt.Sprintf("expected string, got %s", typeOf(v.Value)), Span: span}},
+		}
+	}
+	if !slices.Contains(allowed, s) {
+		return "", &LabeledError{
+			Msg:    fmt.Sprintf("invalid value of the flag --%s", name),
+			Labels: []ErrorLabel{{Text: fmt.Sprintf("expected one of %s, got %q", strings.Join(allowed, ", "), s), Span: span}},
+		}
+	}
+	return s, nil
+}
+
+/*
+PositionalOrDefault returns value of the positional argument at given index.
+
+When the argument was not provided by user (ie it is optional positional
+argument) the default value defined in the plugin signature is returned.
+When signature doesn't define default value (or there is no positional
+argument with such index in the signature) zero Value is returned.
+
+Index counts over both required and optional positional arguments, ie
+index of the first optional argument is len(RequiredPositional).
+*/
+func (ec *ExecCommand) PositionalOrDefault(index int) Value {
+	if index < 0 {
+		return Value{}
+	}
+	if index < len(ec.Positional) {
+		return ec.Positional[index]
+	}
+
+	sig := ec.p.cmds[ec.Name].Signature
+	if index -= len(sig.RequiredPositional); index >= 0 && index < len(sig.OptionalPositional) {
+		if dv := sig.OptionalPositional[index].Default; dv != nil {
+			return *dv
+		}
+	}
+	return Value{}
+}
+
+/*
+ListArg returns items of the List Value positional argument at given index
+(see [ExecCommand.PositionalOrDefault]), items retain their spans so these
+can be used to report errors about individual items. Nil slice is returned
+when the argument is not provided and there is no default value.
+
+When the argument is not a List LabeledError pointing to it is returned.
+*/
+func (ec *ExecCommand) ListArg(index int) ([]Value, error) {
+	v := ec.PositionalOrDefault(index)
+	switch lst := v.Value.(type) {
+	case nil:
+		return nil, nil
+	case []Value:
+		return lst, nil
+	default:
+		span := v.Span
+		if span == (Span{}) {
+			span = ec.Head
+		}
+		return nil, &LabeledError{
+			Msg:    fmt.Sprintf("invalid positional argument [%d]", index),
+			Labels: []ErrorLabel{{Text: fmt.Sprintf("expected list, got %s", typeOf(v.Value)), Span: span}},
+		}
+	}
+}
+
+/*
+OutputTypes returns the input-output type pairs declared in the signature of
+the command (see [PluginSignature.InputOutputTypes]), ie command which
+supports multiple input types can use it to find the output type which
+corresponds to the actual input.
+
+The returned slice is a copy, modifying it doesn't change the signature.
+*/
+func (ec *ExecCommand) OutputTypes() []InOutTypes {
+	return slices.Clone(ec.p.cmds[ec.Name].Signature.InputOutputTypes)
+}
+
 /*
 ReturnValue should be used when command returns single Value.
+
+Command can respond only once, to output multiple Values use
+[ExecCommand.ReturnListStream] (or return List Value).
 */
 func (ec *ExecCommand) ReturnValue(ctx context.Context, v Value) error {
-	if !ec.output.CompareAndSwap(nil, v) {
-		return fmt.Errorf("response has been already sent")
+	return ec.ReturnValueWithMetadata(ctx, v)
+}
+
+/*
+ReturnValueWithMetadata is like [ExecCommand.ReturnValue] but allows to
+set the pipeline metadata of the response (ie content type).
+*/
+func (ec *ExecCommand) ReturnValueWithMetadata(ctx context.Context, v Value, opts ...MetadataOption) error {
+	if !ec.output.setOnce(v) {
+		return errMultipleResponses
 	}
 
-	rsp := callResponse{ID: ec.callID, Response: &pipelineData{Data: v}}
+	pv := &pipelineValue{V: v}
+	for _, opt := range opts {
+		opt.applyMetadata(&pv.M)
+	}
+	rsp := callResponse{ID: ec.callID, Response: &pipelineData{Data: pv}}
 	return ec.p.outputMsg(ctx, &rsp)
 }
 
+/*
+ReturnBinary returns b as single Binary Value, Nushell's "describe" reports
+it as "binary". Use it when the data is small enough to be held in memory.
+
+Data returned using [ExecCommand.ReturnRawStream] with [BinaryStream] option
+is reported as "binary (stream)" by "describe" and it is collected into
+Binary Value only when consumer needs it.
+*/
+func (ec *ExecCommand) ReturnBinary(ctx context.Context, b []byte) error {
+	return ec.ReturnValue(ctx, Value{Value: b, Span: ec.Head})
+}
+
+/*
+ReturnCellPath returns cp as CellPath Value. Members of the path which do
+not have span assigned get the span of the command call so that errors
+raised by the engine when the path is used point to the command.
+*/
+func (ec *ExecCommand) ReturnCellPath(ctx context.Context, cp CellPath) error {
+	members := slices.Clone(cp.Members)
+	for i := range members {
+		if members[i].Span == (Span{}) {
+			members[i].Span = ec.Head
+		}
+	}
+	return ec.ReturnValue(ctx, Value{Value: CellPath{Members: members}, Span: ec.Head})
+}
+
 /*
 ReturnListStream should be used when command returns multiple nu.Values.
 
 When one of the values is [error] engine considers the plugin call to have
-been failed and prints that error message.
+been failed and prints that error message, use [ErrorValue] to create such
+Value.
 
 To signal the end of data chan must be closed (even when sending error)!
+See [ExecCommand.ReturnListSender] for an alternative which is safe to close
+multiple times.
+
+The plugin protocol sends each Value as separate Data message which must
+be acknowledged by the consumer before next Value is sent so for big lists
+it might be more efficient to return single List Value instead or to
+allow multiple Values to be sent without waiting for the Ack, see
+[ListStreamWindow] option.
+
+When the consumer drops the stream the ctx passed to the OnRun handler is
+cancelled with [ErrDropStream] cause, values sent after that are not consumed
+so sending to the chan should be done in select with ctx.Done.
+
+The protocol has no way to ask whether the consumer is interested in the
+output before the response is sent, but the stream can be opened before
+computing the values: the Drop message is handled as soon as it arrives so
+when consumer discards the output (ie it is piped to "ignore") the ctx is
+cancelled before the first value is sent and expensive work can be skipped.
 */
-func (ec *ExecCommand) ReturnListStream(ctx context.Context) (chan<- Value, error) {
-	out := newOutputListValue(ec.p)
+func (ec *ExecCommand) ReturnListStream(ctx context.Context, opts ...ListStreamOption) (chan<- Value, error) {
+	out := newOutputListValue(ec.p, opts...)
 	out.onDrop = func() { ec.cancel(ErrDropStream) }
 
-	if !ec.output.CompareAndSwap(nil, out) {
+	if !ec.output.setOnce(out) {
 		if es, ok := ec.output.Load().(*listStreamOut); ok {
 			return es.data, nil
 		}
-		return nil, fmt.Errorf("response has been already sent")
+		return nil, errMultipleResponses
 	}
 
 	if err := ec.startResponseStream(ctx, out); err != nil {
@@ -125,6 +343,65 @@ func (ec *ExecCommand) ReturnListStream(ctx context.Context) (chan<- Value, erro
 	return out.data, nil
 }
 
+/*
+ReturnListSender is like [ExecCommand.ReturnListStream] but instead of the
+chan it returns [ListSender] which is easier to use correctly: it's Close
+method may be called multiple times and the stream is closed automatically
+when the OnRun handler returns.
+*/
+func (ec *ExecCommand) ReturnListSender(ctx context.Context, opts ...ListStreamOption) (*ListSender, error) {
+	ch, err := ec.ReturnListStream(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	out := ec.output.Load().(*listStreamOut)
+	out.senderOnce.Do(func() { out.listSender = &ListSender{ctx: ctx, ch: ch} })
+	return out.listSender, nil
+}
+
+/*
+ListSender sends Values into the list stream, see [ExecCommand.ReturnListSender].
+*/
+type ListSender struct {
+	ctx    context.Context
+	mu     sync.Mutex
+	ch     chan<- Value
+	closed bool
+}
+
+/*
+Send sends v into the stream, it blocks until the stream accepts the Value
+(see [ListStreamWindow]) or the ctx passed to ReturnListSender is cancelled
+in which case the cause of the cancellation is returned. Sending into closed
+stream returns [io.ErrClosedPipe].
+*/
+func (ls *ListSender) Send(v Value) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.closed {
+		return io.ErrClosedPipe
+	}
+	select {
+	case ls.ch <- v:
+		return nil
+	case <-ls.ctx.Done():
+		return context.Cause(ls.ctx)
+	}
+}
+
+/*
+Close signals the end of data, subsequent calls are no-op.
+*/
+func (ls *ListSender) Close() error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if !ls.closed {
+		ls.closed = true
+		close(ls.ch)
+	}
+	return nil
+}
+
 /*
 ReturnRawStream should be used when command returns raw stream.
 
@@ -132,16 +409,20 @@ To signal the end of data Writer must be closed.
 
 Cancelling the context (ctx) will also "stop" the output stream, ie it
 signals that the plugin is about to quit and all work has to be abandoned.
+
+When the consumer drops the stream the ctx passed to the OnRun handler is
+cancelled with [ErrDropStream] cause and writes into the stream return
+ErrDropStream error.
 */
 func (ec *ExecCommand) ReturnRawStream(ctx context.Context, opts ...RawStreamOption) (io.WriteCloser, error) {
 	out := newOutputListRaw(ec.p, opts...)
 	out.onDrop = func() { ec.cancel(ErrDropStream) }
 
-	if !ec.output.CompareAndSwap(nil, out) {
+	if !ec.output.setOnce(out) {
 		if es, ok := ec.output.Load().(*rawStreamOut); ok {
 			return es.data, nil
 		}
-		return nil, fmt.Errorf("response has been already sent")
+		return nil, errMultipleResponses
 	}
 
 	if err := ec.startResponseStream(ctx, out); err != nil {
@@ -151,6 +432,129 @@ func (ec *ExecCommand) ReturnRawStream(ctx context.Context, opts ...RawStreamOpt
 	return out.data, nil
 }
 
+/*
+ReturnReader returns content of r as raw stream (see [ExecCommand.ReturnRawStream]),
+it reads r until EOF and closes the stream. It's counterpart of [InputRawStream]
+used with [ExecCommand.EvalClosure].
+
+When reading r fails or ctx is cancelled the error is returned and the stream
+is closed, data copied before the error has already been sent to the consumer.
+*/
+func (ec *ExecCommand) ReturnReader(ctx context.Context, r io.Reader, opts ...RawStreamOption) error {
+	out, err := ec.ReturnRawStream(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, ctxReader{ctx: ctx, r: r}); err != nil {
+		// wait until the data copied before the error has been sent so
+		// that the error is the last item of the stream
+		out.Close()
+		if rs, ok := ec.output.Load().(*rawStreamOut); ok {
+			select {
+			case <-rs.done:
+			case <-ctx.Done():
+			}
+		}
+		return fmt.Errorf("copying data into stream: %w", err)
+	}
+	return out.Close()
+}
+
+/*
+ReturnEvalResult forwards the result of [ExecCommand.EvalClosure] or
+[Declaration.Call] as the command's response:
+
+  - nil: nothing is returned (command's response will be Empty);
+  - Value: returned using [ExecCommand.ReturnValue];
+  - list stream (<-chan Value): items are forwarded to the list stream
+    returned by [ExecCommand.ReturnListStream];
+  - raw stream ([io.Reader]): data is copied into the raw stream returned by
+    [ExecCommand.ReturnRawStream], the type of the stream is "Unknown".
+
+ReturnEvalResult blocks until the result stream has been forwarded.
+*/
+func (ec *ExecCommand) ReturnEvalResult(ctx context.Context, result any) error {
+	switch r := result.(type) {
+	case nil:
+		return nil
+	case Value:
+		return ec.ReturnValue(ctx, r)
+	case <-chan Value:
+		out, err := ec.ReturnListStream(ctx)
+		if err != nil {
+			return fmt.Errorf("opening output stream: %w", err)
+		}
+		defer close(out)
+		for {
+			select {
+			case v, ok := <-r:
+				if !ok {
+					return nil
+				}
+				select {
+				case out <- v:
+				case <-ctx.Done():
+					return context.Cause(ctx)
+				}
+			case <-ctx.Done():
+				return context.Cause(ctx)
+			}
+		}
+	case io.Reader:
+		out, err := ec.ReturnRawStream(ctx)
+		if err != nil {
+			return fmt.Errorf("opening output stream: %w", err)
+		}
+		if _, err := io.Copy(out, ctxReader{ctx: ctx, r: r}); err != nil {
+			out.Close()
+			return fmt.Errorf("forwarding raw stream: %w", err)
+		}
+		return out.Close()
+	default:
+		return fmt.Errorf("unsupported result type %T", result)
+	}
+}
+
+/*
+WaitStreamClosed blocks until the consumer has acknowledged the end of the
+command's output stream (opened with [ExecCommand.ReturnListStream] or
+[ExecCommand.ReturnRawStream]), ie the engine has fully consumed the output.
+This is useful when command has to do cleanup which must happen only after
+the output has been consumed (ie delete the file the output was read from).
+
+The End message is sent only after all the data has been sent, so the output
+stream should be closed (data chan closed or Writer closed) before calling
+WaitStreamClosed, otherwise it blocks until it is closed by another goroutine or
+ctx is cancelled.
+
+Error is returned when command's response is not a stream.
+*/
+func (ec *ExecCommand) WaitStreamClosed(ctx context.Context) error {
+	var eh *endHandshake
+	var out closeCtx
+	var done <-chan struct{}
+	switch s := ec.output.Load().(type) {
+	case *rawStreamOut:
+		eh, out, done = &s.endHandshake, s, s.done
+	case *listStreamOut:
+		eh, out, done = &s.endHandshake, s, s.done
+	default:
+		return fmt.Errorf("response is not a stream")
+	}
+
+	// close blocks until all the data has been sent, wait for it here so
+	// that ctx is respected.
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+	if err := out.close(ctx); err != nil {
+		return fmt.Errorf("closing output stream: %w", err)
+	}
+	return eh.waitDrop(ctx)
+}
+
 /*
 if response haven't been sent then send Empty
 */
@@ -189,6 +593,9 @@ func (ec *ExecCommand) startResponseStream(ctx context.Context, out outputStream
 
 func (ec *ExecCommand) closeOutputStream(ctx context.Context) {
 	out := ec.output.Load()
+	if ls, ok := out.(*listStreamOut); ok && ls.listSender != nil {
+		ls.listSender.Close()
+	}
 	if closer, ok := out.(closeCtx); ok {
 		closer.close(ctx)
 	}
@@ -203,13 +610,51 @@ type (
 		bufSize  uint
 		dataType string // the expected type of the stream
 		md       pipelineMetadata
+		validate bool // validate that data written into the stream is UTF-8
+		framed   bool // send each write as separate Data message
 		//span     Span
 	}
 	rawStreamOpt struct{ fn func(*rawStreamCfg) }
+
+	/*
+		MetadataOption sets pipeline metadata of the command's response.
+		MetadataOption is also RawStreamOption and ListStreamOption, ie it
+		can be used with [ExecCommand.ReturnRawStream] and
+		[ExecCommand.ReturnListStream].
+	*/
+	MetadataOption interface {
+		RawStreamOption
+		ListStreamOption
+		applyMetadata(*pipelineMetadata)
+	}
+
+	metadataOpt struct{ fn func(*pipelineMetadata) }
+
+	/*
+		ListStreamOption configures the output stream returned by
+		[ExecCommand.ReturnListStream].
+	*/
+	ListStreamOption interface {
+		applyList(*listStreamCfg)
+	}
+
+	listStreamCfg struct {
+		window uint // how many Data messages may be waiting for Ack
+		md     pipelineMetadata
+	}
+	listStreamOpt struct{ fn func(*listStreamCfg) }
 )
 
+func (opt listStreamOpt) applyList(cfg *listStreamCfg) { opt.fn(cfg) }
+
 func (opt rawStreamOpt) apply(cfg *rawStreamCfg) { opt.fn(cfg) }
 
+func (opt metadataOpt) apply(cfg *rawStreamCfg) { opt.fn(&cfg.md) }
+
+func (opt metadataOpt) applyList(cfg *listStreamCfg) { opt.fn(&cfg.md) }
+
+func (opt metadataOpt) applyMetadata(md *pipelineMetadata) { opt.fn(md) }
+
 /*
 BufferSize allows to hint the desired buffer size (but it is not guaranteed
 that buffer will be exactly that big).
@@ -219,6 +664,29 @@ func BufferSize(size uint) RawStreamOption {
 	return rawStreamOpt{fn: func(rc *rawStreamCfg) { rc.bufSize = max(size, 512) }}
 }
 
+/*
+Framed makes each Write into the raw stream to be sent to the consumer as
+separate Data message, ie write boundaries are preserved (writes are not
+collected into buffer and big writes are not split, [BufferSize] is ignored).
+Empty writes are not sent. Meant for binary streams, in combination with
+[StringStreamValidated] incomplete UTF-8 sequence at the end of the write is
+sent with the next write.
+*/
+func Framed() RawStreamOption {
+	return rawStreamOpt{fn: func(rc *rawStreamCfg) { rc.framed = true }}
+}
+
+/*
+ListStreamWindow allows up to size Values to be sent to the consumer without
+waiting for the Ack of the previously sent Value. By default every Value must
+be acknowledged before the next one is sent (window size 1). Bigger window
+improves throughput at the cost of having more Values "in flight". Size 0
+is treated as 1.
+*/
+func ListStreamWindow(size uint) ListStreamOption {
+	return listStreamOpt{fn: func(cfg *listStreamCfg) { cfg.window = max(size, 1) }}
+}
+
 /*
 BinaryStream indicates that the stream contains binary data of unknown encoding,
 and should be treated as a binary value. See also [StringStream].
@@ -235,19 +703,68 @@ func StringStream() RawStreamOption {
 	return rawStreamOpt{fn: func(rc *rawStreamCfg) { rc.dataType = "String" }}
 }
 
+/*
+StringStreamValidated is like [StringStream] but additionally validates that
+the data written into the stream is valid UTF-8. Write containing invalid
+UTF-8 returns error (and nothing of that write is sent to the consumer).
+Multi-byte characters may be split between writes.
+
+Use [strings.ToValidUTF8] to replace invalid sequences when lossy conversion
+is acceptable.
+*/
+func StringStreamValidated() RawStreamOption {
+	return rawStreamOpt{fn: func(rc *rawStreamCfg) {
+		rc.dataType = "String"
+		rc.validate = true
+	}}
+}
+
 /*
 FilePath sets the stream metadata to "DataSource = FilePath" with given file name.
 The "content type" field of the metadata is set based on the file's extension
 using system mime type registry.
 */
-func FilePath(fileName string) RawStreamOption {
-	return rawStreamOpt{fn: func(rc *rawStreamCfg) {
-		rc.md.FilePath = fileName
-		rc.md.DataSource = "FilePath"
-		rc.md.ContentType = mime.TypeByExtension(filepath.Ext(fileName))
+func FilePath(fileName string) MetadataOption {
+	return metadataOpt{fn: func(md *pipelineMetadata) {
+		md.FilePath = fileName
+		md.DataSource = "FilePath"
+		md.ContentType = mime.TypeByExtension(filepath.Ext(fileName))
+	}}
+}
+
+/*
+ContentType sets the "content type" field of the stream metadata to given
+mime type, ie "application/json". Use it when the stream's content type can't
+be derived from the file name (see [FilePath]).
+*/
+func ContentType(mime string) MetadataOption {
+	return metadataOpt{fn: func(md *pipelineMetadata) {
+		md.ContentType = mime
+		if md.DataSource == "" {
+			md.DataSource = "None"
+		}
 	}}
 }
 
+/*
+responseHolder holds the response of the command. Unlike atomic.Value it
+allows values of different types to be stored (atomic.Value panics when
+value of different type than the stored one is swapped in).
+*/
+type responseHolder struct{ p atomic.Pointer[any] }
+
+func (rh *responseHolder) Load() any {
+	if v := rh.p.Load(); v != nil {
+		return *v
+	}
+	return nil
+}
+
+func (rh *responseHolder) Store(v any) { rh.p.Store(&v) }
+
+// setOnce stores v when there is no value stored yet, returns true on success.
+func (rh *responseHolder) setOnce(v any) bool { return rh.p.CompareAndSwap(nil, &v) }
+
 type commandsInFlight struct {
 	runs []*ExecCommand
 	m    sync.Mutex
@@ -299,3 +816,66 @@ func (cf *commandsInFlight) CancelAndWait(cause error) {
 	// should have some timeout for the wait? ctx as param?
 	cf.wg.Wait()
 }
+
+/*
+utf8Writer rejects writes which are not valid UTF-8. Incomplete sequence
+at the end of the write is held back until the next write completes it.
+*/
+type utf8Writer struct {
+	w       io.WriteCloser
+	partial []byte // incomplete UTF-8 sequence at the end of the last write
+	offset  int    // count of bytes written to w
+}
+
+func (uw *utf8Writer) Write(p []byte) (int, error) {
+	buf := p
+	if len(uw.partial) > 0 {
+		buf = append(uw.partial, p...)
+	}
+	valid := buf[:len(buf)-incompleteUTF8Tail(buf)]
+	if !utf8.Valid(valid) {
+		for i := 0; i < len(valid); {
+			r, size := utf8.DecodeRune(valid[i:])
+			if r == utf8.RuneError && size == 1 {
+				return 0, fmt.Errorf("invalid UTF-8 at stream offset %d", uw.offset+i)
+			}
+			i += size
+		}
+	}
+
+	if _, err := uw.w.Write(valid); err != nil {
+		return 0, err
+	}
+	uw.offset += len(valid)
+	uw.partial = append(uw.partial[:0], buf[len(valid):]...)
+	return len(p), nil
+}
+
+func (uw *utf8Writer) Close() error {
+	if len(uw.partial) > 0 {
+		err := fmt.Errorf("incomplete UTF-8 sequence at the end of the stream (offset %d)", uw.offset)
+		if pw, ok := uw.w.(interface{ CloseWithError(error) error }); ok {
+			pw.CloseWithError(err)
+		} else {
+			uw.w.Close()
+		}
+		return err
+	}
+	return uw.w.Close()
+}
+
+/*
+incompleteUTF8Tail returns the length of the (possibly) incomplete UTF-8
+sequence at the end of buf.
+*/
+func incompleteUTF8Tail(buf []byte) int {
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(buf); i++ {
+		if utf8.RuneStart(buf[len(buf)-i]) {
+			if utf8.FullRune(buf[len(buf)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,1404 @@
+package nu
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/ainvaltin/nu-plugin/syntaxshape"
+	"github.com/ainvaltin/nu-plugin/types"
+)
+
+func Test_ExecCommand_PositionalOrDefault(t *testing.T) {
+	p := &Plugin{cmds: map[string]*Command{
+		"cmd": {
+			Signature: PluginSignature{
+				Name: "cmd",
+				RequiredPositional: PositionalArgs{
+					{Name: "first"},
+				},
+				OptionalPositional: PositionalArgs{
+					{Name: "second", Default: &Value{Value: "default"}},
+					{Name: "third"},
+				},
+			},
+		},
+	}}
+
+	t.Run("all arguments supplied", func(t *testing.T) {
+		ec := &ExecCommand{p: p, Name: "cmd", Positional: []Value{{Value: 1}, {Value: "two"}, {Value: 3}}}
+		for x, v := range []Value{{Value: 1}, {Value: "two"}, {Value: 3}} {
+			if diff := cmp.Diff(v, ec.PositionalOrDefault(x)); diff != "" {
+				t.Errorf("[%d] mismatch (-want +got):\n%s", x, diff)
+			}
+		}
+	})
+
+	t.Run("optional arguments omitted", func(t *testing.T) {
+		ec := &ExecCommand{p: p, Name: "cmd", Positional: []Value{{Value: 1}}}
+		if diff := cmp.Diff(Value{Value: 1}, ec.PositionalOrDefault(0)); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+		// has default value in the signature
+		if diff := cmp.Diff(Value{Value: "default"}, ec.PositionalOrDefault(1)); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+		// no default value in the signature
+		if diff := cmp.Diff(Value{}, ec.PositionalOrDefault(2)); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid index", func(t *testing.T) {
+		ec := &ExecCommand{p: p, Name: "cmd", Positional: []Value{{Value: 1}}}
+		for _, idx := range []int{-1, 3, 10} {
+			if diff := cmp.Diff(Value{}, ec.PositionalOrDefault(idx)); diff != "" {
+				t.Errorf("[%d] mismatch (-want +got):\n%s", idx, diff)
+			}
+		}
+	})
+}
+
+func Test_ExecCommand_ListArg(t *testing.T) {
+	var got []Value
+	var gotErr error
+	p, err := New(
+		[]*Command{{
+			Signature: PluginSignature{
+				Name:               "foo",
+				Category:           "Experimental",
+				Desc:               "test cmd",
+				SearchTerms:        []string{"foo"},
+				InputOutputTypes:   []InOutTypes{{types.Nothing(), types.Nothing()}},
+				RequiredPositional: PositionalArgs{{Name: "items", Shape: syntaxshape.List(syntaxshape.Any())}},
+				OptionalPositional: PositionalArgs{{Name: "more", Shape: syntaxshape.Any()}},
+			},
+			OnRun: func(ctx context.Context, exec *ExecCommand) error {
+				got, gotErr = exec.ListArg(0)
+				if gotErr != nil {
+					return nil
+				}
+				_, gotErr = exec.ListArg(1)
+				return nil
+			},
+		}},
+		"0.0.1",
+		&Config{Logger: logger(t)},
+	)
+	if err != nil {
+		t.Fatal("creating plugin:", err)
+	}
+
+	items := []Value{{Value: int64(1), Span: Span{Start: 5, End: 6}}, {Value: "two", Span: Span{Start: 7, End: 12}}}
+	runEngine(t, p, append(protocolPrelude,
+		msgDef{send: &call{ID: 1, Call: run{Name: "foo", Call: evaluatedCall{
+			Head:       Span{Start: 0, End: 3},
+			Positional: []Value{{Value: items, Span: Span{Start: 4, End: 13}}, {Value: "bar", Span: Span{Start: 14, End: 19}}},
+		}}}},
+		msgDef{recv: callResponse{ID: 1, Response: pipelineData{empty{}}}},
+	))
+	if diff := cmp.Diff(items, got); diff != "" {
+		t.Errorf("list items mismatch (-want +got):\n%s", diff)
+	}
+	expectErrorMsg(t, gotErr, `invalid positional argument [1]`)
+	var le *LabeledError
+	if !errors.As(gotErr, &le) {
+		t.Fatalf("expected LabeledError, got %T", gotErr)
+	}
+	if diff := cmp.Diff([]ErrorLabel{{Text: "expected list, got string", Span: Span{Start: 14, End: 19}}}, le.Labels); diff != "" {
+		t.Errorf("labels mismatch (-want +got):\n%s", diff)
+	}
+
+	// optional argument not provided
+	ec := &ExecCommand{p: p, Name: "foo", Positional: []Value{{Value: items}}}
+	if lst, err := ec.ListArg(1); err != nil || lst != nil {
+		t.Errorf("expected nil list and no error, got %v, %v", lst, err)
+	}
+}
+
+func Test_ExecCommand_OutputTypes(t *testing.T) {
+	iot := []InOutTypes{{types.Int(), types.String()}, {types.List(types.Int()), types.List(types.String())}}
+	var got []InOutTypes
+	p, err := New(
+		[]*Command{{
+			Signature: PluginSignature{
+				Name:             "foo",
+				Category:         "Experimental",
+				Desc:             "test cmd",
+				SearchTerms:      []string{"foo"},
+				InputOutputTypes: iot,
+			},
+			OnRun: func(ctx context.Context, exec *ExecCommand) error {
+				got = exec.OutputTypes()
+				// modifying the returned slice must not change the signature
+				got[0].Out = types.Nothing()
+				got = exec.OutputTypes()
+				return nil
+			},
+		}},
+		"0.0.1",
+		&Config{Logger: logger(t)},
+	)
+	if err != nil {
+		t.Fatal("creating plugin:", err)
+	}
+
+	runEngine(t, p, append(protocolPrelude,
+		msgDef{send: &call{ID: 1, Call: run{Name: "foo"}}},
+		msgDef{recv: callResponse{ID: 1, Response: pipelineData{empty{}}}},
+	))
+
+	if diff := cmp.Diff(iot, got, cmp.Comparer(func(a, b types.Type) bool { return a.String() == b.String() })); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_ExecCommand_FlagEnum(t *testing.T) {
+	p := &Plugin{cmds: map[string]*Command{
+		"cmd": {
+			Signature: PluginSignature{
+				Name: "cmd",
+				Named: Flags{
+					{Long: "as", Shape: syntaxshape.String(), Default: &Value{Value: "json"}},
+					{Long: "bad", Shape: syntaxshape.String(), Default: &Value{Value: "xml"}},
+					{Long: "none", Shape: syntaxshape.String()},
+				},
+			},
+		},
+	}}
+	allowed := []string{"json", "csv"}
+	head := Span{Start: 1, End: 4}
+	flagSpan := Span{Start: 10, End: 15}
+
+	t.Run("valid", func(t *testing.T) {
+		ec := &ExecCommand{p: p, Name: "cmd", Head: head, Named: NamedParams{"as": {Value: "csv", Span: flagSpan}}}
+		s, err := ec.FlagEnum("as", allowed)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if s != "csv" {
+			t.Errorf("expected csv, got %q", s)
+		}
+	})
+
+	t.Run("default", func(t *testing.T) {
+		ec := &ExecCommand{p: p, Name: "cmd", Head: head}
+		s, err := ec.FlagEnum("as", allowed)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if s != "json" {
+			t.Errorf("expected json, got %q", s)
+		}
+
+		if s, err = ec.FlagEnum("none", allowed); err != nil || s != "" {
+			t.Errorf("expected empty string and no error, got %q, %v", s, err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		ec := &ExecCommand{p: p, Name: "cmd", Head: head, Named: NamedParams{"as": {Value: "yaml", Span: flagSpan}, "none": {Value: int64(1), Span: flagSpan}}}
+		testCases := []struct {
+			name string
+			err  *LabeledError
+		}{
+			{
+				name: "as",
+				err:  &LabeledError{Msg: "invalid value of the flag --as", Labels: []ErrorLabel{{Text: `expected one of json, csv, got "yaml"`, Span: flagSpan}}},
+			},
+			{
+				name: "bad",
+				err:  &LabeledError{Msg: "invalid value of the flag --bad", Labels: []ErrorLabel{{Text: `expected one of json, csv, got "xml"`, Span: head}}},
+			},
+			{
+				name: "none",
+				err:  &LabeledError{Msg: "invalid value of the flag --none", Labels: []ErrorLabel{{Text: `expected string, got int`, Span: flagSpan}}},
+			},
+		}
+		for _, tc := range testCases {
+			s, err := ec.FlagEnum(tc.name, allowed)
+			if s != "" {
+				t.Errorf("expected empty string, got %q", s)
+			}
+			var le *LabeledError
+			if !errors.As(err, &le) {
+				t.Fatalf("expected LabeledError, got %T (%v)", err, err)
+			}
+			if diff := cmp.Diff(tc.err, le); diff != "" {
+				t.Errorf("[%s] mismatch (-want +got):\n%s", tc.name, diff)
+			}
+		}
+	})
+}
+
+func Test_ExecCommand_ReturnValueWithMetadata(t *testing.T) {
+	out := &bytes.Buffer{}
+	ec := &ExecCommand{p: &Plugin{out: out, log: logger(t)}, callID: 3}
+	v := Value{Value: "<b>foo</b>", Span: Span{Start: 1, End: 5}}
+	if err := ec.ReturnValueWithMetadata(context.Background(), v, FilePath("foo.html")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// CallResponse: [ID, {PipelineData: {Value: [Value, Metadata]}}]
+	dec := msgpack.NewDecoder(out)
+	if name, err := decodeWrapperMap(dec); err != nil || name != "CallResponse" {
+		t.Fatalf("expected CallResponse, got %q (error: %v)", name, err)
+	}
+	if id, err := decodeTupleStart(dec); err != nil || id != 3 {
+		t.Fatalf("expected call ID 3, got %d (error: %v)", id, err)
+	}
+	for _, key := range []string{"PipelineData", "Value"} {
+		if name, err := decodeWrapperMap(dec); err != nil || name != key {
+			t.Fatalf("expected %s, got %q (error: %v)", key, name, err)
+		}
+	}
+	pv := pipelineValue{}
+	if err := pv.DecodeMsgpack(dec); err != nil {
+		t.Fatalf("decoding PipelineDataHeader Value: %v", err)
+	}
+	expect := pipelineValue{V: v, M: pipelineMetadata{DataSource: "FilePath", FilePath: "foo.html", ContentType: "text/html; charset=utf-8"}}
+	if diff := cmp.Diff(expect, pv); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := ec.ReturnValueWithMetadata(context.Background(), v); err == nil {
+		t.Error("expected error when sending second response")
+	}
+}
+
+func Test_ExecCommand_concurrent_engine_calls(t *testing.T) {
+	p := &Plugin{engc: make(map[int]chan any), log: logger(t)}
+	// engine responds to GetEnvVar call with the name of the variable
+	p.out = writerFunc(func(b []byte) (int, error) {
+		var msg struct {
+			EngineCall struct {
+				ID   int               `msgpack:"id"`
+				Call map[string]string `msgpack:"call"`
+			}
+		}
+		if err := msgpack.Unmarshal(b, &msg); err != nil {
+			return 0, err
+		}
+		name := msg.EngineCall.Call["GetEnvVar"]
+		ecr := engineCallResponse{ID: msg.EngineCall.ID, Response: pipelineData{Data: Value{Value: name}}}
+		return len(b), p.handleEngineCallResponse(context.Background(), ecr)
+	})
+	ec := &ExecCommand{p: p, callID: 1}
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("var%d", i)
+			v, err := ec.GetEnvVar(context.Background(), name)
+			if err != nil {
+				t.Errorf("GetEnvVar(%s): %v", name, err)
+				return
+			}
+			if v == nil || v.Value != name {
+				t.Errorf("expected %q, got %v", name, v)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(p.engc) != 0 {
+		t.Errorf("expected no in-flight engine calls, got %d", len(p.engc))
+	}
+}
+
+func Test_ExecCommand_engine_call_retry(t *testing.T) {
+	// engine stub which fails to send the first engine call and responds
+	// to the GetEnvVar call with the name of the variable
+	createPlugin := func(t *testing.T, retries int, resp func(name string) any) (*Plugin, *int) {
+		p := &Plugin{engc: make(map[int]chan any), log: logger(t), engineCallRetries: retries}
+		calls := 0
+		p.out = writerFunc(func(b []byte) (int, error) {
+			if calls++; calls == 1 {
+				return 0, errors.New("transient failure")
+			}
+			var msg struct {
+				EngineCall struct {
+					ID   int               `msgpack:"id"`
+					Call map[string]string `msgpack:"call"`
+				}
+			}
+			if err := msgpack.Unmarshal(b, &msg); err != nil {
+				return 0, err
+			}
+			ecr := engineCallResponse{ID: msg.EngineCall.ID, Response: resp(msg.EngineCall.Call["GetEnvVar"])}
+			return len(b), p.handleEngineCallResponse(context.Background(), ecr)
+		})
+		return p, &calls
+	}
+
+	t.Run("retry succeeds", func(t *testing.T) {
+		p, calls := createPlugin(t, 1, func(name string) any { return pipelineData{Data: Value{Value: name}} })
+		ec := &ExecCommand{p: p, callID: 1}
+		v, err := ec.GetEnvVar(context.Background(), "foo")
+		if err != nil {
+			t.Fatalf("GetEnvVar: %v", err)
+		}
+		if v == nil || v.Value != "foo" {
+			t.Errorf("expected \"foo\", got %v", v)
+		}
+		if *calls != 2 {
+			t.Errorf("expected 2 attempts, got %d", *calls)
+		}
+	})
+
+	t.Run("retries disabled", func(t *testing.T) {
+		p, calls := createPlugin(t, 0, func(name string) any { return pipelineData{Data: Value{Value: name}} })
+		ec := &ExecCommand{p: p, callID: 1}
+		_, err := ec.GetEnvVar(context.Background(), "foo")
+		expectErrorMsg(t, err, `engine call: sending engine call: writing to output: transient failure`)
+		if *calls != 1 {
+			t.Errorf("expected single attempt, got %d", *calls)
+		}
+	})
+
+	t.Run("error response is not retried", func(t *testing.T) {
+		p, calls := createPlugin(t, 3, func(name string) any { return LabeledError{Msg: "no " + name} })
+		ec := &ExecCommand{p: p, callID: 1}
+		_, err := ec.GetEnvVar(context.Background(), "foo")
+		expectErrorMsg(t, err, `no foo`)
+		if *calls != 2 {
+			t.Errorf("expected 2 attempts, got %d", *calls)
+		}
+	})
+
+	t.Run("partial write is not retried", func(t *testing.T) {
+		p := &Plugin{engc: make(map[int]chan any), log: logger(t), engineCallRetries: 3}
+		calls := 0
+		p.out = writerFunc(func(b []byte) (int, error) {
+			calls++
+			return 1, errors.New("broken pipe")
+		})
+		ec := &ExecCommand{p: p, callID: 1}
+		_, err := ec.GetEnvVar(context.Background(), "foo")
+		expectErrorMsg(t, err, `engine call: sending engine call: writing to output: broken pipe`)
+		if calls != 1 {
+			t.Errorf("expected single attempt, got %d", calls)
+		}
+	})
+
+	t.Run("not idempotent", func(t *testing.T) {
+		p, calls := createPlugin(t, 3, func(name string) any { return pipelineData{Data: Value{Value: "/"}} })
+		ec := &ExecCommand{p: p, callID: 1}
+		_, err := ec.GetCurrentDir(context.Background())
+		expectErrorMsg(t, err, `engine call: sending engine call: writing to output: transient failure`)
+		if *calls != 1 {
+			t.Errorf("expected single attempt, got %d", *calls)
+		}
+	})
+}
+
+func Test_ExecCommand_GetCurrentDir(t *testing.T) {
+	p := &Plugin{engc: make(map[int]chan any), log: logger(t)}
+	calls := 0
+	p.out = writerFunc(func(b []byte) (int, error) {
+		var msg struct {
+			EngineCall struct {
+				ID   int    `msgpack:"id"`
+				Call string `msgpack:"call"`
+			}
+		}
+		if err := msgpack.Unmarshal(b, &msg); err != nil {
+			return 0, err
+		}
+		if msg.EngineCall.Call != "GetCurrentDir" {
+			return 0, fmt.Errorf("unexpected engine call %q", msg.EngineCall.Call)
+		}
+		calls++
+		ecr := engineCallResponse{ID: msg.EngineCall.ID, Response: pipelineData{Data: Value{Value: fmt.Sprintf("/dir/%d", calls)}}}
+		return len(b), p.handleEngineCallResponse(context.Background(), ecr)
+	})
+	ec := &ExecCommand{p: p, callID: 1}
+
+	for range 2 {
+		dir, err := ec.GetCurrentDir(context.Background())
+		if err != nil {
+			t.Fatalf("GetCurrentDir: %v", err)
+		}
+		if dir != "/dir/1" {
+			t.Errorf("expected /dir/1, got %q", dir)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected single engine call, got %d", calls)
+	}
+
+	dir, err := ec.RefreshCurrentDir(context.Background())
+	if err != nil {
+		t.Fatalf("RefreshCurrentDir: %v", err)
+	}
+	if dir != "/dir/2" {
+		t.Errorf("expected /dir/2, got %q", dir)
+	}
+	if dir, _ := ec.GetCurrentDir(context.Background()); dir != "/dir/2" {
+		t.Errorf("expected cached /dir/2, got %q", dir)
+	}
+	if calls != 2 {
+		t.Errorf("expected two engine calls, got %d", calls)
+	}
+}
+
+func Test_ExecCommand_EvalClosure_ReSpan(t *testing.T) {
+	closureSpan := Span{Start: 100, End: 110}
+	result := func() Value {
+		return Value{
+			Value: []Value{
+				{Value: 1, Span: closureSpan},
+				{Value: Record{"a": {Value: "b", Span: closureSpan}}, Span: closureSpan},
+			},
+			Span: closureSpan,
+		}
+	}
+
+	newExec := func(t *testing.T) *ExecCommand {
+		p := &Plugin{engc: make(map[int]chan any), log: logger(t)}
+		p.out = writerFunc(func(b []byte) (int, error) {
+			var msg struct {
+				EngineCall struct {
+					ID int `msgpack:"id"`
+				}
+			}
+			if err := msgpack.Unmarshal(b, &msg); err != nil {
+				return 0, err
+			}
+			ecr := engineCallResponse{ID: msg.EngineCall.ID, Response: pipelineData{Data: result()}}
+			return len(b), p.handleEngineCallResponse(context.Background(), ecr)
+		})
+		return &ExecCommand{p: p, callID: 1, Head: Span{Start: 1, End: 5}}
+	}
+	closure := Value{Value: Closure{BlockID: 1}}
+
+	t.Run("without ReSpan", func(t *testing.T) {
+		v, err := newExec(t).EvalClosure(context.Background(), closure)
+		if err != nil {
+			t.Fatalf("EvalClosure: %v", err)
+		}
+		if diff := cmp.Diff(result(), v); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("with ReSpan", func(t *testing.T) {
+		ec := newExec(t)
+		v, err := ec.EvalClosure(context.Background(), closure, ReSpan(ec.Head))
+		if err != nil {
+			t.Fatalf("EvalClosure: %v", err)
+		}
+		expect := Value{
+			Value: []Value{
+				{Value: 1, Span: ec.Head},
+				{Value: Record{"a": {Value: "b", Span: ec.Head}}, Span: ec.Head},
+			},
+			Span: ec.Head,
+		}
+		if diff := cmp.Diff(expect, v); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func Test_ExecCommand_AddEnvVar_after_response(t *testing.T) {
+	out := &bytes.Buffer{}
+	ec := &ExecCommand{p: &Plugin{out: out, log: logger(t), engc: make(map[int]chan any)}, callID: 1}
+	if ec.Responded() {
+		t.Error("expected Responded to be false before response is sent")
+	}
+	if err := ec.ReturnValue(context.Background(), Value{Value: 1}); err != nil {
+		t.Fatalf("sending response: %v", err)
+	}
+	if !ec.Responded() {
+		t.Error("expected Responded to be true after response is sent")
+	}
+
+	n := out.Len()
+	err := ec.AddEnvVar(context.Background(), "FOO", Value{Value: "bar"})
+	if !errors.Is(err, ErrResponseSent) {
+		t.Errorf("expected ErrResponseSent, got %v", err)
+	}
+	expectErrorMsg(t, err, `AddEnvVar "FOO" must be called before the response is sent: response has been already sent`)
+	if out.Len() != n {
+		t.Error("engine call was sent after the response")
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (wf writerFunc) Write(b []byte) (int, error) { return wf(b) }
+
+func Test_ExecCommand_WaitStreamClosed(t *testing.T) {
+	t.Run("response is not a stream", func(t *testing.T) {
+		ec := &ExecCommand{}
+		expectErrorMsg(t, ec.WaitStreamClosed(context.Background()), `response is not a stream`)
+	})
+
+	t.Run("blocks until Drop", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		sent := make(chan any, 1)
+		out := newOutputListValue(&Plugin{})
+		out.sender = func(ctx context.Context, data any) error { sent <- data; return nil }
+		out.onDrop = func() { t.Error("unexpected onDrop call") }
+		ec := &ExecCommand{}
+		ec.output.Store(out)
+
+		go out.run(ctx)
+		close(out.data)
+
+		waitDone := make(chan error, 1)
+		go func() { waitDone <- ec.WaitStreamClosed(ctx) }()
+
+		select {
+		case msg := <-sent:
+			if diff := cmp.Diff(end{ID: out.id}, msg); diff != "" {
+				t.Errorf("unexpected message (-want +got):\n%s", diff)
+			}
+		case <-ctx.Done():
+			t.Fatal("End message wasn't sent")
+		}
+
+		select {
+		case err := <-waitDone:
+			t.Fatalf("WaitStreamClosed returned before Drop: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		out.drop()
+		select {
+		case err := <-waitDone:
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		case <-ctx.Done():
+			t.Fatal("WaitStreamClosed didn't return after Drop")
+		}
+
+		// closing stream again must not send second End
+		if err := out.close(ctx); err != nil {
+			t.Errorf("closing stream again: %v", err)
+		}
+		select {
+		case msg := <-sent:
+			t.Errorf("unexpected message %#v", msg)
+		default:
+		}
+	})
+
+	t.Run("ctx cancelled while stream is open", func(t *testing.T) {
+		out := newOutputListValue(&Plugin{})
+		out.sender = func(ctx context.Context, data any) error {
+			t.Errorf("unexpected message %#v", data)
+			return nil
+		}
+		ec := &ExecCommand{}
+		ec.output.Store(out)
+
+		ctx, cancel := context.WithCancelCause(context.Background())
+		errStop := errors.New("stop waiting")
+		cancel(errStop)
+		if err := ec.WaitStreamClosed(ctx); !errors.Is(err, errStop) {
+			t.Errorf("expected %v, got %v", errStop, err)
+		}
+	})
+
+	t.Run("Drop before End cancels command", func(t *testing.T) {
+		out := initOutputListRaw(1)
+		dropped := false
+		out.onDrop = func() { dropped = true }
+		out.drop()
+		if !dropped {
+			t.Error("expected onDrop to be called")
+		}
+	})
+}
+
+func Test_utf8Writer(t *testing.T) {
+	t.Run("valid input", func(t *testing.T) {
+		out := &bufCloser{}
+		w := &utf8Writer{w: out}
+		// "€" is 3 bytes, split it between writes
+		for _, s := range []string{"a\xe2", "\x82", "\xacb", "", "ü"} {
+			if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+				t.Fatalf("Write(%q) = %d, %v", s, n, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("unexpected Close error: %v", err)
+		}
+		if s := out.String(); s != "a€bü" {
+			t.Errorf("expected %q, got %q", "a€bü", s)
+		}
+	})
+
+	t.Run("invalid input", func(t *testing.T) {
+		out := &bufCloser{}
+		w := &utf8Writer{w: out}
+		if _, err := w.Write([]byte("abc")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		n, err := w.Write([]byte("d\xffe"))
+		expectErrorMsg(t, err, `invalid UTF-8 at stream offset 4`)
+		if n != 0 {
+			t.Errorf("expected 0 bytes written, got %d", n)
+		}
+		if s := out.String(); s != "abc" {
+			t.Errorf("expected %q, got %q", "abc", s)
+		}
+	})
+
+	t.Run("incomplete sequence at the end", func(t *testing.T) {
+		out := &bufCloser{}
+		w := &utf8Writer{w: out}
+		if _, err := w.Write([]byte("ab\xe2\x82")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expectErrorMsg(t, w.Close(), `incomplete UTF-8 sequence at the end of the stream (offset 2)`)
+		if !out.closed {
+			t.Error("expected underlying writer to be closed")
+		}
+	})
+
+	t.Run("stream option", func(t *testing.T) {
+		out := initOutputListRaw(1, StringStreamValidated())
+		if out.cfg.dataType != "String" {
+			t.Errorf("expected stream type String, got %q", out.cfg.dataType)
+		}
+		if _, ok := out.data.(*utf8Writer); !ok {
+			t.Errorf("expected data writer to be utf8Writer, got %T", out.data)
+		}
+	})
+}
+
+type bufCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (bc *bufCloser) Close() error {
+	bc.closed = true
+	return nil
+}
+
+func Test_ExecCommand_dropStream(t *testing.T) {
+	newPlugin := func(t *testing.T, onRun func(context.Context, *ExecCommand) error) *Plugin {
+		p, err := New(
+			[]*Command{{
+				Signature: PluginSignature{
+					Name:             "producer",
+					Category:         "Experimental",
+					Desc:             "test cmd",
+					SearchTerms:      []string{"producer"},
+					InputOutputTypes: []InOutTypes{{In: types.Nothing(), Out: types.Any()}},
+				},
+				OnRun: onRun,
+			}},
+			"",
+			&Config{Logger: logger(t)},
+		)
+		if err != nil {
+			t.Fatalf("creating plugin: %v", err)
+		}
+		return p
+	}
+
+	t.Run("list stream", func(t *testing.T) {
+		cause := make(chan error, 1)
+		p := newPlugin(t, func(ctx context.Context, exec *ExecCommand) error {
+			out, err := exec.ReturnListStream(ctx)
+			if err != nil {
+				return err
+			}
+			defer close(out)
+			for i := 0; ; i++ {
+				select {
+				case out <- Value{Value: i}:
+				case <-ctx.Done():
+					cause <- context.Cause(ctx)
+					return nil
+				}
+			}
+		})
+
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "producer"}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: listStream{ID: 1}}}},
+			msgDef{recv: data{ID: 1, Data: Value{Value: int64(0)}}},
+			msgDef{send: &drop{ID: 1}},
+			msgDef{recv: end{ID: 1}},
+		))
+
+		if err := <-cause; !errors.Is(err, ErrDropStream) {
+			t.Errorf("expected context cause to be ErrDropStream, got %v", err)
+		}
+	})
+
+	t.Run("immediate drop", func(t *testing.T) {
+		// consumer drops the stream before any value has been computed,
+		// handler must see the cancellation before doing the work
+		cause := make(chan error, 1)
+		p := newPlugin(t, func(ctx context.Context, exec *ExecCommand) error {
+			out, err := exec.ReturnListStream(ctx)
+			if err != nil {
+				return err
+			}
+			defer close(out)
+			select {
+			case <-ctx.Done():
+				cause <- context.Cause(ctx)
+			case <-time.After(5 * time.Second):
+				cause <- errors.New("context was not cancelled")
+			}
+			return nil
+		})
+
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "producer"}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: listStream{ID: 1}}}},
+			msgDef{send: &drop{ID: 1}},
+			msgDef{recv: end{ID: 1}},
+		))
+
+		if err := <-cause; !errors.Is(err, ErrDropStream) {
+			t.Errorf("expected context cause to be ErrDropStream, got %v", err)
+		}
+	})
+
+	t.Run("raw stream", func(t *testing.T) {
+		cause := make(chan error, 2)
+		p := newPlugin(t, func(ctx context.Context, exec *ExecCommand) error {
+			out, err := exec.ReturnRawStream(ctx, BufferSize(512))
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+			if _, err := out.Write(bytes.Repeat([]byte{'a'}, 512)); err != nil {
+				return err
+			}
+			<-ctx.Done()
+			cause <- context.Cause(ctx)
+			_, err = out.Write([]byte("more"))
+			cause <- err
+			return nil
+		})
+
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "producer"}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: byteStream{ID: 1, Type: "Unknown"}}}},
+			msgDef{recv: data{ID: 1, Data: bytes.Repeat([]byte{'a'}, 512)}},
+			msgDef{send: &drop{ID: 1}},
+			msgDef{recv: end{ID: 1}},
+		))
+
+		if err := <-cause; !errors.Is(err, ErrDropStream) {
+			t.Errorf("expected context cause to be ErrDropStream, got %v", err)
+		}
+		if err := <-cause; !errors.Is(err, ErrDropStream) {
+			t.Errorf("expected write to fail with ErrDropStream, got %v", err)
+		}
+	})
+}
+
+func Test_ExecCommand_ReturnReader(t *testing.T) {
+	newPlugin := func(t *testing.T, r io.Reader) *Plugin {
+		p, err := New(
+			[]*Command{{
+				Signature: PluginSignature{
+					Name:             "reader",
+					Category:         "Experimental",
+					Desc:             "test cmd",
+					SearchTerms:      []string{"reader"},
+					InputOutputTypes: []InOutTypes{{In: types.Nothing(), Out: types.String()}},
+				},
+				OnRun: func(ctx context.Context, exec *ExecCommand) error {
+					return exec.ReturnReader(ctx, r, BufferSize(512), StringStream())
+				},
+			}},
+			"",
+			&Config{Logger: logger(t)},
+		)
+		if err != nil {
+			t.Fatalf("creating plugin: %v", err)
+		}
+		return p
+	}
+
+	t.Run("success", func(t *testing.T) {
+		content := strings.Repeat("0123456789", 60)
+		runEngine(t, newPlugin(t, strings.NewReader(content)), append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "reader"}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: byteStream{ID: 1, Type: "String"}}}},
+			msgDef{recv: data{ID: 1, Data: []byte(content[:512])}},
+			msgDef{send: &ack{ID: 1}},
+			msgDef{recv: data{ID: 1, Data: []byte(content[512:])}},
+			msgDef{send: &ack{ID: 1}},
+			msgDef{recv: end{ID: 1}},
+		))
+	})
+
+	t.Run("read error", func(t *testing.T) {
+		r := io.MultiReader(strings.NewReader("abc"), readerFunc(func(b []byte) (int, error) { return 0, errors.New("broken") }))
+		runEngine(t, newPlugin(t, r), append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "reader"}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: byteStream{ID: 1, Type: "String"}}}},
+			msgDef{recv: data{ID: 1, Data: []byte("abc")}},
+			msgDef{send: &ack{ID: 1}},
+			msgDef{recv: data{ID: 1, Data: LabeledError{Msg: "copying data into stream: broken"}}},
+			msgDef{recv: end{ID: 1}},
+		))
+	})
+}
+
+func Test_ExecCommand_ReturnRawStream_Framed(t *testing.T) {
+	frames := [][]byte{{1, 2, 3}, bytes.Repeat([]byte{5}, 1500), {}, {6}}
+	p, err := New(
+		[]*Command{{
+			Signature: PluginSignature{
+				Name:             "frames",
+				Category:         "Experimental",
+				Desc:             "test cmd",
+				SearchTerms:      []string{"frames"},
+				InputOutputTypes: []InOutTypes{{In: types.Nothing(), Out: types.Binary()}},
+			},
+			OnRun: func(ctx context.Context, exec *ExecCommand) error {
+				out, err := exec.ReturnRawStream(ctx, BinaryStream(), Framed())
+				if err != nil {
+					return err
+				}
+				defer out.Close()
+				for _, f := range frames {
+					if _, err := out.Write(f); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		}},
+		"",
+		&Config{Logger: logger(t)},
+	)
+	if err != nil {
+		t.Fatalf("creating plugin: %v", err)
+	}
+
+	// each non-empty write is sent as separate Data message
+	runEngine(t, p, append(protocolPrelude,
+		msgDef{send: &call{ID: 1, Call: run{Name: "frames"}}},
+		msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: byteStream{ID: 1, Type: "Binary"}}}},
+		msgDef{recv: data{ID: 1, Data: frames[0]}},
+		msgDef{send: &ack{ID: 1}},
+		msgDef{recv: data{ID: 1, Data: frames[1]}},
+		msgDef{send: &ack{ID: 1}},
+		msgDef{recv: data{ID: 1, Data: frames[3]}},
+		msgDef{send: &ack{ID: 1}},
+		msgDef{recv: end{ID: 1}},
+	))
+}
+
+func Test_ExecCommand_ReturnBinary(t *testing.T) {
+	p, err := New(
+		[]*Command{{
+			Signature: PluginSignature{
+				Name:             "bin",
+				Category:         "Experimental",
+				Desc:             "test cmd",
+				SearchTerms:      []string{"binary"},
+				InputOutputTypes: []InOutTypes{{In: types.Nothing(), Out: types.Binary()}},
+				Named:            Flags{{Long: "stream", Desc: "return stream"}},
+			},
+			OnRun: func(ctx context.Context, exec *ExecCommand) error {
+				if _, ok := exec.Named["stream"]; !ok {
+					return exec.ReturnBinary(ctx, []byte{1, 2, 3})
+				}
+				out, err := exec.ReturnRawStream(ctx, BinaryStream())
+				if err != nil {
+					return err
+				}
+				defer out.Close()
+				_, err = out.Write([]byte{1, 2, 3})
+				return err
+			},
+		}},
+		"",
+		&Config{Logger: logger(t)},
+	)
+	if err != nil {
+		t.Fatalf("creating plugin: %v", err)
+	}
+
+	t.Run("single value", func(t *testing.T) {
+		// the response is Binary Value, "describe" reports "binary"
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "bin", Call: evaluatedCall{Head: Span{Start: 1, End: 4}}}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: Value{Value: []byte{1, 2, 3}, Span: Span{Start: 1, End: 4}}}}},
+		))
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		// the response is ByteStream of type Binary, "describe" reports "binary (stream)"
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "bin", Call: evaluatedCall{Named: NamedParams{"stream": Value{}}}}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: byteStream{ID: 1, Type: "Binary"}}}},
+			msgDef{recv: data{ID: 1, Data: []byte{1, 2, 3}}},
+			msgDef{send: &ack{ID: 1}},
+			msgDef{recv: end{ID: 1}},
+			msgDef{send: &drop{ID: 1}},
+		))
+	})
+}
+
+func Test_ExecCommand_ReturnCellPath(t *testing.T) {
+	p, err := New(
+		[]*Command{{
+			Signature: PluginSignature{
+				Name:             "to-path",
+				Category:         "Experimental",
+				Desc:             "test cmd",
+				SearchTerms:      []string{"cell-path"},
+				InputOutputTypes: []InOutTypes{{In: types.String(), Out: types.CellPath()}},
+			},
+			OnRun: func(ctx context.Context, exec *ExecCommand) error {
+				// convert dot separated string into CellPath, numeric
+				// segments become Int members
+				in := exec.Input.(Value)
+				var cp CellPath
+				for _, s := range strings.Split(in.Value.(string), ".") {
+					if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+						cp.AddInteger(uint(n))
+					} else {
+						cp.AddString(s)
+					}
+				}
+				// member with span assigned must keep it
+				cp.Members = append(cp.Members, PathMember{Type: PathMemberString, Name: "x", Optional: true, Span: in.Span})
+				return exec.ReturnCellPath(ctx, cp)
+			},
+		}},
+		"",
+		&Config{Logger: logger(t)},
+	)
+	if err != nil {
+		t.Fatalf("creating plugin: %v", err)
+	}
+
+	head := Span{Start: 20, End: 27}
+	inSpan := Span{Start: 1, End: 10}
+	expect := CellPath{Members: []PathMember{
+		{Type: PathMemberString, Name: "foo", Span: head},
+		{Type: PathMemberInt, Index: 1, Span: head},
+		{Type: PathMemberString, Name: "bar", Span: head},
+		{Type: PathMemberString, Name: "x", Optional: true, Span: inSpan},
+	}}
+	runEngine(t, p, append(protocolPrelude,
+		msgDef{send: &call{ID: 1, Call: run{Name: "to-path", Call: evaluatedCall{Head: head}, Input: Value{Value: "foo.1.bar", Span: inSpan}}}},
+		msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: Value{Value: expect, Span: head}}}},
+	))
+}
+
+func Test_ExecCommand_ErrorAt(t *testing.T) {
+	span := Span{Start: 10, End: 13}
+	source := map[Span]Value{span: {Value: []byte("foo")}, {Start: 1, End: 1}: {Value: []byte{}}}
+
+	p := &Plugin{engc: make(map[int]chan any), log: logger(t)}
+	p.out = writerFunc(func(b []byte) (int, error) {
+		var msg struct {
+			EngineCall struct {
+				ID   int             `msgpack:"id"`
+				Call map[string]Span `msgpack:"call"`
+			}
+		}
+		if err := msgpack.Unmarshal(b, &msg); err != nil {
+			return 0, err
+		}
+		var resp any = LabeledError{Msg: "unknown span"}
+		if v, ok := source[msg.EngineCall.Call["GetSpanContents"]]; ok {
+			resp = pipelineData{Data: v}
+		}
+		return len(b), p.handleEngineCallResponse(context.Background(), engineCallResponse{ID: msg.EngineCall.ID, Response: resp})
+	})
+	ec := &ExecCommand{p: p, callID: 1}
+
+	testCases := []struct {
+		name string
+		span Span
+		text string
+	}{
+		{name: "source", span: span, text: "foo"},
+		{name: "empty source", span: Span{Start: 1, End: 1}, text: "bad value"},
+		{name: "engine error", span: Span{Start: 2, End: 3}, text: "bad value"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ec.ErrorAt(context.Background(), tc.span, "bad value")
+			expect := &LabeledError{Msg: "bad value", Labels: []ErrorLabel{{Text: tc.text, Span: tc.span}}}
+			if diff := cmp.Diff(expect, err); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_ExecCommand_ReturnEvalResult(t *testing.T) {
+	newPlugin := func(t *testing.T, result func() any) *Plugin {
+		p, err := New(
+			[]*Command{{
+				Signature: PluginSignature{
+					Name:             "wrapper",
+					Category:         "Experimental",
+					Desc:             "test cmd",
+					SearchTerms:      []string{"wrapper"},
+					InputOutputTypes: []InOutTypes{{In: types.Nothing(), Out: types.Any()}},
+				},
+				OnRun: func(ctx context.Context, exec *ExecCommand) error {
+					return exec.ReturnEvalResult(ctx, result())
+				},
+			}},
+			"",
+			&Config{Logger: logger(t)},
+		)
+		if err != nil {
+			t.Fatalf("creating plugin: %v", err)
+		}
+		return p
+	}
+
+	t.Run("nil", func(t *testing.T) {
+		p := newPlugin(t, func() any { return nil })
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "wrapper"}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{empty{}}}},
+		))
+	})
+
+	t.Run("Value", func(t *testing.T) {
+		p := newPlugin(t, func() any { return Value{Value: "foo"} })
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "wrapper"}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: Value{Value: "foo"}}}},
+		))
+	})
+
+	t.Run("list stream", func(t *testing.T) {
+		p := newPlugin(t, func() any {
+			ch := make(chan Value, 2)
+			ch <- Value{Value: "v1"}
+			ch <- Value{Value: "v2"}
+			close(ch)
+			return (<-chan Value)(ch)
+		})
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "wrapper"}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: listStream{ID: 1}}}},
+			msgDef{recv: data{ID: 1, Data: Value{Value: "v1"}}},
+			msgDef{send: &ack{ID: 1}},
+			msgDef{recv: data{ID: 1, Data: Value{Value: "v2"}}},
+			msgDef{send: &ack{ID: 1}},
+			msgDef{recv: end{ID: 1}},
+			msgDef{send: &drop{ID: 1}},
+		))
+	})
+
+	t.Run("raw stream", func(t *testing.T) {
+		p := newPlugin(t, func() any { return strings.NewReader("raw data") })
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "wrapper"}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{byteStream{ID: 1, Type: "Unknown"}}}},
+			msgDef{recv: data{ID: 1, Data: []byte("raw data")}},
+			msgDef{send: &ack{ID: 1}},
+			msgDef{recv: end{ID: 1}},
+			msgDef{send: &drop{ID: 1}},
+		))
+	})
+
+	t.Run("raw stream, cancelled context", func(t *testing.T) {
+		p := &Plugin{out: io.Discard, log: logger(t), outs: make(map[int]outputStream)}
+		ec := &ExecCommand{p: p, callID: 1, cancel: func(error) {}}
+		ctx, cancel := context.WithCancelCause(context.Background())
+		errStop := errors.New("stop")
+		cancel(errStop)
+		r := readerFunc(func(b []byte) (int, error) {
+			t.Error("unexpected Read after the context has been cancelled")
+			return copy(b, "data"), nil
+		})
+		if err := ec.ReturnEvalResult(ctx, io.Reader(r)); !errors.Is(err, errStop) {
+			t.Errorf("expected error %v, got %v", errStop, err)
+		}
+	})
+
+	t.Run("unsupported type", func(t *testing.T) {
+		ec := &ExecCommand{}
+		err := ec.ReturnEvalResult(context.Background(), 42)
+		expectErrorMsg(t, err, `unsupported result type int`)
+	})
+}
+
+func Test_ExecCommand_respond_twice(t *testing.T) {
+	newExec := func(t *testing.T) *ExecCommand {
+		p := &Plugin{out: io.Discard, log: logger(t), outs: make(map[int]outputStream)}
+		return &ExecCommand{p: p, callID: 1, cancel: func(error) {}}
+	}
+	msg := `response has been already sent, command can respond only once (use ReturnListStream for multiple values)`
+
+	t.Run("ReturnValue", func(t *testing.T) {
+		ec := newExec(t)
+		if err := ec.ReturnValue(context.Background(), Value{Value: 1}); err != nil {
+			t.Fatalf("sending response: %v", err)
+		}
+		err := ec.ReturnValue(context.Background(), Value{Value: 2})
+		if !errors.Is(err, ErrResponseSent) {
+			t.Errorf("expected ErrResponseSent, got %v", err)
+		}
+		expectErrorMsg(t, err, msg)
+
+		_, err = ec.ReturnListStream(context.Background())
+		expectErrorMsg(t, err, msg)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		ec := newExec(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		out, err := ec.ReturnRawStream(ctx)
+		if err != nil {
+			t.Fatalf("opening stream: %v", err)
+		}
+		defer out.Close()
+
+		err = ec.ReturnValue(ctx, Value{Value: 2})
+		expectErrorMsg(t, err, msg)
+		_, err = ec.ReturnListStream(ctx)
+		expectErrorMsg(t, err, msg)
+	})
+}
+
+func Test_ExecCommand_stream_ErrorValue(t *testing.T) {
+	p, err := New(
+		[]*Command{{
+			Signature: PluginSignature{
+				Name:             "producer",
+				Category:         "Experimental",
+				Desc:             "test cmd",
+				SearchTerms:      []string{"producer"},
+				InputOutputTypes: []InOutTypes{{In: types.Nothing(), Out: types.Any()}},
+			},
+			OnRun: func(ctx context.Context, exec *ExecCommand) error {
+				out, err := exec.ReturnListStream(ctx)
+				if err != nil {
+					return err
+				}
+				defer close(out)
+				out <- Value{Value: "v1", Span: exec.Head}
+				out <- ErrorValue(fmt.Errorf("reading item: %w", io.ErrUnexpectedEOF), exec.Head)
+				return nil
+			},
+		}},
+		"",
+		&Config{Logger: logger(t)},
+	)
+	if err != nil {
+		t.Fatalf("creating plugin: %v", err)
+	}
+
+	head := Span{Start: 4, End: 12}
+	runEngine(t, p, append(protocolPrelude,
+		msgDef{send: &call{ID: 1, Call: run{Name: "producer", Call: evaluatedCall{Head: head}}}},
+		msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: listStream{ID: 1}}}},
+		msgDef{recv: data{ID: 1, Data: Value{Value: "v1", Span: head}}},
+		msgDef{send: &ack{ID: 1}},
+		msgDef{recv: data{ID: 1, Data: Value{Value: LabeledError{Msg: "reading item: unexpected EOF"}, Span: head}}},
+		msgDef{send: &ack{ID: 1}},
+		msgDef{recv: end{ID: 1}},
+		msgDef{send: &drop{ID: 1}},
+	))
+}
+
+func Test_ExecCommand_ReturnListSender(t *testing.T) {
+	newPlugin := func(t *testing.T, onRun func(context.Context, *ExecCommand) error) *Plugin {
+		p, err := New(
+			[]*Command{{
+				Signature: PluginSignature{
+					Name:             "producer",
+					Category:         "Experimental",
+					Desc:             "test cmd",
+					SearchTerms:      []string{"producer"},
+					InputOutputTypes: []InOutTypes{{In: types.Nothing(), Out: types.Any()}},
+				},
+				OnRun: onRun,
+			}},
+			"",
+			&Config{Logger: logger(t)},
+		)
+		if err != nil {
+			t.Fatalf("creating plugin: %v", err)
+		}
+		return p
+	}
+
+	expectMsgs := append(protocolPrelude,
+		msgDef{send: &call{ID: 1, Call: run{Name: "producer"}}},
+		msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: listStream{ID: 1}}}},
+		msgDef{recv: data{ID: 1, Data: Value{Value: "v1"}}},
+		msgDef{send: &ack{ID: 1}},
+		msgDef{recv: end{ID: 1}},
+		msgDef{send: &drop{ID: 1}},
+	)
+
+	t.Run("double close", func(t *testing.T) {
+		p := newPlugin(t, func(ctx context.Context, exec *ExecCommand) error {
+			out, err := exec.ReturnListSender(ctx)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+			if err := out.Send(Value{Value: "v1"}); err != nil {
+				t.Errorf("unexpected send error: %v", err)
+			}
+			if err := out.Close(); err != nil {
+				t.Errorf("unexpected close error: %v", err)
+			}
+			if err := out.Send(Value{Value: "v2"}); !errors.Is(err, io.ErrClosedPipe) {
+				t.Errorf("expected io.ErrClosedPipe, got %v", err)
+			}
+			// second call returns the same sender
+			if out2, err := exec.ReturnListSender(ctx); err != nil || out2 != out {
+				t.Errorf("expected the same sender, got %p (error %v)", out2, err)
+			}
+			return nil
+		})
+		runEngine(t, p, expectMsgs)
+	})
+
+	t.Run("closed automatically", func(t *testing.T) {
+		p := newPlugin(t, func(ctx context.Context, exec *ExecCommand) error {
+			out, err := exec.ReturnListSender(ctx)
+			if err != nil {
+				return err
+			}
+			return out.Send(Value{Value: "v1"})
+		})
+		runEngine(t, p, expectMsgs)
+	})
+
+	t.Run("send after drop", func(t *testing.T) {
+		sendErr := make(chan error, 1)
+		p := newPlugin(t, func(ctx context.Context, exec *ExecCommand) error {
+			out, err := exec.ReturnListSender(ctx)
+			if err != nil {
+				return err
+			}
+			if err := out.Send(Value{Value: "v1"}); err != nil {
+				return err
+			}
+			<-ctx.Done()
+			sendErr <- out.Send(Value{Value: "v2"})
+			return nil
+		})
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "producer"}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: listStream{ID: 1}}}},
+			msgDef{recv: data{ID: 1, Data: Value{Value: "v1"}}},
+			msgDef{send: &drop{ID: 1}},
+			msgDef{recv: end{ID: 1}},
+		))
+		if err := <-sendErr; !errors.Is(err, ErrDropStream) {
+			t.Errorf("expected ErrDropStream, got %v", err)
+		}
+	})
+}
+
+func Test_ExecCommand_MapClosure(t *testing.T) {
+	// the "closure" multiplies the item by 10, item 2 returns nothing and
+	// item 3 fails; responses are sent in reverse order of the calls
+	var inFlight, maxInFlight atomic.Int32
+	p := &Plugin{engc: make(map[int]chan any), log: logger(t)}
+	p.out = writerFunc(func(b []byte) (int, error) {
+		var msg struct {
+			EngineCall struct {
+				ID   int `msgpack:"id"`
+				Call struct {
+					EvalClosure struct {
+						Positional []Value `msgpack:"positional"`
+					}
+				} `msgpack:"call"`
+			}
+		}
+		if err := msgpack.Unmarshal(b, &msg); err != nil {
+			return 0, err
+		}
+		if n := inFlight.Add(1); n > maxInFlight.Load() {
+			maxInFlight.Store(n)
+		}
+		item := msg.EngineCall.Call.EvalClosure.Positional[0]
+		n := item.Value.(int64)
+		var resp any
+		switch n {
+		case 2:
+			resp = pipelineData{Data: empty{}}
+		case 3:
+			resp = LabeledError{Msg: "three"}
+		default:
+			resp = pipelineData{Data: Value{Value: n * 10, Span: item.Span}}
+		}
+		go func() {
+			time.Sleep(time.Duration(10-n) * time.Millisecond)
+			inFlight.Add(-1)
+			p.handleEngineCallResponse(context.Background(), engineCallResponse{ID: msg.EngineCall.ID, Response: resp})
+		}()
+		return len(b), nil
+	})
+	ec := &ExecCommand{p: p, callID: 1}
+
+	items := make(chan Value)
+	go func() {
+		defer close(items)
+		for i := range 8 {
+			items <- Value{Value: i, Span: Span{Start: i, End: i + 1}}
+		}
+	}()
+
+	out, err := ec.MapClosure(context.Background(), Value{Value: Closure{BlockID: 1}}, items)
+	if err != nil {
+		t.Fatalf("MapClosure: %v", err)
+	}
+	var result []Value
+	for v := range out {
+		result = append(result, v)
+	}
+
+	expect := []Value{
+		{Value: int64(0), Span: Span{Start: 0, End: 1}},
+		{Value: int64(10), Span: Span{Start: 1, End: 2}},
+		{Value: LabeledError{Msg: "three"}, Span: Span{Start: 3, End: 4}},
+		{Value: int64(40), Span: Span{Start: 4, End: 5}},
+		{Value: int64(50), Span: Span{Start: 5, End: 6}},
+		{Value: int64(60), Span: Span{Start: 6, End: 7}},
+		{Value: int64(70), Span: Span{Start: 7, End: 8}},
+	}
+	if diff := cmp.Diff(expect, result); diff != "" {
+		t.Errorf("result mismatch (-want +got):\n%s", diff)
+	}
+	if n := maxInFlight.Load(); n > mapClosureConcurrency {
+		t.Errorf("expected at most %d closures in flight, got %d", mapClosureConcurrency, n)
+	}
+
+	t.Run("invalid closure", func(t *testing.T) {
+		_, err := ec.MapClosure(context.Background(), Value{Value: "closure"}, items)
+		expectErrorMsg(t, err, `closure argument must be of type Closure, got string`)
+	})
+}
@@ -0,0 +1,55 @@
+package nu
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+/*
+CommandStats contains execution statistics of the command, see
+[Config.CollectStats] and [Plugin.Stats].
+*/
+type CommandStats struct {
+	Calls    uint64        // how many times the command has been executed
+	Duration time.Duration // total time spent executing the command
+}
+
+type statsCollector struct {
+	m     sync.Mutex
+	stats map[string]CommandStats
+}
+
+func newStatsCollector() *statsCollector {
+	return &statsCollector{stats: make(map[string]CommandStats)}
+}
+
+func (sc *statsCollector) record(name string, d time.Duration) {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+
+	s := sc.stats[name]
+	s.Calls++
+	s.Duration += d
+	sc.stats[name] = s
+}
+
+func (sc *statsCollector) snapshot() map[string]CommandStats {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	return maps.Clone(sc.stats)
+}
+
+/*
+Stats returns execution statistics of the plugin's commands, the key of
+the map is command name. Only commands which have been executed at least
+once are included.
+
+Returns nil when statistics collection is not enabled, see [Config.CollectStats].
+*/
+func (p *Plugin) Stats() map[string]CommandStats {
+	if p.stats == nil {
+		return nil
+	}
+	return p.stats.snapshot()
+}
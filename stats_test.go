@@ -0,0 +1,71 @@
+package nu
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ainvaltin/nu-plugin/types"
+)
+
+func Test_Plugin_Stats(t *testing.T) {
+	newPlugin := func(t *testing.T, cfg *Config) *Plugin {
+		p, err := New(
+			[]*Command{{
+				Signature: PluginSignature{
+					Name:             "slow",
+					Category:         "Experimental",
+					Desc:             "test cmd",
+					SearchTerms:      []string{"slow"},
+					InputOutputTypes: []InOutTypes{{types.Any(), types.Any()}},
+				},
+				OnRun: func(ctx context.Context, exec *ExecCommand) error {
+					time.Sleep(10 * time.Millisecond)
+					return nil
+				},
+			}},
+			"",
+			cfg,
+		)
+		if err != nil {
+			t.Fatalf("creating plugin: %v", err)
+		}
+		return p
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		p := newPlugin(t, &Config{Logger: logger(t)})
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "slow"}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{empty{}}}},
+		))
+		if stats := p.Stats(); stats != nil {
+			t.Errorf("expected nil stats, got %v", stats)
+		}
+	})
+
+	t.Run("stats accumulate", func(t *testing.T) {
+		p := newPlugin(t, &Config{Logger: logger(t), CollectStats: true})
+		if stats := p.Stats(); len(stats) != 0 {
+			t.Errorf("expected empty stats, got %v", stats)
+		}
+
+		runEngine(t, p, append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "slow"}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{empty{}}}},
+			msgDef{send: &call{ID: 2, Call: run{Name: "slow"}}},
+			msgDef{recv: callResponse{ID: 2, Response: pipelineData{empty{}}}},
+		))
+
+		// response is sent before the stats are recorded so wait for the
+		// command goroutines to exit
+		p.runs.wg.Wait()
+		stats := p.Stats()["slow"]
+		if stats.Calls != 2 {
+			t.Errorf("expected 2 calls, got %d", stats.Calls)
+		}
+		if stats.Duration < 20*time.Millisecond {
+			t.Errorf("expected duration to be at least 20ms, got %s", stats.Duration)
+		}
+	})
+}
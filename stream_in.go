@@ -4,43 +4,65 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sync"
 )
 
 func newInputStreamRaw(id int) *rawStreamIn {
 	out := &rawStreamIn{
-		id:  id,
-		buf: make(chan []byte, 10),
+		id:   id,
+		buf:  newInputQueue[[]byte](),
+		done: make(chan struct{}),
 	}
 	out.rdr, out.data = io.Pipe()
 	return out
 }
 
+/*
+rawStreamIn is the raw input stream of the command (engine is the producer).
+
+Flow control: main loop hands the Data messages over to buf (received) and
+the goroutine started by Run writes them into the pipe the command reads from.
+Ack is sent to the engine only after the Write returns, ie the command has
+consumed the data - pipe's Write returns only after all the bytes of the
+chunk have been read so Ack is never sent for partially consumed chunk.
+
+Engine doesn't wait for the Ack before sending the next Data msg so buf
+queues the messages. The queue is not bounded as main loop must never block
+on the input stream - it also delivers the Ack messages of the output streams
+so blocking would deadlock command which reads input and writes output
+concurrently. So the memory used by the stream is bounded only by the count
+of not Ack-ed messages the engine allows, not by the plugin.
+*/
 type rawStreamIn struct {
 	id    int
-	buf   chan []byte
+	buf   *inputQueue[[]byte]
 	onAck func(ctx context.Context, id int) // plugin has consumed the latest Data msg
 	data  io.WriteCloser
-	rdr   io.ReadCloser
+	rdr   *io.PipeReader
+	done  chan struct{} // closed when the goroutine started by Run exits
 }
 
 func (lsi *rawStreamIn) Run(ctx context.Context) {
 	up := make(chan struct{})
 
 	go func() {
+		defer close(lsi.done)
 		defer lsi.data.Close()
+		// when consumer has stopped reading the Write would block forever,
+		// closing the reader on cancellation makes the Write to return.
+		stop := context.AfterFunc(ctx, func() { lsi.rdr.CloseWithError(context.Cause(ctx)) })
+		defer stop()
 		close(up)
 		for {
-			select {
-			case in, ok := <-lsi.buf:
-				if !ok {
-					return
-				}
-				// todo: check for error - user closed the reader to signal to drop the stream?
-				lsi.data.Write(in)
-				lsi.onAck(ctx, lsi.id)
-			case <-ctx.Done():
+			in, ok := lsi.buf.pop(ctx)
+			if !ok {
 				return
 			}
+			// todo: check for error - user closed the reader to signal to drop the stream?
+			if _, err := lsi.data.Write(in); err != nil && ctx.Err() != nil {
+				return
+			}
+			lsi.onAck(ctx, lsi.id)
 		}
 	}()
 
@@ -52,28 +74,33 @@ func (lsi *rawStreamIn) received(ctx context.Context, v any) error {
 	if !ok {
 		return fmt.Errorf("raw stream input must be of type []byte, got %T", v)
 	}
-	lsi.buf <- in
+	lsi.buf.push(in)
 	return nil
 }
 
 func (lsi *rawStreamIn) endOfData() {
-	close(lsi.buf)
+	lsi.buf.close()
 }
 
 func newInputStreamList(id int) *listStreamIn {
 	in := &listStreamIn{
 		id:   id,
 		data: make(chan Value),
-		buf:  make(chan Value, 10),
+		buf:  newInputQueue[Value](),
 	}
 	return in
 }
 
+/*
+listStreamIn is the list input stream of the command, the flow control model
+is the same as with [rawStreamIn] - Values are queued in buf and Ack is sent
+after the command has received the Value from the (unbuffered) data chan.
+*/
 type listStreamIn struct {
 	id   int
 	data chan Value // incoming data to be consumed by plugin
 
-	buf chan Value
+	buf *inputQueue[Value]
 
 	// this callback is triggered to signal that the last item received
 	// has been processed, consumer is ready for the next one
@@ -94,17 +121,13 @@ func (lsi *listStreamIn) Run(ctx context.Context) {
 		defer close(lsi.data)
 		close(up)
 		for {
+			in, ok := lsi.buf.pop(ctx)
+			if !ok {
+				return
+			}
 			select {
-			case in, ok := <-lsi.buf:
-				if !ok {
-					return
-				}
-				select {
-				case lsi.data <- in:
-					lsi.onAck(ctx, lsi.id)
-				case <-ctx.Done():
-					return
-				}
+			case lsi.data <- in:
+				lsi.onAck(ctx, lsi.id)
 			case <-ctx.Done():
 				return
 			}
@@ -120,12 +143,75 @@ func (lsi *listStreamIn) received(ctx context.Context, v any) error {
 	if !ok {
 		return fmt.Errorf("list stream input must be of type Value, got %T", v)
 	}
-	lsi.buf <- in
+	lsi.buf.push(in)
 	return nil
 }
 
 // main loop signals there will be no more data for the stream
-// ctx with timeout for how long wait?
 func (lsi *listStreamIn) endOfData() {
-	close(lsi.buf)
+	lsi.buf.close()
+}
+
+/*
+inputQueue is unbounded FIFO queue between the main loop (producer, must
+not block) and the input stream's goroutine (consumer).
+*/
+type inputQueue[T any] struct {
+	m      sync.Mutex
+	items  []T
+	closed bool
+	ready  chan struct{} // signaled when item is pushed or queue is closed
+}
+
+func newInputQueue[T any]() *inputQueue[T] {
+	return &inputQueue[T]{ready: make(chan struct{}, 1)}
+}
+
+func (q *inputQueue[T]) push(v T) {
+	q.m.Lock()
+	q.items = append(q.items, v)
+	q.m.Unlock()
+	q.signal()
+}
+
+// close signals that there will be no more items, pop returns the items
+// already in the queue before reporting the end.
+func (q *inputQueue[T]) close() {
+	q.m.Lock()
+	q.closed = true
+	q.m.Unlock()
+	q.signal()
+}
+
+func (q *inputQueue[T]) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop blocks until item is available, false is returned when the queue has
+// been closed and drained or ctx is cancelled.
+func (q *inputQueue[T]) pop(ctx context.Context) (v T, ok bool) {
+	for {
+		q.m.Lock()
+		if len(q.items) > 0 {
+			v = q.items[0]
+			clear(q.items[:1])
+			q.items = q.items[1:]
+			q.m.Unlock()
+			return v, true
+		}
+		closed := q.closed
+		q.m.Unlock()
+		if closed {
+			return v, false
+		}
+
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return v, false
+		}
+	}
 }
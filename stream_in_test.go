@@ -3,9 +3,11 @@ package nu
 import (
 	"context"
 	"crypto/rand"
+	"fmt"
 	"hash/crc64"
 	"io"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -78,6 +80,76 @@ func Test_rawStreamIn(t *testing.T) {
 			t.Errorf("CRC doesn't match: expected %d, got %d", sumW, sumR)
 		}
 	})
+
+	t.Run("large transfer is Ack-ed after consumption", func(t *testing.T) {
+		const chunkSize = 64 * 1024
+		const chunkCount = 160
+
+		var consumed, ackCount atomic.Int64
+		acked := make(chan struct{})
+		rs := newInputStreamRaw(3)
+		rs.onAck = func(ctx context.Context, id int) {
+			ackCount.Add(1)
+			acked <- struct{}{}
+		}
+		rs.Run(context.Background())
+
+		// engine stub which waits for the Ack before sending the next chunk
+		go func() {
+			defer rs.endOfData()
+			for range chunkCount {
+				if err := rs.received(context.Background(), make([]byte, chunkSize)); err != nil {
+					t.Errorf("sending data to stream: %v", err)
+					return
+				}
+				<-acked
+			}
+		}()
+
+		// read in smaller pieces than the chunk size
+		buf := make([]byte, 4096)
+		for {
+			n, err := rs.rdr.Read(buf)
+			c := consumed.Add(int64(n))
+			// chunk must be Ack-ed only after it has been read completely
+			if a := ackCount.Load(); a*chunkSize > c {
+				t.Fatalf("%d chunks Ack-ed after consuming %d bytes", a, c)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("reading input: %v", err)
+			}
+		}
+		if n := consumed.Load(); n != chunkSize*chunkCount {
+			t.Errorf("expected to read %d bytes, got %d", chunkSize*chunkCount, n)
+		}
+	})
+
+	t.Run("consumer stops reading", func(t *testing.T) {
+		rs := newInputStreamRaw(5)
+		rs.onAck = func(ctx context.Context, id int) { t.Error("unexpected Ack") }
+		ctx, cancel := context.WithCancelCause(context.Background())
+		rs.Run(ctx)
+
+		// nobody reads from rs.rdr so the goroutine blocks writing the data
+		if err := rs.received(ctx, []byte{1, 2, 3}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		cancel(fmt.Errorf("stop reading"))
+
+		select {
+		case <-rs.done:
+		case <-time.After(time.Second):
+			t.Fatal("input stream goroutine didn't exit")
+		}
+
+		// reader has been closed, consumer attempting to read gets error
+		_, err := rs.rdr.Read(make([]byte, 3))
+		expectErrorMsg(t, err, `io: read/write on closed pipe`)
+	})
 }
 
 func Test_listStreamIn(t *testing.T) {
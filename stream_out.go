@@ -2,12 +2,15 @@ package nu
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
 )
 
 func newOutputListRaw(p *Plugin, opts ...RawStreamOption) *rawStreamOut {
-	out := initOutputListRaw(int(p.idGen.Add(1)), opts...)
+	out := initOutputListRaw(p.nextID(), opts...)
 	out.sender = p.outputMsg
 
 	return out
@@ -15,16 +18,23 @@ func newOutputListRaw(p *Plugin, opts ...RawStreamOption) *rawStreamOut {
 
 func initOutputListRaw(id int, opts ...RawStreamOption) *rawStreamOut {
 	out := &rawStreamOut{
-		id:   id,
-		done: make(chan struct{}),
-		sent: make(chan struct{}, 1),
-		cfg:  rawStreamCfg{bufSize: 1024, dataType: "Unknown"},
+		id:           id,
+		done:         make(chan struct{}),
+		sent:         make(chan struct{}, 1),
+		cfg:          rawStreamCfg{bufSize: 1024, dataType: "Unknown"},
+		endHandshake: endHandshake{dropped: make(chan struct{})},
 	}
 	out.rdr, out.data = io.Pipe()
 
 	for _, opt := range opts {
 		opt.apply(&out.cfg)
 	}
+	if out.cfg.framed {
+		out.data = &frameWriter{w: out.data}
+	}
+	if out.cfg.validate {
+		out.data = &utf8Writer{w: out.data}
+	}
 
 	return out
 }
@@ -36,8 +46,8 @@ type rawStreamOut struct {
 	sent   chan struct{} // has the latest Data msg been Ack-ed?
 	sender func(ctx context.Context, data any) error
 	done   chan struct{}
-	onDrop func()
 	cfg    rawStreamCfg
+	endHandshake
 }
 
 func (rc *rawStreamOut) streamID() int { return rc.id }
@@ -47,10 +57,63 @@ func (rc *rawStreamOut) pipelineDataHdr() any {
 }
 
 func (rc *rawStreamOut) read() ([]byte, error) {
-	buf := make([]byte, rc.cfg.bufSize)
+	if rc.cfg.framed {
+		return readFrame(rc.rdr)
+	}
+	return readChunk(rc.rdr, make([]byte, rc.cfg.bufSize))
+}
+
+/*
+frameWriter is used by [Framed] raw stream, it prefixes each write with it's
+length so that the reader (see readFrame) can restore the write boundaries.
+*/
+type frameWriter struct {
+	m sync.Mutex
+	w io.WriteCloser
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	fw.m.Lock()
+	defer fw.m.Unlock()
+	if _, err := fw.w.Write(binary.BigEndian.AppendUint64(nil, uint64(len(p)))); err != nil {
+		return 0, err
+	}
+	return fw.w.Write(p)
+}
+
+func (fw *frameWriter) Close() error { return fw.w.Close() }
+
+// readFrame reads single write of the frameWriter from r.
+func readFrame(r io.Reader) ([]byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint64(hdr[:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+/*
+readChunk reads from r until buf is full or Read returns error (which
+might be accompanied by data, ie io.EOF after the last bytes).
+
+Read returning no data and no error is skipped. The stream is read from
+io.Pipe which returns it for every empty Write and blocks until the next
+Write so this doesn't spin, and empty Writes are legal for the handler.
+*/
+func readChunk(r io.Reader, buf []byte) ([]byte, error) {
 	sp := 0
 	for {
-		n, err := rc.rdr.Read(buf[sp:])
+		n, err := r.Read(buf[sp:])
 		sp += n
 		if sp == len(buf) || err != nil {
 			return buf[:sp], err
@@ -60,8 +123,10 @@ func (rc *rawStreamOut) read() ([]byte, error) {
 
 func (rc *rawStreamOut) run(ctx context.Context) error {
 	defer func() {
+		// closing the reader makes writes to fail, writer is not closed as
+		// then writes would fail with io.ErrClosedPipe even when reader has
+		// been closed with more specific error (ie ErrDropStream)
 		rc.rdr.Close()
-		rc.data.Close()
 		close(rc.done)
 	}()
 
@@ -100,24 +165,32 @@ func (rc *rawStreamOut) ack() error {
 }
 
 func (rc *rawStreamOut) close(ctx context.Context) error {
-	<-rc.done
-	return rc.sender(ctx, end{ID: rc.id})
+	return rc.sendEnd(rc.done, func() error { return rc.sender(ctx, end{ID: rc.id}) })
 }
 
 func (rc *rawStreamOut) drop() {
-	if rc.onDrop != nil {
-		rc.onDrop()
-	}
+	// writes into the stream will now fail with ErrDropStream. Must be done
+	// before dropReceived as it cancels the command's context which makes
+	// run to close the reader (and the first close error sticks).
 	rc.rdr.CloseWithError(ErrDropStream)
+	rc.dropReceived()
 }
 
-func newOutputListValue(p *Plugin) *listStreamOut {
+func newOutputListValue(p *Plugin, opts ...ListStreamOption) *listStreamOut {
+	cfg := listStreamCfg{window: 1}
+	for _, opt := range opts {
+		opt.applyList(&cfg)
+	}
+
 	out := &listStreamOut{
-		id:     int(p.idGen.Add(1)),
-		done:   make(chan struct{}),
-		sent:   make(chan struct{}, 1),
-		data:   make(chan Value),
-		sender: p.outputMsg,
+		id:           p.nextID(),
+		done:         make(chan struct{}),
+		sent:         make(chan struct{}, cfg.window),
+		window:       int(cfg.window),
+		md:           cfg.md,
+		data:         make(chan Value),
+		sender:       p.outputMsg,
+		endHandshake: endHandshake{dropped: make(chan struct{})},
 	}
 	return out
 }
@@ -125,35 +198,58 @@ func newOutputListValue(p *Plugin) *listStreamOut {
 type listStreamOut struct {
 	id     int
 	done   chan struct{}
-	sent   chan struct{}
+	sent   chan struct{} // Ack-s received but not yet accounted by run
+	window int           // how many Data messages may be waiting for Ack
+	md     pipelineMetadata
 	data   chan Value
 	sender func(ctx context.Context, data any) error
-	onDrop func()
+	endHandshake
+
+	senderOnce sync.Once
+	listSender *ListSender // assigned when ReturnListSender is used
 }
 
 func (rc *listStreamOut) streamID() int { return rc.id }
 
-func (rc *listStreamOut) pipelineDataHdr() any { return &listStream{ID: rc.id} }
+func (rc *listStreamOut) pipelineDataHdr() any { return &listStream{ID: rc.id, MD: rc.md} }
 
+/*
+run sends Values received from data chan to the consumer. Up to "window"
+Data messages may be sent without waiting for the Ack, when the window is
+full run waits for the Ack before accepting the next Value. Before returning
+(data chan has been closed) run waits for all the Data messages to be Ack-ed.
+*/
 func (rc *listStreamOut) run(ctx context.Context) error {
 	defer close(rc.done)
+	inFlight := 0
 	for {
 		select {
 		case v, ok := <-rc.data:
 			if !ok {
+				for ; inFlight > 0; inFlight-- {
+					select {
+					case <-rc.sent:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
 				return nil
 			}
 			if err := rc.sender(ctx, &data{ID: rc.id, Data: v}); err != nil {
 				return fmt.Errorf("send: %w", err)
 			}
+			inFlight++
 		case <-ctx.Done():
 			return ctx.Err()
 		}
 
-		select {
-		case <-rc.sent:
-		case <-ctx.Done():
-			return ctx.Err()
+		if inFlight == rc.window {
+			select {
+			case <-rc.sent:
+				inFlight--
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
 	}
 }
@@ -169,13 +265,60 @@ func (rc *listStreamOut) ack() error {
 }
 
 func (rc *listStreamOut) close(ctx context.Context) error {
-	<-rc.done
-	return rc.sender(ctx, end{ID: rc.id})
+	return rc.sendEnd(rc.done, func() error { return rc.sender(ctx, end{ID: rc.id}) })
 }
 
 func (rc *listStreamOut) drop() {
 	// closing the chan will cause panic on send so don't do that!
-	if rc.onDrop != nil {
-		rc.onDrop()
+	rc.dropReceived()
+}
+
+/*
+endHandshake tracks the End -> Drop handshake of the output stream: plugin
+sends End message when the stream is closed and the consumer acknowledges
+it with Drop message.
+*/
+type endHandshake struct {
+	endOnce  sync.Once
+	err      error       // result of sending the End message
+	ended    atomic.Bool // has the End message been (about to be) sent?
+	dropOnce sync.Once
+	dropped  chan struct{} // closed when Drop message is received
+	onDrop   func()        // called when consumer drops the stream before it ended
+}
+
+/*
+sendEnd waits until done is closed (the stream has sent all the data) and
+then calls send which must send the End message. It is done only once,
+subsequent calls return the result of the first call.
+*/
+func (eh *endHandshake) sendEnd(done <-chan struct{}, send func() error) error {
+	eh.endOnce.Do(func() {
+		<-done
+		eh.ended.Store(true)
+		eh.err = send()
+	})
+	return eh.err
+}
+
+/*
+dropReceived marks the Drop message as received. When it wasn't a response
+to the End message (ie consumer dropped the stream before it ended) the
+onDrop callback is called.
+*/
+func (eh *endHandshake) dropReceived() {
+	eh.dropOnce.Do(func() { close(eh.dropped) })
+	if !eh.ended.Load() && eh.onDrop != nil {
+		eh.onDrop()
+	}
+}
+
+// waitDrop blocks until Drop message is received or ctx is cancelled.
+func (eh *endHandshake) waitDrop(ctx context.Context) error {
+	select {
+	case <-eh.dropped:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
 	}
 }
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"slices"
 	"testing"
 	"time"
@@ -208,6 +210,73 @@ func Test_rawStreamOut(t *testing.T) {
 	})
 }
 
+func Test_readChunk(t *testing.T) {
+	// reader returns results of the reads in order, when reads are
+	// exhausted io.EOF is returned
+	type read struct {
+		data string
+		err  error
+	}
+	reader := func(reads ...read) io.Reader {
+		return readerFunc(func(b []byte) (int, error) {
+			if len(reads) == 0 {
+				return 0, io.EOF
+			}
+			r := reads[0]
+			reads = reads[1:]
+			return copy(b, r.data), r.err
+		})
+	}
+
+	testCases := []struct {
+		name  string
+		rdr   io.Reader
+		chunk string
+		err   error
+	}{
+		{name: "buffer full", rdr: reader(read{data: "abc"}, read{data: "defgh"}), chunk: "abcde"},
+		{name: "data with EOF", rdr: reader(read{data: "ab", err: io.EOF}), chunk: "ab", err: io.EOF},
+		{name: "data then EOF", rdr: reader(read{data: "ab"}), chunk: "ab", err: io.EOF},
+		{name: "empty reads then data", rdr: reader(read{}, read{}, read{data: "ab"}, read{}, read{data: "cde"}), chunk: "abcde"},
+		{name: "read error", rdr: reader(read{data: "a"}, read{err: io.ErrUnexpectedEOF}), chunk: "a", err: io.ErrUnexpectedEOF},
+		{name: "many empty reads", rdr: reader(append(append([]read{{data: "a"}}, make([]read, 1000)...), read{data: "b"})...), chunk: "ab", err: io.EOF},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			chunk, err := readChunk(tc.rdr, make([]byte, 5))
+			if !errors.Is(err, tc.err) {
+				t.Errorf("expected error %v, got %v", tc.err, err)
+			}
+			if string(chunk) != tc.chunk {
+				t.Errorf("expected chunk %q, got %q", tc.chunk, chunk)
+			}
+		})
+	}
+
+	t.Run("empty write to the stream", func(t *testing.T) {
+		var sent [][]byte
+		ls := initOutputListRaw(1)
+		ls.sender = func(ctx context.Context, d any) error {
+			sent = append(sent, d.(*data).Data.([]byte))
+			return ls.ack()
+		}
+		go func() {
+			// empty writes are legal and must not fail the stream
+			for range 1000 {
+				ls.data.Write(nil)
+			}
+			ls.data.Write([]byte("data"))
+			ls.data.Close()
+		}()
+		if err := ls.run(context.Background()); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if diff := cmp.Diff([][]byte{[]byte("data")}, sent); diff != "" {
+			t.Errorf("sent data mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
 func Test_listStreamOut(t *testing.T) {
 	t.Run("sending data blocks until Ack-ed", func(t *testing.T) {
 		ls := newOutputListValue(&Plugin{})
@@ -318,6 +387,60 @@ func Test_listStreamOut(t *testing.T) {
 		}
 	})
 
+	t.Run("window allows multiple sends without Ack", func(t *testing.T) {
+		ls := newOutputListValue(&Plugin{}, ListStreamWindow(3))
+		ls.sender = func(ctx context.Context, data any) error { return nil }
+
+		runDone := make(chan error)
+		go func() {
+			runDone <- ls.run(context.Background())
+		}()
+
+		for i := range 3 {
+			select {
+			case ls.data <- Value{Value: i}:
+			case <-time.After(500 * time.Millisecond):
+				t.Fatalf("send %d was NOT accepted", i)
+			}
+		}
+
+		// window is full, next send must wait for Ack
+		select {
+		case ls.data <- Value{Value: 3}:
+			t.Fatalf("send was accepted while window is full")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		ls.ack()
+		select {
+		case ls.data <- Value{Value: 3}:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("send was NOT accepted after Ack")
+		}
+
+		// run must not exit before all the sent Values are Ack-ed
+		close(ls.data)
+		select {
+		case err := <-runDone:
+			t.Fatalf("run exited before all Values were Ack-ed: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		for range 3 {
+			if err := ls.ack(); err != nil {
+				t.Fatalf("unexpected Ack error: %v", err)
+			}
+		}
+		select {
+		case err := <-runDone:
+			if err != nil {
+				t.Errorf("run exited with unexpected error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Error("run hasn't exited")
+		}
+	})
+
 	t.Run("two Ack-s in a row", func(t *testing.T) {
 		ls := newOutputListValue(&Plugin{})
 		if err := ls.ack(); err != nil {
@@ -332,3 +455,61 @@ func Test_listStreamOut(t *testing.T) {
 		}
 	})
 }
+
+func Benchmark_listStreamOut(b *testing.B) {
+	ls := newOutputListValue(&Plugin{})
+	// simulate consumer which Acks immediately
+	ls.sender = func(ctx context.Context, data any) error { return ls.ack() }
+
+	runDone := make(chan error)
+	go func() {
+		runDone <- ls.run(context.Background())
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ls.data <- Value{Value: i}
+	}
+	close(ls.data)
+	if err := <-runDone; err != nil {
+		b.Errorf("run exited with unexpected error: %v", err)
+	}
+}
+
+func Benchmark_listStreamOut_window(b *testing.B) {
+	for _, window := range []uint{1, 16} {
+		b.Run(fmt.Sprintf("window=%d", window), func(b *testing.B) {
+			ls := newOutputListValue(&Plugin{}, ListStreamWindow(window))
+			// simulate consumer which Acks asynchronously
+			acks := make(chan struct{}, window)
+			ls.sender = func(ctx context.Context, data any) error {
+				acks <- struct{}{}
+				return nil
+			}
+			go func() {
+				for range acks {
+					ls.ack()
+				}
+			}()
+			defer close(acks)
+
+			runDone := make(chan error)
+			go func() {
+				runDone <- ls.run(context.Background())
+			}()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ls.data <- Value{Value: i}
+			}
+			close(ls.data)
+			if err := <-runDone; err != nil {
+				b.Errorf("run exited with unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (rf readerFunc) Read(b []byte) (int, error) { return rf(b) }
@@ -9,6 +9,9 @@ import (
 	"fmt"
 
 	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+
+	"github.com/ainvaltin/nu-plugin/types"
 )
 
 /*
@@ -20,6 +23,8 @@ https://docs.rs/nu-protocol/latest/nu_protocol/enum.SyntaxShape.html
 */
 type SyntaxShape interface {
 	EncodeMsgpack(enc *msgpack.Encoder) error
+	// Type returns the type of the Values the shape accepts.
+	Type() types.Type
 
 	encodeMsgpack(enc *msgpack.Encoder) error
 }
@@ -42,36 +47,11 @@ func (ss *syntaxShape) EncodeMsgpack(enc *msgpack.Encoder) error {
 }
 
 func (ss *syntaxShape) encodeMsgpack(enc *msgpack.Encoder) error {
-	switch ss.typ {
-	case "Any",
-		"Binary",
-		"Block",
-		"Boolean",
-		"CellPath",
-		"DateTime",
-		"Directory",
-		"Duration",
-		"Error",
-		"Expression",
-		"ExternalArgument",
-		"Filepath",
-		"Filesize",
-		"Float",
-		"FullCellPath",
-		"GlobPattern",
-		"Int",
-		"ImportPattern",
-		"MathExpression",
-		"MatchBlock",
-		"Nothing",
-		"Number",
-		"Operator",
-		"Range",
-		"RowCondition",
-		"Signature",
-		"String",
-		"VarWithOptType":
+	if isSimpleShape(ss.typ) {
 		return enc.EncodeString(ss.typ)
+	}
+
+	switch ss.typ {
 	case "Closure": // Closure(Option<Vec<SyntaxShape>>)
 		if err := encodeMapStart(enc, "Closure"); err != nil {
 			return err
@@ -130,6 +110,180 @@ func (ss *syntaxShape) encodeMsgpack(enc *msgpack.Encoder) error {
 	return nil
 }
 
+/*
+Type follows the Nushell's SyntaxShape::to_type, ie shapes which describe
+syntax rather than data (Expression, OneOf etc) are of type Any.
+*/
+func (ss *syntaxShape) Type() types.Type {
+	switch ss.typ {
+	case "Binary":
+		return types.Binary()
+	case "Block":
+		return types.Block()
+	case "Boolean", "RowCondition":
+		return types.Bool()
+	case "Closure":
+		return types.Closure()
+	case "DateTime":
+		return types.Date()
+	case "Directory", "Filepath", "String":
+		return types.String()
+	case "Duration":
+		return types.Duration()
+	case "Error":
+		return types.Error()
+	case "Filesize":
+		return types.Filesize()
+	case "Float":
+		return types.Float()
+	case "GlobPattern":
+		return types.Glob()
+	case "Int":
+		return types.Int()
+	case "Keyword":
+		return ss.itmType[0].Type()
+	case "List":
+		return types.List(ss.itmType[0].Type())
+	case "Nothing":
+		return types.Nothing()
+	case "Number":
+		return types.Number()
+	case "Range":
+		return types.Range()
+	case "Record", "Table":
+		fields := make(types.RecordDef, len(ss.fields))
+		for k, v := range ss.fields {
+			fields[k] = v.Type()
+		}
+		if ss.typ == "Table" {
+			return types.Table(fields)
+		}
+		return types.Record(fields)
+	case "Signature":
+		return types.Signature()
+	default:
+		return types.Any()
+	}
+}
+
+// isSimpleShape returns true for shapes which are encoded as plain string.
+func isSimpleShape(typ string) bool {
+	switch typ {
+	case "Any",
+		"Binary",
+		"Block",
+		"Boolean",
+		"CellPath",
+		"DateTime",
+		"Directory",
+		"Duration",
+		"Error",
+		"Expression",
+		"ExternalArgument",
+		"Filepath",
+		"Filesize",
+		"Float",
+		"FullCellPath",
+		"GlobPattern",
+		"Int",
+		"ImportPattern",
+		"MathExpression",
+		"MatchBlock",
+		"Nothing",
+		"Number",
+		"Operator",
+		"Range",
+		"RowCondition",
+		"Signature",
+		"String",
+		"VarWithOptType":
+		return true
+	}
+	return false
+}
+
+/*
+Decode reads SyntaxShape from the decoder, it is the inverse of the
+SyntaxShape's EncodeMsgpack method.
+*/
+func Decode(dec *msgpack.Decoder) (SyntaxShape, error) {
+	c, err := dec.PeekCode()
+	if err != nil {
+		return nil, err
+	}
+	if msgpcode.IsFixedString(c) || msgpcode.IsString(c) {
+		typ, err := dec.DecodeString()
+		if err != nil {
+			return nil, err
+		}
+		if !isSimpleShape(typ) {
+			return nil, fmt.Errorf("unsupported SyntaxShape: %q", typ)
+		}
+		return &syntaxShape{typ: typ}, nil
+	}
+
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		return nil, fmt.Errorf("decoding SyntaxShape: %w", err)
+	}
+	if n != 1 {
+		return nil, fmt.Errorf("expected SyntaxShape map to contain one item, got %d", n)
+	}
+	typ, err := dec.DecodeString()
+	if err != nil {
+		return nil, fmt.Errorf("decoding SyntaxShape name: %w", err)
+	}
+
+	ss := &syntaxShape{typ: typ}
+	switch typ {
+	case "Closure", "OneOf":
+		// Closure(Option<Vec<SyntaxShape>>), OneOf(Vec<SyntaxShape>)
+		if ss.itmType, err = decodeShapeList(dec); err != nil {
+			return nil, fmt.Errorf("decoding %s item types: %w", typ, err)
+		}
+	case "Keyword":
+		n, err := dec.DecodeArrayLen()
+		if err != nil {
+			return nil, fmt.Errorf("decoding Keyword tuple: %w", err)
+		}
+		if n != 2 {
+			return nil, fmt.Errorf("expected Keyword to be tuple of two, got %d items", n)
+		}
+		if ss.data, err = decodeBytes(dec); err != nil {
+			return nil, fmt.Errorf("decoding Keyword: %w", err)
+		}
+		shape, err := Decode(dec)
+		if err != nil {
+			return nil, fmt.Errorf("decoding Keyword shape: %w", err)
+		}
+		ss.itmType = []SyntaxShape{shape}
+	case "List":
+		shape, err := Decode(dec)
+		if err != nil {
+			return nil, fmt.Errorf("decoding List item type: %w", err)
+		}
+		ss.itmType = []SyntaxShape{shape}
+	case "Record", "Table":
+		n, err := dec.DecodeArrayLen()
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s field count: %w", typ, err)
+		}
+		if n > 0 {
+			ss.fields = make(RecordDef, n)
+		}
+		for range n {
+			name, shape, err := decodeRecordItem(dec)
+			if err != nil {
+				return nil, fmt.Errorf("decoding %s field: %w", typ, err)
+			}
+			ss.fields[name] = shape
+		}
+	default:
+		return nil, fmt.Errorf("unsupported SyntaxShape: %q", typ)
+	}
+	return ss, nil
+}
+
 // Any syntactic form is allowed.
 func Any() SyntaxShape {
 	return &syntaxShape{typ: "Any"}
@@ -297,3 +451,59 @@ func encodeRecordItem(enc *msgpack.Encoder, name string, typ SyntaxShape) error
 	}
 	return typ.encodeMsgpack(enc)
 }
+
+func decodeRecordItem(dec *msgpack.Decoder) (string, SyntaxShape, error) {
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return "", nil, err
+	}
+	if n != 2 {
+		return "", nil, fmt.Errorf("expected record item to be tuple of two, got %d items", n)
+	}
+	name, err := dec.DecodeString()
+	if err != nil {
+		return "", nil, err
+	}
+	shape, err := Decode(dec)
+	return name, shape, err
+}
+
+// decodeShapeList decodes (possibly nil) array of shapes.
+func decodeShapeList(dec *msgpack.Decoder) ([]SyntaxShape, error) {
+	n, err := dec.DecodeArrayLen()
+	if err != nil || n <= 0 {
+		return nil, err
+	}
+	shapes := make([]SyntaxShape, n)
+	for i := range shapes {
+		if shapes[i], err = Decode(dec); err != nil {
+			return nil, err
+		}
+	}
+	return shapes, nil
+}
+
+/*
+decodeBytes decodes binary which might be encoded as msgpack bin or
+as an array of integers (the default for Vec<u8> in Rust).
+*/
+func decodeBytes(dec *msgpack.Decoder) ([]byte, error) {
+	c, err := dec.PeekCode()
+	if err != nil {
+		return nil, err
+	}
+	if !msgpcode.IsFixedArray(c) && c != msgpcode.Array16 && c != msgpcode.Array32 {
+		return dec.DecodeBytes()
+	}
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	for i := range b {
+		if b[i], err = dec.DecodeUint8(); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,238 @@
+package nu
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+/*
+tableStreamThreshold is the row count above which ReturnTable returns the
+table as list stream rather than single List Value.
+*/
+const tableStreamThreshold = 1000
+
+/*
+ReturnTable returns rows (slice or array of structs or pointers to struct)
+as table, ie List of Records. Each exported field of the struct becomes a
+column of the table, field's "nu" tag can be used to set the name of the
+column, fields tagged with `nu:"-"` are skipped. Fields of embedded structs
+(without "nu" tag) are promoted to the columns of the outer struct.
+
+Field values are converted as follows:
+
+  - Value is used as is;
+  - types supported by the Value encoder (ie [time.Time], [Filesize], [Glob],
+    []byte) are used as is;
+  - bool, integer, float and string kinds (including named types) are
+    converted to Bool, Int, Float and String;
+  - nil pointer is converted to Nothing, otherwise pointee is converted;
+  - struct is converted to Record, slices to List and maps with string key
+    to Record.
+
+Big tables (more than 1000 rows) are returned as list stream.
+*/
+func (ec *ExecCommand) ReturnTable(ctx context.Context, rows any) error {
+	rv := reflect.ValueOf(rows)
+	if k := rv.Kind(); k != reflect.Slice && k != reflect.Array {
+		return fmt.Errorf("rows must be slice of structs, got %T", rows)
+	}
+	if et := rv.Type().Elem(); et.Kind() != reflect.Struct && (et.Kind() != reflect.Pointer || et.Elem().Kind() != reflect.Struct) {
+		return fmt.Errorf("rows must be slice of structs, got %T", rows)
+	}
+
+	row := func(i int) (Value, error) {
+		v, err := reflectToValue(rv.Index(i))
+		if err != nil {
+			return v, fmt.Errorf("converting row [%d]: %w", i, err)
+		}
+		reSpan(&v, ec.Head)
+		return v, nil
+	}
+
+	if rv.Len() <= tableStreamThreshold {
+		lst := make([]Value, rv.Len())
+		for i := range lst {
+			var err error
+			if lst[i], err = row(i); err != nil {
+				return err
+			}
+		}
+		return ec.ReturnValue(ctx, Value{Value: lst, Span: ec.Head})
+	}
+
+	out, err := ec.ReturnListStream(ctx)
+	if err != nil {
+		return fmt.Errorf("opening output stream: %w", err)
+	}
+	defer close(out)
+	for i := range rv.Len() {
+		v, err := row(i)
+		if err != nil {
+			return err
+		}
+		select {
+		case out <- v:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+	return nil
+}
+
+/*
+ReturnStructStream returns list stream (see [ExecCommand.ReturnListStream]) of
+records, ie table. Each struct sent to the returned chan is converted to the
+row of the table using the same rules as [ExecCommand.ReturnTable]. T must be
+struct or pointer to struct.
+
+To signal the end of data the chan must be closed. When the consumer drops
+the stream the ctx passed to the OnRun handler is cancelled and the rest of
+the structs sent to the chan are discarded. When converting the struct fails
+Error Value is sent to the consumer instead of the row (which fails the call
+of the command).
+*/
+func ReturnStructStream[T any](ctx context.Context, ec *ExecCommand, opts ...ListStreamOption) (chan<- T, error) {
+	if et := reflect.TypeFor[T](); et.Kind() != reflect.Struct && (et.Kind() != reflect.Pointer || et.Elem().Kind() != reflect.Struct) {
+		return nil, fmt.Errorf("type parameter must be struct or pointer to struct, got %s", et)
+	}
+
+	out, err := ec.ReturnListStream(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("opening output stream: %w", err)
+	}
+
+	in := make(chan T)
+	go func() {
+		defer close(out)
+		for item := range in {
+			if ctx.Err() != nil {
+				continue
+			}
+			v, err := reflectToValue(reflect.ValueOf(&item).Elem())
+			if err != nil {
+				v = ErrorValue(fmt.Errorf("converting row: %w", err), ec.Head)
+			} else {
+				reSpan(&v, ec.Head)
+			}
+			select {
+			case out <- v:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return in, nil
+}
+
+/*
+reflectToValue converts Go value to Value, see [ExecCommand.ReturnTable]
+for the conversion rules.
+*/
+func reflectToValue(rv reflect.Value) (Value, error) {
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return Value{}, nil
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return Value{}, nil
+		}
+		return reflectToValue(rv.Elem())
+	}
+
+	switch v := rv.Interface().(type) {
+	case Value:
+		return v, nil
+	case time.Time, time.Duration, Filesize, Glob, Record, []Value, []byte, IntRange, FloatRange, CellPath, Closure, Block:
+		return Value{Value: v}, nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		return Value{Value: rv.Bool()}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Value{Value: rv.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n := rv.Uint(); n <= math.MaxInt64 {
+			return Value{Value: int64(n)}, nil
+		}
+		return Value{}, fmt.Errorf("value %d overflows Int", rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return Value{Value: rv.Float()}, nil
+	case reflect.String:
+		return Value{Value: rv.String()}, nil
+	case reflect.Struct:
+		rec := Record{}
+		if err := structToRecord(rv, rec); err != nil {
+			return Value{}, err
+		}
+		return Value{Value: rec}, nil
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8 {
+			return Value{Value: rv.Bytes()}, nil
+		}
+		lst := make([]Value, rv.Len())
+		for i := range lst {
+			var err error
+			if lst[i], err = reflectToValue(rv.Index(i)); err != nil {
+				return Value{}, fmt.Errorf("item [%d]: %w", i, err)
+			}
+		}
+		return Value{Value: lst}, nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		rec := make(Record, rv.Len())
+		for iter := rv.MapRange(); iter.Next(); {
+			v, err := reflectToValue(iter.Value())
+			if err != nil {
+				return Value{}, fmt.Errorf("key %q: %w", iter.Key().String(), err)
+			}
+			rec[iter.Key().String()] = v
+		}
+		return Value{Value: rec}, nil
+	}
+	return Value{}, fmt.Errorf("unsupported type %s", rv.Type())
+}
+
+// structToRecord adds exported fields of the struct rv into rec.
+func structToRecord(rv reflect.Value, rec Record) error {
+	for i := range rv.NumField() {
+		f := rv.Type().Field(i)
+		tag := f.Tag.Get("nu")
+		if tag == "-" {
+			continue
+		}
+		if f.Anonymous && tag == "" {
+			fv := rv.Field(i)
+			if fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				if err := structToRecord(fv, rec); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+
+		name := f.Name
+		if tag != "" {
+			name = tag
+		}
+		v, err := reflectToValue(rv.Field(i))
+		if err != nil {
+			return fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		rec[name] = v
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package nu
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ainvaltin/nu-plugin/types"
+)
+
+func Test_ExecCommand_ReturnTable(t *testing.T) {
+	type base struct {
+		ID uint16 `nu:"id"`
+	}
+	type row struct {
+		base
+		Name    string
+		Size    Filesize `nu:"size"`
+		Tags    []string
+		Parent  *row
+		Skipped int `nu:"-"`
+		private int
+	}
+
+	rows := []row{
+		{base: base{ID: 1}, Name: "foo", Size: 10, Tags: []string{"a", "b"}},
+		{base: base{ID: 2}, Name: "bar", Size: 20, Parent: &row{base: base{ID: 1}, Name: "foo"}, Skipped: 5, private: 6},
+	}
+
+	newPlugin := func(t *testing.T, rows any) *Plugin {
+		p, err := New(
+			[]*Command{{
+				Signature: PluginSignature{
+					Name:             "table",
+					Category:         CategoryExperimental,
+					Desc:             "test cmd",
+					SearchTerms:      []string{"table"},
+					InputOutputTypes: []InOutTypes{{In: types.Nothing(), Out: types.Any()}},
+				},
+				OnRun: func(ctx context.Context, exec *ExecCommand) error {
+					return exec.ReturnTable(ctx, rows)
+				},
+			}},
+			"",
+			&Config{Logger: logger(t)},
+		)
+		if err != nil {
+			t.Fatalf("creating plugin: %v", err)
+		}
+		return p
+	}
+
+	t.Run("table", func(t *testing.T) {
+		head := Span{Start: 1, End: 6}
+		nothing := Value{Span: head}
+		expect := Value{
+			Span: head,
+			Value: []Value{
+				{Span: head, Value: Record{
+					"id": {Value: int64(1), Span: head}, "Name": {Value: "foo", Span: head}, "size": {Value: Filesize(10), Span: head},
+					"Tags":   {Value: []Value{{Value: "a", Span: head}, {Value: "b", Span: head}}, Span: head},
+					"Parent": nothing,
+				}},
+				{Span: head, Value: Record{
+					"id": {Value: int64(2), Span: head}, "Name": {Value: "bar", Span: head}, "size": {Value: Filesize(20), Span: head},
+					"Tags": {Value: []Value{}, Span: head},
+					"Parent": {Span: head, Value: Record{
+						"id": {Value: int64(1), Span: head}, "Name": {Value: "foo", Span: head}, "size": {Value: Filesize(0), Span: head},
+						"Tags": {Value: []Value{}, Span: head}, "Parent": nothing,
+					}},
+				}},
+			},
+		}
+		runEngine(t, newPlugin(t, rows), append(protocolPrelude,
+			msgDef{send: &call{ID: 1, Call: run{Name: "table", Call: evaluatedCall{Head: head}}}},
+			msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: expect}}},
+		))
+	})
+
+	t.Run("not a slice of structs", func(t *testing.T) {
+		ec := &ExecCommand{}
+		expectErrorMsg(t, ec.ReturnTable(context.Background(), rows[0]), `rows must be slice of structs, got nu.row`)
+		expectErrorMsg(t, ec.ReturnTable(context.Background(), []int{1}), `rows must be slice of structs, got []int`)
+	})
+}
+
+func Test_ReturnStructStream(t *testing.T) {
+	type row struct {
+		Name string `nu:"name"`
+		Size int    `nu:"size"`
+		Any  any    `nu:"any"`
+	}
+
+	p, err := New(
+		[]*Command{{
+			Signature: PluginSignature{
+				Name:             "table",
+				Category:         CategoryExperimental,
+				Desc:             "test cmd",
+				SearchTerms:      []string{"table"},
+				InputOutputTypes: []InOutTypes{{In: types.Nothing(), Out: types.Any()}},
+			},
+			OnRun: func(ctx context.Context, exec *ExecCommand) error {
+				out, err := ReturnStructStream[*row](ctx, exec)
+				if err != nil {
+					return err
+				}
+				go func() {
+					defer close(out)
+					for _, r := range []*row{{Name: "foo", Size: 1}, nil, {Name: "bad", Any: make(chan int)}} {
+						select {
+						case out <- r:
+						case <-ctx.Done():
+							return
+						}
+					}
+				}()
+				return nil
+			},
+		}},
+		"",
+		&Config{Logger: logger(t)},
+	)
+	if err != nil {
+		t.Fatalf("creating plugin: %v", err)
+	}
+
+	head := Span{Start: 1, End: 6}
+	runEngine(t, p, append(protocolPrelude,
+		msgDef{send: &call{ID: 1, Call: run{Name: "table", Call: evaluatedCall{Head: head}}}},
+		msgDef{recv: callResponse{ID: 1, Response: pipelineData{Data: listStream{ID: 1}}}},
+		msgDef{recv: data{ID: 1, Data: Value{Span: head, Value: Record{
+			"name": {Value: "foo", Span: head}, "size": {Value: int64(1), Span: head}, "any": {Span: head},
+		}}}},
+		msgDef{send: &ack{ID: 1}},
+		msgDef{recv: data{ID: 1, Data: Value{Span: head}}},
+		msgDef{send: &ack{ID: 1}},
+		msgDef{recv: data{ID: 1, Data: Value{Span: head, Value: LabeledError{Msg: "converting row: field Any: unsupported type chan int"}}}},
+		msgDef{send: &ack{ID: 1}},
+		msgDef{recv: end{ID: 1}},
+		msgDef{send: &drop{ID: 1}},
+	))
+
+	t.Run("invalid type", func(t *testing.T) {
+		_, err := ReturnStructStream[int](context.Background(), &ExecCommand{})
+		expectErrorMsg(t, err, `type parameter must be struct or pointer to struct, got int`)
+	})
+}
+
+func Test_reflectToValue(t *testing.T) {
+	type color string
+	date := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	testCases := []struct {
+		in  any
+		out Value
+	}{
+		{in: nil, out: Value{}},
+		{in: true, out: Value{Value: true}},
+		{in: int8(-3), out: Value{Value: int64(-3)}},
+		{in: uint(7), out: Value{Value: int64(7)}},
+		{in: float32(1.5), out: Value{Value: 1.5}},
+		{in: color("red"), out: Value{Value: "red"}},
+		{in: date, out: Value{Value: date}},
+		{in: time.Second, out: Value{Value: time.Second}},
+		{in: []byte("bin"), out: Value{Value: []byte("bin")}},
+		{in: Value{Value: "as is"}, out: Value{Value: "as is"}},
+		{in: [2]int{1, 2}, out: Value{Value: []Value{{Value: int64(1)}, {Value: int64(2)}}}},
+		{in: map[string]any{"a": 1, "b": nil}, out: Value{Value: Record{"a": {Value: int64(1)}, "b": {}}}},
+	}
+	for _, tc := range testCases {
+		v, err := reflectToValue(reflect.ValueOf(tc.in))
+		if err != nil {
+			t.Errorf("%#v: unexpected error: %v", tc.in, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.out, v); diff != "" {
+			t.Errorf("%#v: mismatch (-want +got):\n%s", tc.in, diff)
+		}
+	}
+
+	_, err := reflectToValue(reflect.ValueOf(map[int]string{1: "one"}))
+	expectErrorMsg(t, err, `unsupported type map[int]string`)
+
+	_, err = reflectToValue(reflect.ValueOf(uint64(1 << 63)))
+	expectErrorMsg(t, err, `value 9223372036854775808 overflows Int`)
+}
@@ -2,8 +2,12 @@ package types
 
 import (
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
 
 	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
 )
 
 /*
@@ -15,6 +19,8 @@ https://docs.rs/nu-protocol/latest/nu_protocol/enum.Type.html
 */
 type Type interface {
 	EncodeMsgpack(enc *msgpack.Encoder) error
+	// String returns the type in the Nushell syntax, ie "list<int>".
+	String() string
 
 	encodeMsgpack(enc *msgpack.Encoder) error
 }
@@ -37,7 +43,119 @@ func (ss *nuType) EncodeMsgpack(enc *msgpack.Encoder) error {
 }
 
 func (ss *nuType) encodeMsgpack(enc *msgpack.Encoder) error {
+	if isSimpleType(ss.typ) {
+		return enc.EncodeString(ss.typ)
+	}
+
 	switch ss.typ {
+	case "Custom": // Custom(Box<str>),
+		if err := encodeMapStart(enc, ss.typ); err != nil {
+			return err
+		}
+		return enc.EncodeString(ss.name)
+	case "List": // List(Box<Type>),
+		if err := encodeMapStart(enc, ss.typ); err != nil {
+			return err
+		}
+		return ss.itmType.encodeMsgpack(enc)
+	case "Record", "Table": // Record(Box<[(String, Type)]>), Table(Box<[(String, Type)]>),
+		if err := encodeMapStart(enc, ss.typ); err != nil {
+			return err
+		}
+		if err := enc.EncodeArrayLen(len(ss.fields)); err != nil {
+			return err
+		}
+		for k, v := range ss.fields {
+			if err := encodeRecordItem(enc, k, v); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported Type: %q", ss.typ)
+	}
+	return nil
+}
+
+func (ss *nuType) String() string {
+	switch ss.typ {
+	case "CellPath":
+		return "cell-path"
+	case "ListStream":
+		return "list-stream"
+	case "Custom":
+		return ss.name
+	case "List":
+		return "list<" + ss.itmType.String() + ">"
+	case "Record", "Table":
+		name := strings.ToLower(ss.typ)
+		if len(ss.fields) == 0 {
+			return name
+		}
+		fields := make([]string, 0, len(ss.fields))
+		for _, k := range slices.Sorted(maps.Keys(ss.fields)) {
+			fields = append(fields, k+": "+ss.fields[k].String())
+		}
+		return name + "<" + strings.Join(fields, ", ") + ">"
+	default:
+		return strings.ToLower(ss.typ)
+	}
+}
+
+/*
+IsSubtype reports whether Value of type t can be used where type of is
+expected, ie Int is subtype of Number and every type is subtype of Any.
+Follows the rules of the Nushell's Type::is_subtype_of.
+*/
+func IsSubtype(t, of Type) bool {
+	this, ok1 := t.(*nuType)
+	that, ok2 := of.(*nuType)
+	if !ok1 || !ok2 {
+		return false
+	}
+
+	switch {
+	case that.typ == "Any":
+		return true
+	case this.typ == that.typ:
+		switch this.typ {
+		case "List":
+			return IsSubtype(this.itmType, that.itmType)
+		case "Record", "Table":
+			return isSubtypeFields(this.fields, that.fields)
+		case "Custom":
+			return this.name == that.name
+		}
+		return true
+	case that.typ == "Number":
+		return this.typ == "Int" || this.typ == "Float"
+	case this.typ == "Table" && that.typ == "List":
+		itm := that.itmType.(*nuType)
+		return itm.typ == "Any" || (itm.typ == "Record" && isSubtypeFields(this.fields, itm.fields))
+	}
+	return false
+}
+
+/*
+isSubtypeFields reports whether record (or table) with fields this is
+subtype of the record with fields that, ie this has all the fields of that
+(and field types are subtypes). Empty field list means "any fields".
+*/
+func isSubtypeFields(this, that RecordDef) bool {
+	if len(this) == 0 || len(that) == 0 {
+		return true
+	}
+	for name, typ := range that {
+		ft, ok := this[name]
+		if !ok || !IsSubtype(ft, typ) {
+			return false
+		}
+	}
+	return true
+}
+
+// isSimpleType returns true for types which are encoded as plain string.
+func isSimpleType(typ string) bool {
+	switch typ {
 	case
 		"Any",
 		"Binary",
@@ -58,33 +176,75 @@ func (ss *nuType) encodeMsgpack(enc *msgpack.Encoder) error {
 		"Signature",
 		"String",
 		"Glob":
-		return enc.EncodeString(ss.typ)
-	case "Custom": // Custom(Box<str>),
-		if err := encodeMapStart(enc, ss.typ); err != nil {
-			return err
+		return true
+	}
+	return false
+}
+
+/*
+Decode reads Type from the decoder, it is the inverse of the Type's
+EncodeMsgpack method.
+*/
+func Decode(dec *msgpack.Decoder) (Type, error) {
+	c, err := dec.PeekCode()
+	if err != nil {
+		return nil, err
+	}
+	if msgpcode.IsFixedString(c) || msgpcode.IsString(c) {
+		typ, err := dec.DecodeString()
+		if err != nil {
+			return nil, err
 		}
-		return enc.EncodeString(ss.name)
-	case "List": // List(Box<Type>),
-		if err := encodeMapStart(enc, ss.typ); err != nil {
-			return err
+		if !isSimpleType(typ) {
+			return nil, fmt.Errorf("unsupported Type: %q", typ)
 		}
-		return ss.itmType.encodeMsgpack(enc)
-	case "Record", "Table": // Record(Box<[(String, Type)]>), Table(Box<[(String, Type)]>),
-		if err := encodeMapStart(enc, ss.typ); err != nil {
-			return err
+		return &nuType{typ: typ}, nil
+	}
+
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		return nil, fmt.Errorf("decoding Type: %w", err)
+	}
+	if n != 1 {
+		return nil, fmt.Errorf("expected Type map to contain one item, got %d", n)
+	}
+	typ, err := dec.DecodeString()
+	if err != nil {
+		return nil, fmt.Errorf("decoding Type name: %w", err)
+	}
+	switch typ {
+	case "Custom":
+		name, err := dec.DecodeString()
+		if err != nil {
+			return nil, fmt.Errorf("decoding Custom type name: %w", err)
 		}
-		if err := enc.EncodeArrayLen(len(ss.fields)); err != nil {
-			return err
+		return Custom(name), nil
+	case "List":
+		itemType, err := Decode(dec)
+		if err != nil {
+			return nil, fmt.Errorf("decoding List item type: %w", err)
 		}
-		for k, v := range ss.fields {
-			if err := encodeRecordItem(enc, k, v); err != nil {
-				return err
+		return List(itemType), nil
+	case "Record", "Table":
+		n, err := dec.DecodeArrayLen()
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s field count: %w", typ, err)
+		}
+		t := &nuType{typ: typ}
+		if n > 0 {
+			t.fields = make(RecordDef, n)
+		}
+		for range n {
+			name, ft, err := decodeRecordItem(dec)
+			if err != nil {
+				return nil, fmt.Errorf("decoding %s field: %w", typ, err)
 			}
+			t.fields[name] = ft
 		}
+		return t, nil
 	default:
-		return fmt.Errorf("unsupported Type: %q", ss.typ)
+		return nil, fmt.Errorf("unsupported Type: %q", typ)
 	}
-	return nil
 }
 
 func Any() Type {
@@ -198,3 +358,19 @@ func encodeRecordItem(enc *msgpack.Encoder, name string, typ Type) error {
 	}
 	return typ.encodeMsgpack(enc)
 }
+
+func decodeRecordItem(dec *msgpack.Decoder) (string, Type, error) {
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return "", nil, err
+	}
+	if n != 2 {
+		return "", nil, fmt.Errorf("expected record item to be tuple of two, got %d items", n)
+	}
+	name, err := dec.DecodeString()
+	if err != nil {
+		return "", nil, err
+	}
+	typ, err := Decode(dec)
+	return name, typ, err
+}
@@ -1,11 +1,20 @@
 package nu
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"iter"
 	"log/slog"
+	"maps"
 	"reflect"
+	"slices"
+	"sync/atomic"
 
 	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
 )
 
 func attrError(err error) slog.Attr {
@@ -94,6 +103,14 @@ decodeWrapperMap reads the "single item map" whose key is string - the
 key name is returned and decoder is ready to read the value.
 */
 func decodeWrapperMap(dec *msgpack.Decoder) (string, error) {
+	c, err := dec.PeekCode()
+	if err != nil {
+		return "", fmt.Errorf("reading wrapper map start code: %w", err)
+	}
+	if !isMapCode(c) {
+		return "", fmt.Errorf("expected wrapper map (single item map with string key), got %s", describeCode(c))
+	}
+
 	cnt, err := dec.DecodeMapLen()
 	if err != nil {
 		return "", fmt.Errorf("reading map length: %w", err)
@@ -108,3 +125,181 @@ func decodeWrapperMap(dec *msgpack.Decoder) (string, error) {
 	}
 	return keyName, nil
 }
+
+func isMapCode(c byte) bool {
+	return msgpcode.IsFixedMap(c) || c == msgpcode.Map16 || c == msgpcode.Map32
+}
+
+/*
+describeCode returns human readable description of the msgpack type code,
+ie "string (code 0xa3)".
+*/
+func describeCode(c byte) string {
+	var kind string
+	switch {
+	case c == msgpcode.Nil:
+		kind = "nil"
+	case c == msgpcode.True || c == msgpcode.False:
+		kind = "bool"
+	case msgpcode.IsFixedNum(c), c >= msgpcode.Uint8 && c <= msgpcode.Int64:
+		kind = "integer"
+	case c == msgpcode.Float || c == msgpcode.Double:
+		kind = "float"
+	case msgpcode.IsString(c):
+		kind = "string"
+	case msgpcode.IsBin(c):
+		kind = "binary"
+	case msgpcode.IsFixedArray(c), c == msgpcode.Array16, c == msgpcode.Array32:
+		kind = "array"
+	case isMapCode(c):
+		kind = "map"
+	case msgpcode.IsExt(c):
+		kind = "extension"
+	default:
+		kind = "unknown type"
+	}
+	return fmt.Sprintf("%s (code 0x%x)", kind, c)
+}
+
+/*
+limitReader fails the read when more than limit bytes has been consumed
+since the last reset. It implements io.ByteScanner so msgpack decoder uses
+it directly (without it's own buffering), ie the count is exact.
+*/
+type limitReader struct {
+	r     *bufio.Reader
+	n     int64 // bytes consumed since the last reset
+	limit int64
+}
+
+func (lr *limitReader) reset() { lr.n = 0 }
+
+func (lr *limitReader) err() error {
+	return fmt.Errorf("message is bigger than %d bytes: %w", lr.limit, ErrMessageTooLarge)
+}
+
+func (lr *limitReader) Read(b []byte) (int, error) {
+	if lr.n >= lr.limit {
+		return 0, lr.err()
+	}
+	if rem := lr.limit - lr.n; int64(len(b)) > rem {
+		b = b[:rem]
+	}
+	n, err := lr.r.Read(b)
+	lr.n += int64(n)
+	return n, err
+}
+
+func (lr *limitReader) ReadByte() (byte, error) {
+	if lr.n >= lr.limit {
+		return 0, lr.err()
+	}
+	b, err := lr.r.ReadByte()
+	if err == nil {
+		lr.n++
+	}
+	return b, err
+}
+
+func (lr *limitReader) UnreadByte() error {
+	err := lr.r.UnreadByte()
+	if err == nil {
+		lr.n--
+	}
+	return err
+}
+
+/*
+inputReader records the first error (other than io.EOF) returned by the
+underlying reader so that I/O errors can be told apart from decoding errors.
+*/
+type inputReader struct {
+	r   io.Reader
+	err atomic.Pointer[error]
+}
+
+func (ir *inputReader) Read(b []byte) (int, error) {
+	n, err := ir.r.Read(b)
+	if err != nil && err != io.EOF {
+		ir.err.CompareAndSwap(nil, &err)
+	}
+	return n, err
+}
+
+// Err returns the I/O error of the underlying reader, nil if there was none.
+func (ir *inputReader) Err() error {
+	if err := ir.err.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+/*
+optsReader is used as the input of the msgpack decoder to pass options to
+the custom decoders (ie Value's decoder) and to collect information about
+the decoded message.
+
+msgpack decoder doesn't support user defined options so custom decoders
+check the type of the decoder's input instead.
+*/
+type optsReader struct {
+	byteReader
+	opts *decodeOpts
+}
+
+type decodeOpts struct {
+	retainRaw  bool     // retain raw msgpack of the Values, see [Config.RetainRawValues]
+	duplicates []string // duplicate Record field names seen while decoding the message
+}
+
+// byteReader is the interface msgpack decoder uses without extra buffering.
+type byteReader interface {
+	io.Reader
+	io.ByteScanner
+}
+
+// decoderOpts returns options of the dec, nil when dec doesn't read from optsReader.
+func decoderOpts(dec *msgpack.Decoder) *decodeOpts {
+	if r, ok := dec.Buffered().(optsReader); ok {
+		return r.opts
+	}
+	return nil
+}
+
+// retainRawValues reports whether Values decoded by dec must retain raw msgpack.
+func retainRawValues(dec *msgpack.Decoder) bool {
+	opts := decoderOpts(dec)
+	return opts != nil && opts.retainRaw
+}
+
+/*
+sortedKeysBuffer is used as the output of the msgpack encoder to signal to
+the custom encoders of the map-like types (Record, NamedParams) that keys
+must be encoded in sorted order, see [Config.SortMapKeys].
+
+msgpack encoder doesn't expose it's flags so custom encoders can't check
+is the SetSortMapKeys option set.
+*/
+type sortedKeysBuffer struct{ *bytes.Buffer }
+
+// mapKeys returns keys of m, sorted when enc writes into sortedKeysBuffer.
+func mapKeys[V any](enc *msgpack.Encoder, m map[string]V) iter.Seq[string] {
+	if _, ok := enc.Writer().(sortedKeysBuffer); ok {
+		return slices.Values(slices.Sorted(maps.Keys(m)))
+	}
+	return maps.Keys(m)
+}
+
+// ctxReader is io.Reader which fails with the cause of the ctx once the ctx
+// is cancelled, the pending Read of the wrapped reader is not interrupted.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if cr.ctx.Err() != nil {
+		return 0, context.Cause(cr.ctx)
+	}
+	return cr.r.Read(p)
+}
@@ -0,0 +1,54 @@
+package nu
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func Test_decodeWrapperMap(t *testing.T) {
+	decode := func(t *testing.T, v any) (string, error) {
+		t.Helper()
+		b, err := msgpack.Marshal(v)
+		if err != nil {
+			t.Fatalf("encoding %T: %v", v, err)
+		}
+		return decodeWrapperMap(msgpack.NewDecoder(bytes.NewReader(b)))
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		key, err := decode(t, map[string]int{"Int": 1})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if key != "Int" {
+			t.Errorf("expected key %q, got %q", "Int", key)
+		}
+	})
+
+	t.Run("not a map", func(t *testing.T) {
+		testCases := []struct {
+			v   any
+			err string
+		}{
+			{v: nil, err: `expected wrapper map (single item map with string key), got nil (code 0xc0)`},
+			{v: true, err: `expected wrapper map (single item map with string key), got bool (code 0xc3)`},
+			{v: 5, err: `expected wrapper map (single item map with string key), got integer (code 0x5)`},
+			{v: 500, err: `expected wrapper map (single item map with string key), got integer (code 0xcd)`},
+			{v: 1.5, err: `expected wrapper map (single item map with string key), got float (code 0xcb)`},
+			{v: "Int", err: `expected wrapper map (single item map with string key), got string (code 0xa3)`},
+			{v: []byte{1}, err: `expected wrapper map (single item map with string key), got binary (code 0xc4)`},
+			{v: []int{1, 2}, err: `expected wrapper map (single item map with string key), got array (code 0x92)`},
+		}
+		for _, tc := range testCases {
+			_, err := decode(t, tc.v)
+			expectErrorMsg(t, err, tc.err)
+		}
+	})
+
+	t.Run("map with multiple items", func(t *testing.T) {
+		_, err := decode(t, map[string]int{"a": 1, "b": 2})
+		expectErrorMsg(t, err, `wrapper map is expected to contain one item, got 2`)
+	})
+}
@@ -1,12 +1,18 @@
 package nu
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/vmihailenco/msgpack/v5"
 	"github.com/vmihailenco/msgpack/v5/msgpcode"
+
+	"github.com/ainvaltin/nu-plugin/types"
 )
 
 /*
@@ -40,7 +46,8 @@ Incoming data is encoded as follows:
   - Glob -> [Glob]
   - Closure -> [Closure]
   - Block -> [Block]
-  - Range -> [IntRange]
+  - Range -> [IntRange] or [FloatRange] (see [Range])
+  - CellPath -> [CellPath]
 
 Outgoing values are encoded as:
 
@@ -49,7 +56,7 @@ Outgoing values are encoded as:
   - uint, uint8, uint16, uint32, uint64 -> Int
   - float64, float32 -> Float
   - bool -> Bool
-  - []byte -> Binary
+  - []byte -> Binary (nil slice is encoded as empty Binary, see [NothingIfNil])
   - string -> String
   - [Filesize] -> Filesize
   - [time.Duration] -> Duration
@@ -59,7 +66,8 @@ Outgoing values are encoded as:
   - [Glob] -> Glob
   - [Closure] -> Closure
   - [Block] -> Block
-  - [IntRange] -> Range
+  - [IntRange], [FloatRange] -> Range
+  - [CellPath] -> CellPath
   - error -> LabeledError
 
 [Nushell Value]: https://www.nushell.sh/contributor-book/plugin_protocol_reference.html#value-types
@@ -69,6 +77,118 @@ type Value struct {
 	Span  Span
 }
 
+/*
+NothingIfNil returns Nothing Value when b is nil and Binary Value otherwise.
+By default nil []byte is encoded as empty Binary, use NothingIfNil when nil
+slice means "no value".
+*/
+func NothingIfNil(b []byte) Value {
+	if b == nil {
+		return Value{}
+	}
+	return Value{Value: b}
+}
+
+/*
+ErrorValue returns Error Value for err (converted using [AsLabeledError]),
+nil error is converted to Nothing.
+
+Error Value is ordinary data from the protocol's point of view, but when
+Nushell encounters it in the pipeline (ie as an item of the list stream
+returned by [ExecCommand.ReturnListStream]) it raises the error, aborting
+the pipeline. So to fail the whole command return error from the OnRun
+handler, sending ErrorValue as stream item is for the cases where part of
+the output has already been sent.
+*/
+func ErrorValue(err error, span Span) Value {
+	if err == nil {
+		return Value{Span: span}
+	}
+	return Value{Value: *AsLabeledError(err), Span: span}
+}
+
+/*
+ToDateValue returns Date Value of t converted to the location loc, when loc
+is nil the location of t is preserved. Date is sent to the engine as RFC3339
+string so the location only determines the UTC offset Nushell displays the
+date with, ie use [time.UTC] or [time.Local] to normalize the dates.
+*/
+func ToDateValue(t time.Time, loc *time.Location) Value {
+	if loc != nil {
+		t = t.In(loc)
+	}
+	return Value{Value: t}
+}
+
+/*
+IsNothing reports whether v is Nothing Value.
+*/
+func (v Value) IsNothing() bool { return v.Value == nil }
+
+/*
+AsBoolLoose converts v to bool, in addition to Bool Value it accepts:
+
+  - Int 0 and 1;
+  - String "true", "false", "yes", "no", "1" and "0" (case-insensitive).
+
+For other Values [LabeledError] is returned.
+*/
+func (v Value) AsBoolLoose() (bool, error) {
+	switch data := v.Value.(type) {
+	case bool:
+		return data, nil
+	case int64:
+		if data == 0 || data == 1 {
+			return data == 1, nil
+		}
+	case int:
+		if data == 0 || data == 1 {
+			return data == 1, nil
+		}
+	case string:
+		switch strings.ToLower(data) {
+		case "true", "yes", "1":
+			return true, nil
+		case "false", "no", "0":
+			return false, nil
+		}
+	}
+	return false, &LabeledError{
+		Msg:    "can't convert value to bool",
+		Labels: []ErrorLabel{{Text: fmt.Sprintf("expected bool, 0/1 or true/false/yes/no, got %s", typeOf(v.Value)), Span: v.Span}},
+	}
+}
+
+/*
+IsEmpty reports whether v is "empty": Nothing, empty String, empty List,
+empty Record or zero length Binary. Nushell's "is-empty" command uses the
+same definition.
+*/
+func (v Value) IsEmpty() bool {
+	switch data := v.Value.(type) {
+	case nil:
+		return true
+	case string:
+		return data == ""
+	case []Value:
+		return len(data) == 0
+	case Record:
+		return len(data) == 0
+	case []byte:
+		return len(data) == 0
+	default:
+		return false
+	}
+}
+
+/*
+Span is the location of the Value in the source code, as byte offsets.
+
+The protocol requires span for every Value, zero Span is what Nushell uses
+as "unknown span" (Span::unknown) so Values created by the plugin don't need
+to set it. Use [ExecCommand.Head] as the span of the Value derived from the
+command call to point error messages to the command.
+*/
 type Span struct {
 	Start int `msgpack:"start"`
 	End   int `msgpack:"end"`
@@ -119,6 +239,206 @@ Block is Nushell [Block Value] type.
 */
 type Block uint64
 
+var _ json.Marshaler = Value{}
+
+/*
+MarshalJSON implements [json.Marshaler], the Value is encoded as:
+
+  - Record -> object
+  - List -> array
+  - Binary -> base64 encoded string
+  - Date -> RFC3339 string
+  - Filesize -> number of bytes
+  - Duration -> number of nanoseconds
+  - Glob, CellPath -> string
+  - Range -> array of the values in the range (unbounded range is an error)
+  - error -> object with "error" field containing the error message
+  - Closure, Block -> error
+
+Span of the Value is not included.
+*/
+func (v Value) MarshalJSON() ([]byte, error) {
+	switch data := v.Value.(type) {
+	case Record:
+		return json.Marshal(map[string]Value(data))
+	case []Value:
+		if data == nil {
+			data = []Value{}
+		}
+		return json.Marshal(data)
+	case Filesize:
+		return json.Marshal(int64(data))
+	case time.Duration:
+		return json.Marshal(int64(data))
+	case time.Time:
+		return json.Marshal(data.Format(time.RFC3339Nano))
+	case Glob:
+		return json.Marshal(data.Value)
+	case CellPath:
+		return json.Marshal(data.String())
+	case IntRange:
+		if data.Bound == Unbounded {
+			return nil, fmt.Errorf("unbounded range can't be marshaled to JSON")
+		}
+		return json.Marshal(slices.Collect(data.All()))
+	case FloatRange:
+		if data.Bound == Unbounded {
+			return nil, fmt.Errorf("unbounded range can't be marshaled to JSON")
+		}
+		return json.Marshal(slices.Collect(data.All()))
+	case LabeledError:
+		return json.Marshal(map[string]string{"error": data.Error()})
+	case error:
+		return json.Marshal(map[string]string{"error": data.Error()})
+	case Closure, Block:
+		return nil, fmt.Errorf("%T Value can't be marshaled to JSON", data)
+	default:
+		return json.Marshal(data)
+	}
+}
+
+var _ json.Unmarshaler = (*Value)(nil)
+
+/*
+UnmarshalJSON implements [json.Unmarshaler], JSON is decoded as:
+
+  - object -> Record
+  - array -> List
+  - number -> Int (int64) when it is an integer which fits into int64,
+    Float (float64) otherwise
+  - string -> String
+  - bool -> Bool
+  - null -> Nothing
+
+NB! the conversion is lossy when compared to [Value.MarshalJSON]: Binary,
+Date, Filesize, Duration etc are not recovered (ie Binary is decoded as
+base64 encoded String and Filesize as Int). Span of the Value is not set.
+*/
+func (v *Value) UnmarshalJSON(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var data any
+	if err := dec.Decode(&data); err != nil {
+		return err
+	}
+	*v = jsonToValue(data)
+	return nil
+}
+
+func jsonToValue(data any) Value {
+	switch tv := data.(type) {
+	case map[string]any:
+		rec := make(Record, len(tv))
+		for k, item := range tv {
+			rec[k] = jsonToValue(item)
+		}
+		return Value{Value: rec}
+	case []any:
+		lst := make([]Value, len(tv))
+		for i, item := range tv {
+			lst[i] = jsonToValue(item)
+		}
+		return Value{Value: lst}
+	case json.Number:
+		if n, err := tv.Int64(); err == nil {
+			return Value{Value: n}
+		}
+		f, _ := tv.Float64()
+		return Value{Value: f}
+	default:
+		// string, bool or nil
+		return Value{Value: tv}
+	}
+}
+
+/*
+typeOf returns the Nushell Type of the Value v.
+*/
+func typeOf(v any) types.Type {
+	switch tv := v.(type) {
+	case nil:
+		return types.Nothing()
+	case Value:
+		return typeOf(tv.Value)
+	case bool:
+		return types.Bool()
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return types.Int()
+	case float32, float64:
+		return types.Float()
+	case string:
+		return types.String()
+	case []byte:
+		return types.Binary()
+	case Filesize:
+		return types.Filesize()
+	case time.Duration:
+		return types.Duration()
+	case time.Time:
+		return types.Date()
+	case Record:
+		fields := make(types.RecordDef, len(tv))
+		for k, v := range tv {
+			fields[k] = typeOf(v.Value)
+		}
+		return types.Record(fields)
+	case []Value:
+		return typeOfList(tv)
+	case Glob:
+		return types.Glob()
+	case Closure:
+		return types.Closure()
+	case Block:
+		return types.Block()
+	case IntRange, FloatRange:
+		return types.Range()
+	case CellPath:
+		return types.CellPath()
+	case error, LabeledError:
+		return types.Error()
+	default:
+		return types.Any()
+	}
+}
+
+/*
+typeOfList returns Table type when all the items are Records (the columns
+are the fields present in all the records with the same type), List of the
+common item type or List of Any when item types differ.
+*/
+func typeOfList(items []Value) types.Type {
+	if len(items) == 0 {
+		return types.List(types.Any())
+	}
+
+	if rec, ok := items[0].Value.(Record); ok {
+		cols := make(types.RecordDef, len(rec))
+		for k, v := range rec {
+			cols[k] = typeOf(v.Value)
+		}
+		for _, item := range items[1:] {
+			rec, ok := item.Value.(Record)
+			if !ok {
+				return types.List(types.Any())
+			}
+			for k, t := range cols {
+				if v, ok := rec[k]; !ok || typeOf(v.Value).String() != t.String() {
+					delete(cols, k)
+				}
+			}
+		}
+		return types.Table(cols)
+	}
+
+	t := typeOf(items[0].Value)
+	for _, item := range items[1:] {
+		if typeOf(item.Value).String() != t.String() {
+			return types.List(types.Any())
+		}
+	}
+	return types.List(t)
+}
+
 var _ msgpack.CustomEncoder = (*Value)(nil)
 
 func (v *Value) EncodeMsgpack(enc *msgpack.Encoder) error {
@@ -217,7 +537,12 @@ func (v *Value) EncodeMsgpack(enc *msgpack.Encoder) error {
 		if err := startValue(enc, "Binary"); err != nil {
 			return err
 		}
-		err = enc.EncodeBytes(tv)
+		if tv == nil {
+			// msgpack encodes nil slice as nil which Nushell rejects as Binary
+			err = enc.EncodeBytesLen(0)
+		} else {
+			err = enc.EncodeBytes(tv)
+		}
 	case Record:
 		if err := startValue(enc, "Record"); err != nil {
 			return err
@@ -225,10 +550,11 @@ func (v *Value) EncodeMsgpack(enc *msgpack.Encoder) error {
 		if err := enc.EncodeMapLen(len(tv)); err != nil {
 			return err
 		}
-		for k, v := range tv {
+		for k := range mapKeys(enc, tv) {
 			if err := enc.EncodeString(k); err != nil {
 				return err
 			}
+			v := tv[k]
 			if err := enc.EncodeValue(reflect.ValueOf(&v)); err != nil {
 				return err
 			}
@@ -252,6 +578,16 @@ func (v *Value) EncodeMsgpack(enc *msgpack.Encoder) error {
 			return err
 		}
 		err = tv.EncodeMsgpack(enc)
+	case FloatRange:
+		if err := startValue(enc, "Range"); err != nil {
+			return err
+		}
+		err = tv.EncodeMsgpack(enc)
+	case CellPath:
+		if err := startValue(enc, "CellPath"); err != nil {
+			return err
+		}
+		err = tv.EncodeMsgpack(enc)
 	case error:
 		err = encodeLabeledError(enc, AsLabeledError(tv))
 	case LabeledError:
@@ -356,7 +692,39 @@ func encodeLabeledError(enc *msgpack.Encoder, le *LabeledError) error {
 
 var _ msgpack.CustomDecoder = (*Value)(nil)
 
+/*
+decodeRetainRaw decodes Value from dec into v and returns the raw msgpack
+encoding of it, see [Config.RetainRawValues].
+*/
+func decodeRetainRaw(dec *msgpack.Decoder, v *Value) (msgpack.RawMessage, error) {
+	raw, err := dec.DecodeRaw()
+	if err != nil {
+		return nil, fmt.Errorf("reading raw Value: %w", err)
+	}
+	nested := &decodeOpts{}
+	if err := v.DecodeMsgpack(msgpack.NewDecoder(optsReader{bytes.NewReader(raw), nested})); err != nil {
+		return nil, err
+	}
+	if opts := decoderOpts(dec); opts != nil {
+		opts.duplicates = append(opts.duplicates, nested.duplicates...)
+	}
+	return raw, nil
+}
+
 func (v *Value) DecodeMsgpack(dec *msgpack.Decoder) error {
+	c, err := dec.PeekCode()
+	if err != nil {
+		return fmt.Errorf("peeking Value start code: %w", err)
+	}
+	if !isMapCode(c) {
+		// skip the unknown item so that decoder stays in sync with the
+		// input and caller may decide to continue with the next item
+		if err := dec.Skip(); err != nil {
+			return fmt.Errorf("skipping unsupported Value encoding (code 0x%x): %w", c, err)
+		}
+		return fmt.Errorf("unsupported Value encoding: expected map, got %s", describeCode(c))
+	}
+
 	name, err := decodeWrapperMap(dec)
 	if err != nil {
 		return fmt.Errorf("decodeWrapperMap: %w", err)
@@ -411,9 +779,7 @@ func (v *Value) decodeValue(dec *msgpack.Decoder, typeName string) error {
 				}
 				v.Value, err = time.Parse(time.RFC3339, d)
 			case "Record":
-				rec := Record{}
-				err = dec.DecodeValue(reflect.ValueOf(&rec))
-				v.Value = rec
+				v.Value, err = decodeRecord(dec)
 			case "Closure":
 				c := Closure{}
 				err = dec.DecodeValue(reflect.ValueOf(&c))
@@ -424,6 +790,10 @@ func (v *Value) decodeValue(dec *msgpack.Decoder, typeName string) error {
 				v.Value = Block(id)
 			case "Range":
 				v.Value, err = decodeMsgpackRange(dec)
+			case "CellPath":
+				cp := CellPath{}
+				err = cp.DecodeMsgpack(dec)
+				v.Value = cp
 			default:
 				return fmt.Errorf("unsupported Value type %q", typeName)
 			}
@@ -435,11 +805,14 @@ func (v *Value) decodeValue(dec *msgpack.Decoder, typeName string) error {
 			if err != nil {
 				return err
 			}
-			lst := make([]Value, cnt)
+			// do not trust the length header to allocate the whole list upfront
+			lst := make([]Value, 0, min(max(cnt, 0), preallocLimit))
 			for i := 0; i < cnt; i++ {
-				if err := lst[i].DecodeMsgpack(dec); err != nil {
+				item := Value{}
+				if err := item.DecodeMsgpack(dec); err != nil {
 					return fmt.Errorf("decoding List item [%d/%d]: %w", i+1, cnt, err)
 				}
+				lst = append(lst, item)
 			}
 			v.Value = lst
 		case "error":
@@ -460,6 +833,43 @@ func (v *Value) decodeValue(dec *msgpack.Decoder, typeName string) error {
 	return nil
 }
 
+/*
+decodeRecord decodes the map of Record fields. When the field name is
+duplicated the last value is used and the name is recorded in the decoder's
+options (when available) so that the plugin can report it once the whole
+message has been decoded, see [Config.RejectDuplicateFields].
+*/
+func decodeRecord(dec *msgpack.Decoder) (Record, error) {
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		return nil, fmt.Errorf("decoding Record field count: %w", err)
+	}
+	rec := make(Record, min(max(n, 0), preallocLimit))
+	for idx := 0; idx < n; idx++ {
+		name, err := dec.DecodeString()
+		if err != nil {
+			return nil, fmt.Errorf("decoding name of the field [%d/%d] of Record: %w", idx+1, n, err)
+		}
+		item := Value{}
+		if err := item.DecodeMsgpack(dec); err != nil {
+			return nil, fmt.Errorf("decoding Record field %q: %w", name, err)
+		}
+		if _, ok := rec[name]; ok {
+			if opts := decoderOpts(dec); opts != nil {
+				opts.duplicates = append(opts.duplicates, name)
+			}
+		}
+		rec[name] = item
+	}
+	return rec, nil
+}
+
+/*
+preallocLimit is the max number of items allocated upfront based on the
+length header of the decoded array, bigger arrays grow as items are decoded.
+*/
+const preallocLimit = 1024
+
 func decodeBinary(dec *msgpack.Decoder) ([]byte, error) {
 	c, err := dec.PeekCode()
 	if err != nil {
@@ -478,11 +888,13 @@ func decodeBinary(dec *msgpack.Decoder) ([]byte, error) {
 		}
 		// just "dec.ReadFull(buf)" won't work as uint8 might be encoded using
 		// two bytes per value but ArrayLen gives us count of items (not bytes)
-		buf := make([]byte, n)
+		buf := make([]byte, 0, min(n, preallocLimit))
 		for i := 0; i < n; i++ {
-			if buf[i], err = dec.DecodeUint8(); err != nil {
+			b, err := dec.DecodeUint8()
+			if err != nil {
 				return nil, fmt.Errorf("reading array item [%d]: %w", i, err)
 			}
+			buf = append(buf, b)
 		}
 		return buf, nil
 	default:
@@ -1,6 +1,9 @@
 package nu
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -52,9 +55,21 @@ func Test_Value_DeEncode(t *testing.T) {
 		{in: Value{Value: Glob{Value: "[a-z].txt", NoExpand: false}}, out: Value{Value: Glob{Value: "[a-z].txt", NoExpand: false}}},
 		{in: Value{Value: Glob{Value: "**/*.txt", NoExpand: true}}, out: Value{Value: Glob{Value: "**/*.txt", NoExpand: true}}},
 		{in: Value{Value: Glob{Value: "foo.txt"}, Span: Span{Start: 1, End: 8}}, out: Value{Value: Glob{Value: "foo.txt"}, Span: Span{Start: 1, End: 8}}},
+		{in: Value{Value: []byte(nil)}, out: Value{Value: []byte{}}},
+		{in: NothingIfNil(nil), out: Value{}},
+		{in: NothingIfNil([]byte{}), out: Value{Value: []byte{}}},
+		{in: Value{Value: IntRange{Start: 1, Step: 2, End: 9, Bound: Excluded}}, out: Value{Value: IntRange{Start: 1, Step: 2, End: 9, Bound: Excluded}}},
+		{in: Value{Value: FloatRange{Start: 0.5, Step: 0.25, End: 2, Bound: Included}}, out: Value{Value: FloatRange{Start: 0.5, Step: 0.25, End: 2, Bound: Included}}},
+		{in: Value{Value: FloatRange{Start: -1, Step: -0.5, Bound: Unbounded}}, out: Value{Value: FloatRange{Start: -1, Step: -0.5, Bound: Unbounded}}},
+		{in: NothingIfNil([]byte{1}), out: Value{Value: []byte{1}}},
+		{in: Value{Value: []Value{{Value: Glob{Value: "*.go"}}, {Value: Glob{Value: "a*", NoExpand: true}, Span: Span{Start: 2, End: 4}}}}, out: Value{Value: []Value{{Value: Glob{Value: "*.go"}}, {Value: Glob{Value: "a*", NoExpand: true}, Span: Span{Start: 2, End: 4}}}}},
+		{in: Value{Value: Record{"pattern": {Value: Glob{Value: "*.md", NoExpand: true}, Span: Span{Start: 3, End: 7}}}}, out: Value{Value: Record{"pattern": {Value: Glob{Value: "*.md", NoExpand: true}, Span: Span{Start: 3, End: 7}}}}},
 		{in: Value{Value: IntRange{Start: 1, Step: 2, End: 3, Bound: Included}}, out: Value{Value: IntRange{Start: 1, Step: 2, End: 3, Bound: Included}}},
 		{in: Value{Value: IntRange{Start: 1, Step: 2, End: 3, Bound: Excluded}}, out: Value{Value: IntRange{Start: 1, Step: 2, End: 3, Bound: Excluded}}},
 		{in: Value{Value: IntRange{Start: 1, Step: 2, End: 3, Bound: Unbounded}}, out: Value{Value: IntRange{Start: 1, Step: 2, End: 0, Bound: Unbounded}}},
+		{in: Value{Value: CellPath{}}, out: Value{Value: CellPath{Members: []PathMember{}}}},
+		{in: Value{Value: *(&CellPath{}).AddString("foo").AddInteger(2)}, out: Value{Value: *(&CellPath{}).AddString("foo").AddInteger(2)}},
+		{in: Value{Value: CellPath{Members: []PathMember{{Type: PathMemberString, Name: "bar", Optional: true, Span: Span{Start: 3, End: 6}}}}}, out: Value{Value: CellPath{Members: []PathMember{{Type: PathMemberString, Name: "bar", Optional: true, Span: Span{Start: 3, End: 6}}}}}},
 	}
 
 	for x, tc := range testCases {
@@ -75,6 +90,99 @@ func Test_Value_DeEncode(t *testing.T) {
 	}
 }
 
+func Test_Value_encode_span(t *testing.T) {
+	// span is always encoded, zero span is Nushell's "unknown span"
+	for x, in := range []Value{{Value: "foo"}, {Value: "foo", Span: Span{Start: 4, End: 7}}} {
+		bin, err := msgpack.Marshal(&in)
+		if err != nil {
+			t.Errorf("[%d] encoding: %v", x, err)
+			continue
+		}
+		var wire map[string]struct {
+			Span *Span `msgpack:"span"`
+		}
+		if err := msgpack.Unmarshal(bin, &wire); err != nil {
+			t.Errorf("[%d] decoding wire form: %v", x, err)
+			continue
+		}
+		if diff := cmp.Diff(&in.Span, wire["String"].Span); diff != "" {
+			t.Errorf("[%d] span mismatch (-want +got):\n%s", x, diff)
+		}
+	}
+}
+
+func Test_ToDateValue(t *testing.T) {
+	tz := time.FixedZone("UTC+3", 3*60*60)
+	date := time.Date(2024, 5, 17, 10, 30, 45, 0, tz)
+
+	testCases := []struct {
+		loc  *time.Location
+		wire string
+	}{
+		{loc: nil, wire: "2024-05-17T10:30:45+03:00"},
+		{loc: time.UTC, wire: "2024-05-17T07:30:45Z"},
+		{loc: time.FixedZone("UTC-2", -2*60*60), wire: "2024-05-17T05:30:45-02:00"},
+	}
+	for x, tc := range testCases {
+		v := ToDateValue(date, tc.loc)
+		bin, err := msgpack.Marshal(&v)
+		if err != nil {
+			t.Errorf("[%d] encoding: %v", x, err)
+			continue
+		}
+		var wire map[string]struct {
+			Val string `msgpack:"val"`
+		}
+		if err := msgpack.Unmarshal(bin, &wire); err != nil {
+			t.Errorf("[%d] decoding wire form: %v", x, err)
+			continue
+		}
+		if got := wire["Date"].Val; got != tc.wire {
+			t.Errorf("[%d] expected %q, got %q", x, tc.wire, got)
+		}
+		if dv := v.Value.(time.Time); !dv.Equal(date) {
+			t.Errorf("[%d] instant changed: %s", x, dv)
+		}
+	}
+}
+
+func Test_ErrorValue(t *testing.T) {
+	span := Span{Start: 3, End: 8}
+	if diff := cmp.Diff(Value{Span: span}, ErrorValue(nil, span)); diff != "" {
+		t.Errorf("nil error (-expected +got):\n%s", diff)
+	}
+
+	le := &LabeledError{Msg: "not found", Labels: []ErrorLabel{{Text: "here", Span: span}}}
+	testCases := []struct {
+		err error
+		out LabeledError
+	}{
+		{err: errors.New("plain"), out: LabeledError{Msg: "plain"}},
+		{err: le, out: *le},
+		{err: fmt.Errorf("wrapped: %w", le), out: LabeledError{Msg: "wrapped: not found", Labels: le.Labels}},
+	}
+	for x, tc := range testCases {
+		v := ErrorValue(tc.err, span)
+		if diff := cmp.Diff(Value{Value: tc.out, Span: span}, v); diff != "" {
+			t.Errorf("[%d] ErrorValue mismatch (-expected +got):\n%s", x, diff)
+		}
+
+		bin, err := msgpack.Marshal(&v)
+		if err != nil {
+			t.Errorf("[%d] encoding: %v", x, err)
+			continue
+		}
+		var dv Value
+		if err := msgpack.Unmarshal(bin, &dv); err != nil {
+			t.Errorf("[%d] decoding: %v", x, err)
+			continue
+		}
+		if diff := cmp.Diff(v, dv); diff != "" {
+			t.Errorf("[%d] round trip mismatch (-input +output):\n%s", x, diff)
+		}
+	}
+}
+
 func Test_Value_Encode(t *testing.T) {
 	t.Run("unsupported type", func(t *testing.T) {
 		v := Value{Value: 10i}
@@ -86,3 +194,331 @@ func Test_Value_Encode(t *testing.T) {
 		expectErrorMsg(t, err, `unsupported Value type struct { Foo string }`)
 	})
 }
+
+func Test_Value_Decode(t *testing.T) {
+	t.Run("not a map", func(t *testing.T) {
+		// Value followed by another item, after error decoder must be
+		// able to continue with the next item
+		buf := bytes.NewBuffer(nil)
+		enc := msgpack.NewEncoder(buf)
+		if err := enc.Encode(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)); err != nil {
+			t.Fatalf("encoding time as ext type: %v", err)
+		}
+		if err := enc.EncodeString("next"); err != nil {
+			t.Fatalf("encoding string: %v", err)
+		}
+
+		dec := msgpack.NewDecoder(buf)
+		var v Value
+		err := v.DecodeMsgpack(dec)
+		expectErrorMsg(t, err, `unsupported Value encoding: expected map, got extension (code 0xd6)`)
+
+		s, err := dec.DecodeString()
+		if err != nil {
+			t.Fatalf("decoding next item: %v", err)
+		}
+		if s != "next" {
+			t.Errorf("expected 'next', got %q", s)
+		}
+	})
+
+	t.Run("record with duplicate keys", func(t *testing.T) {
+		buf := bytes.NewBuffer(nil)
+		enc := msgpack.NewEncoder(buf)
+		// {"Record": {"val": {"a": 1, "a": 2}, "span": {...}}}
+		encode := func(v any) {
+			if err := enc.Encode(v); err != nil {
+				t.Fatalf("encoding %v: %v", v, err)
+			}
+		}
+		if err := enc.EncodeMapLen(1); err != nil {
+			t.Fatal(err)
+		}
+		encode("Record")
+		if err := enc.EncodeMapLen(2); err != nil {
+			t.Fatal(err)
+		}
+		encode("val")
+		if err := enc.EncodeMapLen(2); err != nil {
+			t.Fatal(err)
+		}
+		encode("a")
+		encode(&Value{Value: 1})
+		encode("a")
+		encode(&Value{Value: 2})
+		encode("span")
+		encode(Span{Start: 1, End: 2})
+
+		// the last value is used, duplicate name is recorded in the options
+		opts := &decodeOpts{}
+		var v Value
+		if err := v.DecodeMsgpack(msgpack.NewDecoder(optsReader{bytes.NewReader(buf.Bytes()), opts})); err != nil {
+			t.Fatalf("decoding record: %v", err)
+		}
+		if diff := cmp.Diff(Value{Value: Record{"a": {Value: int64(2)}}, Span: Span{Start: 1, End: 2}}, v); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]string{"a"}, opts.duplicates); diff != "" {
+			t.Errorf("duplicates mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("list of globs", func(t *testing.T) {
+		// the way engine encodes list of globs
+		glob := func(val string, noExpand bool, start int) map[string]any {
+			return map[string]any{"Glob": map[string]any{
+				"val":       val,
+				"no_expand": noExpand,
+				"span":      map[string]any{"start": start, "end": start + len(val)},
+			}}
+		}
+		b, err := msgpack.Marshal(map[string]any{"List": map[string]any{
+			"vals": []any{glob("*.go", false, 10), glob("[ab].txt", true, 20)},
+			"span": map[string]any{"start": 5, "end": 30},
+		}})
+		if err != nil {
+			t.Fatalf("encoding list: %v", err)
+		}
+
+		var v Value
+		if err := v.DecodeMsgpack(msgpack.NewDecoder(bytes.NewReader(b))); err != nil {
+			t.Fatalf("decoding list: %v", err)
+		}
+		expect := Value{
+			Value: []Value{
+				{Value: Glob{Value: "*.go"}, Span: Span{Start: 10, End: 14}},
+				{Value: Glob{Value: "[ab].txt", NoExpand: true}, Span: Span{Start: 20, End: 28}},
+			},
+			Span: Span{Start: 5, End: 30},
+		}
+		if diff := cmp.Diff(expect, v); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("record of globs", func(t *testing.T) {
+		// the way engine encodes record with glob fields
+		b, err := msgpack.Marshal(map[string]any{"Record": map[string]any{
+			"val": map[string]any{
+				"pattern": map[string]any{"Glob": map[string]any{
+					"val":       "src/**",
+					"no_expand": false,
+					"span":      map[string]any{"start": 12, "end": 18},
+				}},
+				"exclude": map[string]any{"List": map[string]any{
+					"vals": []any{map[string]any{"Glob": map[string]any{
+						"val":       "*.tmp",
+						"no_expand": true,
+						"span":      map[string]any{"start": 30, "end": 35},
+					}}},
+					"span": map[string]any{"start": 29, "end": 36},
+				}},
+			},
+			"span": map[string]any{"start": 1, "end": 37},
+		}})
+		if err != nil {
+			t.Fatalf("encoding record: %v", err)
+		}
+
+		var v Value
+		if err := v.DecodeMsgpack(msgpack.NewDecoder(bytes.NewReader(b))); err != nil {
+			t.Fatalf("decoding record: %v", err)
+		}
+		expect := Value{
+			Value: Record{
+				"pattern": {Value: Glob{Value: "src/**"}, Span: Span{Start: 12, End: 18}},
+				"exclude": {
+					Value: []Value{{Value: Glob{Value: "*.tmp", NoExpand: true}, Span: Span{Start: 30, End: 35}}},
+					Span:  Span{Start: 29, End: 36},
+				},
+			},
+			Span: Span{Start: 1, End: 37},
+		}
+		if diff := cmp.Diff(expect, v); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func Test_Value_IsEmpty(t *testing.T) {
+	testCases := []struct {
+		v       Value
+		empty   bool
+		nothing bool
+	}{
+		{v: Value{}, empty: true, nothing: true},
+		{v: Value{Value: ""}, empty: true},
+		{v: Value{Value: []Value{}}, empty: true},
+		{v: Value{Value: Record{}}, empty: true},
+		{v: Value{Value: Record(nil)}, empty: true},
+		{v: Value{Value: []byte{}}, empty: true},
+		{v: Value{Value: " "}},
+		{v: Value{Value: []Value{{}}}},
+		{v: Value{Value: Record{"a": {}}}},
+		{v: Value{Value: []byte{0}}},
+		{v: Value{Value: int64(0)}},
+		{v: Value{Value: false}},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.v.IsEmpty(); got != tc.empty {
+			t.Errorf("IsEmpty(%#v): expected %t, got %t", tc.v.Value, tc.empty, got)
+		}
+		if got := tc.v.IsNothing(); got != tc.nothing {
+			t.Errorf("IsNothing(%#v): expected %t, got %t", tc.v.Value, tc.nothing, got)
+		}
+	}
+}
+
+func Test_Value_AsBoolLoose(t *testing.T) {
+	accepted := []struct {
+		v      any
+		expect bool
+	}{
+		{v: true, expect: true},
+		{v: false, expect: false},
+		{v: int64(1), expect: true},
+		{v: int64(0), expect: false},
+		{v: 1, expect: true},
+		{v: 0, expect: false},
+		{v: "true", expect: true},
+		{v: "False", expect: false},
+		{v: "yes", expect: true},
+		{v: "NO", expect: false},
+		{v: "1", expect: true},
+		{v: "0", expect: false},
+	}
+	for _, tc := range accepted {
+		got, err := Value{Value: tc.v}.AsBoolLoose()
+		if err != nil {
+			t.Errorf("%#v: unexpected error: %v", tc.v, err)
+		}
+		if got != tc.expect {
+			t.Errorf("%#v: expected %t, got %t", tc.v, tc.expect, got)
+		}
+	}
+
+	rejected := []struct {
+		v   any
+		typ string // Nushell type name in the error label
+	}{
+		{nil, "nothing"}, {int64(2), "int"}, {-1, "int"}, {"", "string"}, {"maybe", "string"},
+		{"t", "string"}, {1.0, "float"}, {[]Value{}, "list<any>"},
+	}
+	for _, tc := range rejected {
+		_, err := Value{Value: tc.v, Span: Span{Start: 3, End: 7}}.AsBoolLoose()
+		var le *LabeledError
+		if !errors.As(err, &le) {
+			t.Errorf("%#v: expected LabeledError, got %v", tc.v, err)
+			continue
+		}
+		if le.Msg != "can't convert value to bool" || len(le.Labels) != 1 || le.Labels[0].Span != (Span{Start: 3, End: 7}) {
+			t.Errorf("%#v: unexpected error %#v", tc.v, le)
+			continue
+		}
+		if text := "expected bool, 0/1 or true/false/yes/no, got " + tc.typ; le.Labels[0].Text != text {
+			t.Errorf("%#v: expected label %q, got %q", tc.v, text, le.Labels[0].Text)
+		}
+	}
+}
+
+func Test_Value_MarshalJSON(t *testing.T) {
+	date := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	testCases := []struct {
+		in  Value
+		out string
+	}{
+		{in: Value{}, out: `null`},
+		{in: Value{Value: true}, out: `true`},
+		{in: Value{Value: int64(-5)}, out: `-5`},
+		{in: Value{Value: 1.5}, out: `1.5`},
+		{in: Value{Value: "foo"}, out: `"foo"`},
+		{in: Value{Value: []byte("bin")}, out: `"Ymlu"`},
+		{in: Value{Value: Filesize(1024)}, out: `1024`},
+		{in: Value{Value: 2 * time.Second}, out: `2000000000`},
+		{in: Value{Value: date}, out: `"2024-05-06T07:08:09Z"`},
+		{in: Value{Value: Glob{Value: "*.go"}}, out: `"*.go"`},
+		{in: Value{Value: CellPath{Members: []PathMember{{Type: PathMemberString, Name: "a"}, {Type: PathMemberInt, Index: 1}}}}, out: `"a.1"`},
+		{in: Value{Value: IntRange{Start: 1, Step: 1, End: 3, Bound: Included}}, out: `[1,2,3]`},
+		{in: Value{Value: []Value(nil)}, out: `[]`},
+		{in: Value{Value: []Value{{Value: 1}, {Value: "a"}, {}}}, out: `[1,"a",null]`},
+		{in: Value{Value: Record{"b": {Value: []Value{{Value: false}}}, "a": {Value: Record{}}}}, out: `{"a":{},"b":[false]}`},
+		{in: Value{Value: LabeledError{Msg: "oops"}}, out: `{"error":"oops"}`},
+		{in: Value{Value: fmt.Errorf("failed")}, out: `{"error":"failed"}`},
+	}
+
+	for _, tc := range testCases {
+		b, err := json.Marshal(tc.in)
+		if err != nil {
+			t.Errorf("marshaling %#v: %v", tc.in.Value, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.out, string(b)); diff != "" {
+			t.Errorf("%#v: mismatch (-want +got):\n%s", tc.in.Value, diff)
+		}
+	}
+
+	for _, v := range []any{Closure{BlockID: 1}, Block(2), IntRange{Start: 1, Step: 1, Bound: Unbounded}} {
+		if _, err := json.Marshal(Value{Value: v}); err == nil {
+			t.Errorf("expected error marshaling %T", v)
+		}
+	}
+}
+
+func Test_Value_UnmarshalJSON(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		in := Value{Value: Record{
+			"nothing": {},
+			"bool":    {Value: true},
+			"int":     {Value: int64(-42)},
+			"float":   {Value: 2.5},
+			"string":  {Value: "foo"},
+			"list":    {Value: []Value{{Value: int64(1)}, {Value: "a"}, {Value: []Value{}}}},
+			"record":  {Value: Record{"x": {Value: Record{}}}},
+		}}
+		b, err := json.Marshal(in)
+		if err != nil {
+			t.Fatalf("marshaling: %v", err)
+		}
+		var out Value
+		if err := json.Unmarshal(b, &out); err != nil {
+			t.Fatalf("unmarshaling: %v", err)
+		}
+		if diff := cmp.Diff(in, out); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("lossy", func(t *testing.T) {
+		testCases := []struct {
+			in  Value
+			out Value
+		}{
+			{in: Value{Value: []byte("bin")}, out: Value{Value: "Ymlu"}},
+			{in: Value{Value: Filesize(10)}, out: Value{Value: int64(10)}},
+			{in: Value{Value: time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)}, out: Value{Value: "2024-05-06T07:08:09Z"}},
+			{in: Value{Value: 1e20}, out: Value{Value: 1e20}},
+			{in: Value{Value: 3.0}, out: Value{Value: int64(3)}},
+		}
+		for _, tc := range testCases {
+			b, err := json.Marshal(tc.in)
+			if err != nil {
+				t.Fatalf("marshaling: %v", err)
+			}
+			var out Value
+			if err := json.Unmarshal(b, &out); err != nil {
+				t.Fatalf("unmarshaling: %v", err)
+			}
+			if diff := cmp.Diff(tc.out, out); diff != "" {
+				t.Errorf("%#v: mismatch (-want +got):\n%s", tc.in.Value, diff)
+			}
+		}
+	})
+
+	t.Run("invalid JSON", func(t *testing.T) {
+		var v Value
+		if err := v.UnmarshalJSON([]byte(`{"a":`)); err == nil {
+			t.Error("expected error")
+		}
+	})
+}